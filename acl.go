@@ -0,0 +1,507 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	MAY_EXEC  uint16 = 1
+	MAY_WRITE uint16 = 2
+	MAY_READ  uint16 = 4
+)
+
+// tags of the ACL entries, the same as in Linux
+const (
+	ACL_USER_OBJ  uint16 = 0x01
+	ACL_USER      uint16 = 0x02
+	ACL_GROUP_OBJ uint16 = 0x04
+	ACL_GROUP     uint16 = 0x08
+	ACL_MASK      uint16 = 0x10
+	ACL_OTHER     uint16 = 0x20
+)
+
+type ACLType int
+
+const (
+	ACL_TYPE_ACCESS ACLType = iota
+	ACL_TYPE_DEFAULT
+)
+
+const (
+	XATTR_ACL_ACCESS  = "system.posix_acl_access"
+	XATTR_ACL_DEFAULT = "system.posix_acl_default"
+	ACL_VERSION       = 2
+	// version, then tag (2 bytes), permissions (2 bytes) and id (4 bytes)
+	// for every entry
+	ACL_HEADER_SIZE = 4
+	ACL_ENTRY_SIZE  = 2 + 2 + 4
+)
+
+var ErrPermission error = newError("permission denied", syscall.EACCES)
+var ErrInvalidACL error = newError("invalid ACL", syscall.EINVAL)
+
+type ACLEntry struct {
+	Tag  uint16
+	Perm uint16
+	Id   uint32
+}
+
+type ACL []ACLEntry
+
+// aclType returns the kind of ACL the extended attribute holds
+func aclType(name string) (ACLType, bool) {
+	switch name {
+	case XATTR_ACL_ACCESS:
+		return ACL_TYPE_ACCESS, true
+	case XATTR_ACL_DEFAULT:
+		return ACL_TYPE_DEFAULT, true
+	}
+	return 0, false
+}
+
+func (t ACLType) xattr() string {
+	if t == ACL_TYPE_DEFAULT {
+		return XATTR_ACL_DEFAULT
+	}
+	return XATTR_ACL_ACCESS
+}
+
+func decodeACL(data []byte) (ACL, error) {
+	if len(data) < ACL_HEADER_SIZE || (len(data)-ACL_HEADER_SIZE)%ACL_ENTRY_SIZE != 0 {
+		return nil, ErrInvalidACL
+	}
+	if binary.BigEndian.Uint32(data) != ACL_VERSION {
+		return nil, ErrInvalidACL
+	}
+	acl := ACL{}
+	for data = data[ACL_HEADER_SIZE:]; len(data) != 0; data = data[ACL_ENTRY_SIZE:] {
+		acl = append(acl, ACLEntry{
+			Tag:  binary.BigEndian.Uint16(data),
+			Perm: binary.BigEndian.Uint16(data[2:]),
+			Id:   binary.BigEndian.Uint32(data[4:]),
+		})
+	}
+	// the checks expect the entries of the owner, the group and the others
+	if !acl.valid() {
+		return nil, ErrInvalidACL
+	}
+	return acl, nil
+}
+
+func (acl ACL) encode() []byte {
+	data := binary.BigEndian.AppendUint32(nil, ACL_VERSION)
+	for _, entry := range acl {
+		data = binary.BigEndian.AppendUint16(data, entry.Tag)
+		data = binary.BigEndian.AppendUint16(data, entry.Perm)
+		data = binary.BigEndian.AppendUint32(data, entry.Id)
+	}
+	return data
+}
+
+// sort puts the entries in the order they're checked in
+func (acl ACL) sort() {
+	sort.Slice(acl, func(i, j int) bool {
+		if acl[i].Tag != acl[j].Tag {
+			return acl[i].Tag < acl[j].Tag
+		}
+		return acl[i].Id < acl[j].Id
+	})
+}
+
+func (acl ACL) find(tag uint16, id uint32) int {
+	for i, entry := range acl {
+		if entry.Tag == tag && (entry.Id == id || (tag != ACL_USER && tag != ACL_GROUP)) {
+			return i
+		}
+	}
+	return -1
+}
+
+// minimal tells if the ACL can be expressed with the mode bits
+func (acl ACL) minimal() bool {
+	return len(acl) == 3
+}
+
+func (acl ACL) valid() bool {
+	seen := map[ACLEntry]bool{}
+	count := map[uint16]int{}
+	for _, entry := range acl {
+		if entry.Perm&^(MAY_READ|MAY_WRITE|MAY_EXEC) != 0 {
+			return false
+		}
+		key := ACLEntry{Tag: entry.Tag, Id: entry.Id}
+		if seen[key] {
+			return false
+		}
+		seen[key] = true
+		count[entry.Tag]++
+	}
+	if count[ACL_USER_OBJ] != 1 || count[ACL_GROUP_OBJ] != 1 || count[ACL_OTHER] != 1 {
+		return false
+	}
+	// named entries are limited by the mask
+	named := count[ACL_USER]+count[ACL_GROUP] != 0
+	return count[ACL_MASK] == 1 || (!named && count[ACL_MASK] == 0)
+}
+
+// computeMask sets the mask to the union of the group class permissions
+func (acl *ACL) computeMask() {
+	var mask uint16
+	named := false
+	for _, entry := range *acl {
+		switch entry.Tag {
+		case ACL_USER, ACL_GROUP:
+			named = true
+			mask |= entry.Perm
+		case ACL_GROUP_OBJ:
+			mask |= entry.Perm
+		}
+	}
+	i := acl.find(ACL_MASK, 0)
+	if !named && i == -1 {
+		return
+	}
+	if i == -1 {
+		*acl = append(*acl, ACLEntry{Tag: ACL_MASK})
+		i = len(*acl) - 1
+	}
+	(*acl)[i].Perm = mask
+}
+
+// modeACL returns the ACL that is equivalent to the mode bits
+func modeACL(mode uint16) ACL {
+	return ACL{
+		{Tag: ACL_USER_OBJ, Perm: (mode >> 6) & 7},
+		{Tag: ACL_GROUP_OBJ, Perm: (mode >> 3) & 7},
+		{Tag: ACL_OTHER, Perm: mode & 7},
+	}
+}
+
+// applyMode updates the mode bits from the ACL, the group bits reflect the
+// mask if there is one
+func (acl ACL) applyMode(mode uint16) uint16 {
+	group := acl.find(ACL_MASK, 0)
+	if group == -1 {
+		group = acl.find(ACL_GROUP_OBJ, 0)
+	}
+	mode &^= 0777
+	mode |= acl[acl.find(ACL_USER_OBJ, 0)].Perm << 6
+	mode |= acl[group].Perm << 3
+	mode |= acl[acl.find(ACL_OTHER, 0)].Perm
+	return mode
+}
+
+func (s *Session) inGroup(gid uint32) bool {
+	if s.gid == gid {
+		return true
+	}
+	for _, group := range s.groups {
+		if group == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// readACL returns the ACL of the inode, the caller holds its lock. The
+// access ACL falls back to the mode bits, a missing default ACL is nil.
+func (f *FileSystem) readACL(inode *Inode, kind ACLType) (ACL, error) {
+	attrs, err := f.readXattrs(inode)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := attrs[kind.xattr()]
+	if !ok {
+		if kind == ACL_TYPE_DEFAULT {
+			return nil, nil
+		}
+		return modeACL(inode.mode), nil
+	}
+	return decodeACL(data)
+}
+
+// writeACL stores the ACL, nil removes it. The caller holds the lock.
+func (f *FileSystem) writeACL(inode *Inode, kind ACLType, acl ACL) error {
+	attrs, err := f.readXattrs(inode)
+	if err != nil {
+		return err
+	}
+	if kind == ACL_TYPE_ACCESS && acl != nil {
+		inode.mode = acl.applyMode(inode.mode)
+		// the mode bits are enough
+		if acl.minimal() {
+			acl = nil
+		}
+	}
+	if acl == nil {
+		delete(attrs, kind.xattr())
+	} else {
+		acl.sort()
+		attrs[kind.xattr()] = acl.encode()
+	}
+	return f.writeXattrs(inode, attrs)
+}
+
+// access checks that the session may use the inode, want is a combination
+// of MAY_READ, MAY_WRITE and MAY_EXEC. The caller holds the inode lock.
+func (f *FileSystem) access(inode *Inode, want uint16) error {
+	if want&MAY_WRITE != 0 && inode.flags&FLAG_SNAPSHOT != 0 {
+		return ErrReadOnlySnapshot
+	}
+	session := &f.Session
+	if session.uid == 0 {
+		return nil
+	}
+	acl, err := f.readACL(inode, ACL_TYPE_ACCESS)
+	if err != nil {
+		return err
+	}
+	var mask uint16 = 7
+	if i := acl.find(ACL_MASK, 0); i != -1 {
+		mask = acl[i].Perm
+	}
+	granted := func(perm uint16) error {
+		if perm&want == want {
+			return nil
+		}
+		return ErrPermission
+	}
+	// the owner, then named users, then the groups and the others
+	if session.uid == inode.uid {
+		return granted(acl[acl.find(ACL_USER_OBJ, 0)].Perm)
+	}
+	if i := acl.find(ACL_USER, session.uid); i != -1 {
+		return granted(acl[i].Perm & mask)
+	}
+	matched := false
+	for _, entry := range acl {
+		if (entry.Tag == ACL_GROUP_OBJ && session.inGroup(inode.gid)) ||
+			(entry.Tag == ACL_GROUP && session.inGroup(entry.Id)) {
+			matched = true
+			if granted(entry.Perm&mask) == nil {
+				return nil
+			}
+		}
+	}
+	if matched {
+		return ErrPermission
+	}
+	return granted(acl[acl.find(ACL_OTHER, 0)].Perm)
+}
+
+// inheritACL gives a new inode the default ACL of its directory. The mode
+// limits the permissions of the owner, the group class and the others.
+func (f *FileSystem) inheritACL(dir *Inode, file *Inode) error {
+	acl, err := f.readACL(dir, ACL_TYPE_DEFAULT)
+	if err != nil || acl == nil {
+		return err
+	}
+	if file.fileType == DIRECTORY {
+		err = f.writeACL(file, ACL_TYPE_DEFAULT, acl)
+		if err != nil {
+			return err
+		}
+	}
+	access := make(ACL, len(acl))
+	copy(access, acl)
+	group := access.find(ACL_MASK, 0)
+	if group == -1 {
+		group = access.find(ACL_GROUP_OBJ, 0)
+	}
+	access[access.find(ACL_USER_OBJ, 0)].Perm &= (file.mode >> 6) & 7
+	access[group].Perm &= (file.mode >> 3) & 7
+	access[access.find(ACL_OTHER, 0)].Perm &= file.mode & 7
+	return f.writeACL(file, ACL_TYPE_ACCESS, access)
+}
+
+func (f *FileSystem) GetACL(file int64, kind ACLType) (ACL, error) {
+	lock := f.locks.Inode(file)
+	lock.RLock()
+	defer lock.RUnlock()
+	inode, err := f.ReadInode(file)
+	if err != nil {
+		return nil, err
+	}
+	return f.readACL(&inode, kind)
+}
+
+// SetACL replaces the ACL of the file, nil removes it. Only the owner can
+// change it.
+func (f *FileSystem) SetACL(file int64, kind ACLType, acl ACL) error {
+	if err := f.writable(); err != nil {
+		return err
+	}
+	if acl != nil && !acl.valid() {
+		return ErrInvalidACL
+	}
+	lock := f.locks.Inode(file)
+	lock.Lock()
+	defer lock.Unlock()
+	inode, err := f.ReadInode(file)
+	if err != nil {
+		return err
+	}
+	if f.Session.uid != 0 && f.Session.uid != inode.uid {
+		return ErrPermission
+	}
+	if inode.flags&FLAG_SNAPSHOT != 0 {
+		return ErrReadOnlySnapshot
+	}
+	if kind == ACL_TYPE_DEFAULT && inode.fileType != DIRECTORY {
+		return ErrFileIsNotDir
+	}
+	// without the extended entries only the mode bits are left
+	if kind == ACL_TYPE_ACCESS && acl == nil {
+		acl = modeACL(inode.mode)
+	}
+	err = f.writeACL(&inode, kind, acl)
+	if err != nil {
+		return err
+	}
+	return f.commit()
+}
+
+func permString(perm uint16) string {
+	str := []byte("---")
+	if perm&MAY_READ != 0 {
+		str[0] = 'r'
+	}
+	if perm&MAY_WRITE != 0 {
+		str[1] = 'w'
+	}
+	if perm&MAY_EXEC != 0 {
+		str[2] = 'x'
+	}
+	return string(str)
+}
+
+func parsePerm(str string) (uint16, error) {
+	var perm uint16
+	for _, c := range str {
+		switch c {
+		case 'r':
+			perm |= MAY_READ
+		case 'w':
+			perm |= MAY_WRITE
+		case 'x':
+			perm |= MAY_EXEC
+		case '-':
+		default:
+			return 0, ErrInvalidACL
+		}
+	}
+	return perm, nil
+}
+
+// String formats the ACL like getfacl does
+func (acl ACL) String() string {
+	names := map[uint16]string{
+		ACL_USER_OBJ:  "user",
+		ACL_USER:      "user",
+		ACL_GROUP_OBJ: "group",
+		ACL_GROUP:     "group",
+		ACL_MASK:      "mask",
+		ACL_OTHER:     "other",
+	}
+	lines := []string{}
+	for _, entry := range acl {
+		id := ""
+		if entry.Tag == ACL_USER || entry.Tag == ACL_GROUP {
+			id = strconv.FormatUint(uint64(entry.Id), 10)
+		}
+		lines = append(lines, fmt.Sprintf("%s:%s:%s", names[entry.Tag], id, permString(entry.Perm)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ParseACLEntry parses entries like "u:1000:rw-", "g::r-x", "m::rwx" or
+// "o::r--". Without permissions, like for setfacl -x, they're left zero.
+func ParseACLEntry(str string, withPerm bool) (ACLEntry, error) {
+	parts := strings.Split(str, ":")
+	if (withPerm && len(parts) != 3) || (!withPerm && len(parts) != 2 && len(parts) != 3) {
+		return ACLEntry{}, ErrInvalidACL
+	}
+	entry := ACLEntry{}
+	named := parts[1] != ""
+	switch parts[0] {
+	case "u", "user":
+		entry.Tag = ACL_USER_OBJ
+		if named {
+			entry.Tag = ACL_USER
+		}
+	case "g", "group":
+		entry.Tag = ACL_GROUP_OBJ
+		if named {
+			entry.Tag = ACL_GROUP
+		}
+	case "m", "mask":
+		entry.Tag = ACL_MASK
+	case "o", "other":
+		entry.Tag = ACL_OTHER
+	default:
+		return ACLEntry{}, ErrInvalidACL
+	}
+	if named {
+		if entry.Tag != ACL_USER && entry.Tag != ACL_GROUP {
+			return ACLEntry{}, ErrInvalidACL
+		}
+		id, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			return ACLEntry{}, ErrInvalidACL
+		}
+		entry.Id = uint32(id)
+	}
+	if withPerm {
+		perm, err := parsePerm(parts[2])
+		if err != nil {
+			return ACLEntry{}, err
+		}
+		entry.Perm = perm
+	}
+	return entry, nil
+}
+
+// Modify adds or replaces entries, like setfacl -m. The mask is
+// recalculated unless it's given.
+func (acl ACL) Modify(entries []ACLEntry) ACL {
+	result := make(ACL, len(acl))
+	copy(result, acl)
+	maskGiven := false
+	for _, entry := range entries {
+		if entry.Tag == ACL_MASK {
+			maskGiven = true
+		}
+		if i := result.find(entry.Tag, entry.Id); i != -1 {
+			result[i].Perm = entry.Perm
+		} else {
+			result = append(result, entry)
+		}
+	}
+	if !maskGiven {
+		result.computeMask()
+	}
+	return result
+}
+
+// Remove drops entries, like setfacl -x
+func (acl ACL) Remove(entries []ACLEntry) ACL {
+	result := ACL{}
+	for _, entry := range acl {
+		removed := false
+		for _, remove := range entries {
+			if entry.Tag == remove.Tag && (entry.Id == remove.Id || (entry.Tag != ACL_USER && entry.Tag != ACL_GROUP)) {
+				removed = true
+			}
+		}
+		if !removed {
+			result = append(result, entry)
+		}
+	}
+	result.computeMask()
+	return result
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestACLNamedUser(t *testing.T) {
+	f := newTestFileSystem(t, MountOptions{})
+	root := f.Superblock.Root
+	if err := f.SetACL(root, ACL_TYPE_ACCESS, modeACL(0777)); err != nil {
+		t.Fatal(err)
+	}
+	f.Session.uid, f.Session.gid = 1000, 1000
+	file, err := f.Create(root, "x", REGULAR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 3)
+	f.Session.uid, f.Session.gid = 2000, 2000
+	if _, err := f.ReadFile(file, 0, buf); !errors.Is(err, ErrPermission) {
+		t.Fatalf("read by another user: %v", err)
+	}
+	if err := f.SetACL(file, ACL_TYPE_ACCESS, modeACL(0777)); !errors.Is(err, ErrPermission) {
+		t.Fatalf("ACL set by another user: %v", err)
+	}
+	f.Session.uid = 1000
+	acl, err := f.GetACL(file, ACL_TYPE_ACCESS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl = acl.Modify([]ACLEntry{{Tag: ACL_USER, Id: 2000, Perm: MAY_READ}})
+	if err := f.SetACL(file, ACL_TYPE_ACCESS, acl); err != nil {
+		t.Fatal(err)
+	}
+	f.Session.uid = 2000
+	if _, err := f.ReadFile(file, 0, buf); err != nil {
+		t.Fatalf("read by the named user: %v", err)
+	}
+	if _, err := f.WriteFile(file, 0, buf); !errors.Is(err, ErrPermission) {
+		t.Fatalf("write by the named user: %v", err)
+	}
+}
+
+func TestACLDefaultInherited(t *testing.T) {
+	f := newTestFileSystem(t, MountOptions{})
+	root := f.Superblock.Root
+	dir, err := f.Create(root, "d", DIRECTORY, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	def := modeACL(0750).Modify([]ACLEntry{{Tag: ACL_GROUP, Id: 3000, Perm: 7}})
+	if err := f.SetACL(dir, ACL_TYPE_DEFAULT, def); err != nil {
+		t.Fatal(err)
+	}
+	file, err := f.Create(dir, "n", REGULAR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := f.Create(dir, "sub", DIRECTORY, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subDefault, err := f.GetACL(sub, ACL_TYPE_DEFAULT)
+	if err != nil || len(subDefault) != len(def) {
+		t.Fatalf("default ACL of the subdirectory: %v %v", subDefault, err)
+	}
+	f.Session.uid, f.Session.gid, f.Session.groups = 5, 5, []uint32{3000}
+	if _, err := f.WriteFile(file, 0, []byte("x")); err != nil {
+		t.Fatalf("write by the named group: %v", err)
+	}
+	f.Session.groups = nil
+	if _, err := f.WriteFile(file, 0, []byte("x")); !errors.Is(err, ErrPermission) {
+		t.Fatalf("write by the others: %v", err)
+	}
+}
+
+func TestACLInvalidXattr(t *testing.T) {
+	f := newTestFileSystem(t, MountOptions{})
+	root := f.Superblock.Root
+	if err := f.SetACL(root, ACL_TYPE_ACCESS, modeACL(0777)); err != nil {
+		t.Fatal(err)
+	}
+	f.Session.uid, f.Session.gid = 1000, 1000
+	file, err := f.Create(root, "x", REGULAR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the header, without the entries of the owner and the others
+	header := ACL{}.encode()
+	err = f.SetXattr(file, XATTR_ACL_ACCESS, header, 0)
+	if !errors.Is(err, ErrInvalidACL) {
+		t.Fatalf("header-only ACL: %v", err)
+	}
+	f.Session.uid = 2000
+	if _, err := f.ReadFile(file, 0, make([]byte, 1)); err != nil {
+		t.Fatalf("read after the rejected ACL: %v", err)
+	}
+	// a raw ACL is applied like SetACL does
+	f.Session.uid = 1000
+	if err := f.SetXattr(file, XATTR_ACL_ACCESS, modeACL(0600).encode(), 0); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := f.Stat(file)
+	if err != nil || stat.mode&0777 != 0600 {
+		t.Fatalf("mode %o after the ACL: %v", stat.mode, err)
+	}
+	if err := f.SetXattr(file, XATTR_ACL_DEFAULT, modeACL(0600).encode(), 0); !errors.Is(err, ErrFileIsNotDir) {
+		t.Fatalf("default ACL of a file: %v", err)
+	}
+}
+
+func TestACLDecodeRejectsInvalid(t *testing.T) {
+	for _, acl := range []ACL{
+		{},
+		{{Tag: ACL_USER_OBJ, Perm: 7}},
+		{{Tag: ACL_USER_OBJ, Perm: 7}, {Tag: ACL_GROUP_OBJ}, {Tag: ACL_OTHER}, {Tag: ACL_USER, Id: 5, Perm: 4}},
+	} {
+		if _, err := decodeACL(acl.encode()); !errors.Is(err, ErrInvalidACL) {
+			t.Errorf("%v decoded: %v", acl, err)
+		}
+	}
+	if _, err := decodeACL(modeACL(0644).encode()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,20 +1,51 @@
 package main
 
 import (
+	"bufio"
 	"encoding/binary"
-	"fmt"
+	"errors"
 	"io"
+	"sort"
+	"syscall"
 )
 
 type Block int64
 
-func (f *FileSystem) AllocateBlock() (Block, error) {
-	block, err := f.FindFreeBlock()
+// marks a block pointer that isn't set
+const NO_BLOCK int64 = -1
+
+// Every used block has a reference count, so files and snapshots can share
+// it. The counts are kept after the block bitmap, BLOCK_REF_SIZE bytes each.
+const BLOCK_REF_SIZE = 4
+
+// AllocateBlock returns a new block and charges the owner for it. The owner
+// is nil when the block takes the place of one the owner already has.
+func (f *FileSystem) AllocateBlock(owner *Inode) (Block, error) {
+	if err := f.writable(); err != nil {
+		return -1, err
+	}
+	err := f.charge(owner, 1, 0)
 	if err != nil {
 		return -1, err
 	}
-	err = f.SetBlockBitmapOffset(block, USED)
+	// the search and the update of the bitmap have to be atomic
+	f.locks.blockBitmap.Lock()
+	block, err := f.FindFreeBlock()
+	if err == nil {
+		err = f.SetBlockBitmapOffset(block, USED)
+	}
+	if err == nil {
+		err = f.setBlockRefs(block, 1)
+	}
+	if err == nil {
+		delete(f.discards, block)
+	}
+	if err == nil {
+		f.freeBlocks--
+	}
+	f.locks.blockBitmap.Unlock()
 	if err != nil {
+		f.charge(owner, -1, 0)
 		return -1, err
 	}
 	err = f.ClearBlock(block)
@@ -24,21 +55,230 @@ func (f *FileSystem) AllocateBlock() (Block, error) {
 	return block, nil
 }
 
+// FreeBlock drops the reference of the owner to the block, it's freed with
+// the last one. The owner is nil when the block is replaced.
+func (f *FileSystem) FreeBlock(owner *Inode, block Block) error {
+	err := f.freeBlock(block)
+	if err != nil {
+		return err
+	}
+	return f.charge(owner, -1, 0)
+}
+
+func (f *FileSystem) freeBlock(block Block) error {
+	f.locks.blockBitmap.Lock()
+	defer f.locks.blockBitmap.Unlock()
+	refs, err := f.blockRefs(block)
+	if err != nil {
+		return err
+	}
+	if refs > 1 {
+		return f.setBlockRefs(block, refs-1)
+	}
+	// drop the cached content before somebody else can allocate the block
+	f.blocks.Remove(block)
+	f.index.forget(block)
+	err = f.setBlockRefs(block, 0)
+	if err != nil {
+		return err
+	}
+	err = f.SetBlockBitmapOffset(block, FREE)
+	if err != nil {
+		return err
+	}
+	f.freeBlocks++
+	f.discards[block] = true
+	return nil
+}
+
+// RefBlock adds a reference to a used block
+func (f *FileSystem) RefBlock(block Block) error {
+	f.locks.blockBitmap.Lock()
+	defer f.locks.blockBitmap.Unlock()
+	refs, err := f.blockRefs(block)
+	if err != nil {
+		return err
+	}
+	return f.setBlockRefs(block, refs+1)
+}
+
+// refUsedBlock adds a reference to the block unless it's free
+func (f *FileSystem) refUsedBlock(block Block) (bool, error) {
+	f.locks.blockBitmap.Lock()
+	defer f.locks.blockBitmap.Unlock()
+	refs, err := f.blockRefs(block)
+	if err != nil || refs == 0 {
+		return false, err
+	}
+	return true, f.setBlockRefs(block, refs+1)
+}
+
+// BlockRefs returns the number of references to the block
+func (f *FileSystem) BlockRefs(block Block) (uint32, error) {
+	f.locks.blockBitmap.Lock()
+	defer f.locks.blockBitmap.Unlock()
+	return f.blockRefs(block)
+}
+
+// blockRefs and setBlockRefs expect the caller to hold the bitmap lock
+func (f *FileSystem) blockRefs(block Block) (uint32, error) {
+	buffer := make([]byte, BLOCK_REF_SIZE)
+	_, err := f.Device.ReadAt(buffer, f.Superblock.BlockRefsOffset+int64(block)*BLOCK_REF_SIZE)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(buffer), nil
+}
+
+func (f *FileSystem) setBlockRefs(block Block, refs uint32) error {
+	buffer := binary.BigEndian.AppendUint32(nil, refs)
+	_, err := f.Device.WriteAt(buffer, f.Superblock.BlockRefsOffset+int64(block)*BLOCK_REF_SIZE)
+	return err
+}
+
+// usableBlocks is the number of blocks the bitmap covers, the last ones are
+// never used when BlockCount isn't a multiple of 8
+func (f *FileSystem) usableBlocks() int64 {
+	return f.Superblock.BlockCount / 8 * 8
+}
+
 func (f *FileSystem) ClearBlock(block Block) error {
+	return f.blocks.Put(block, make([]byte, BLOCK_SIZE))
+}
+
+// readBlock returns the content of the block, the caller must not change it
+func (f *FileSystem) readBlock(block Block) ([]byte, error) {
+	data, ok := f.blocks.Get(block)
+	if ok {
+		return data, nil
+	}
+	data = make([]byte, BLOCK_SIZE)
+	location := f.Superblock.BlocksOffset + int64(block)*BLOCK_SIZE
+	_, err := f.Device.ReadAt(data, location)
+	if err != nil {
+		return nil, err
+	}
+	f.decrypt(data, uint64(block))
+	return f.blocks.Fill(block, data)
+}
+
+func (f *FileSystem) writeBlockToDisk(block Block, data []byte) error {
 	location := f.Superblock.BlocksOffset + int64(block)*BLOCK_SIZE
-	f.File.Seek(location, io.SeekStart)
-	bytes := make([]byte, BLOCK_SIZE)
-	_, err := f.File.Write(bytes)
+	// a block of zeros is punched to keep the image sparse, the encrypted
+	// ones don't read as zeros
+	if f.cipher == nil && isZero(data) {
+		if d, ok := f.Device.(discarder); ok && d.Discard(location, BLOCK_SIZE) == nil {
+			return nil
+		}
+	}
+	_, err := f.Device.WriteAt(f.encrypt(data, uint64(block)), location)
 	return err
 }
 
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// discardBlocks gives count blocks from block back to the device, it fails
+// with ENOTSUP when the device or the host can't
+func (f *FileSystem) discardBlocks(block Block, count int64) error {
+	d, ok := f.Device.(discarder)
+	if !ok {
+		return ErrNoDiscard
+	}
+	location := f.Superblock.BlocksOffset + int64(block)*BLOCK_SIZE
+	err := d.Discard(location, count*BLOCK_SIZE)
+	if errors.Is(err, syscall.EOPNOTSUPP) {
+		return ErrNoDiscard
+	}
+	return err
+}
+
+// discardFreed punches the blocks freed since the last Sync. They aren't
+// punched when they are freed: the inodes on disk may still point to them
+// until the cache is written back, and a crash before that would find
+// zeros in place of the old content.
+func (f *FileSystem) discardFreed() error {
+	f.locks.blockBitmap.Lock()
+	defer f.locks.blockBitmap.Unlock()
+	blocks := make([]Block, 0, len(f.discards))
+	for block := range f.discards {
+		blocks = append(blocks, block)
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i] < blocks[j] })
+	// the runs are punched at once, the host frees only its whole blocks
+	for start := 0; start < len(blocks); {
+		end := start + 1
+		for end < len(blocks) && blocks[end] == blocks[end-1]+1 {
+			end++
+		}
+		err := f.discardBlocks(blocks[start], int64(end-start))
+		if errors.Is(err, syscall.ENOTSUP) {
+			// the blocks stay on the host, trim tells why
+			f.discards = make(map[Block]bool)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, block := range blocks[start:end] {
+			delete(f.discards, block)
+		}
+		start = end
+	}
+	return nil
+}
+
+// Trim discards all the free blocks and returns their number, for images
+// whose blocks were freed before they were punched on Sync
+func (f *FileSystem) Trim() (int64, error) {
+	if err := f.writable(); err != nil {
+		return 0, err
+	}
+	// nothing on disk may point to a free block before it's punched
+	err := f.Sync()
+	if err != nil {
+		return 0, err
+	}
+	f.locks.blockBitmap.Lock()
+	defer f.locks.blockBitmap.Unlock()
+	bitmap := make([]byte, f.Superblock.BlockCount/8)
+	_, err = f.Device.ReadAt(bitmap, f.Superblock.BlockBitmapOffset)
+	if err != nil {
+		return 0, err
+	}
+	// the runs of free blocks are discarded at once
+	var trimmed, start int64 = 0, -1
+	for block := int64(0); block <= f.usableBlocks(); block++ {
+		// the blocks freed since the Sync wait for the next one
+		free := block < f.usableBlocks() && bitmap[block/8]&(1<<(block%8)) == 0 && !f.discards[Block(block)]
+		if free && start < 0 {
+			start = block
+		}
+		if !free && start >= 0 {
+			err = f.discardBlocks(Block(start), block-start)
+			if err != nil {
+				return trimmed, err
+			}
+			trimmed += block - start
+			start = -1
+		}
+	}
+	return trimmed, nil
+}
+
 func (f *FileSystem) FindFreeBlock() (Block, error) {
 	start := f.Superblock.BlockBitmapOffset
-	f.File.Seek(start, io.SeekStart)
+	bitmap := bufio.NewReader(io.NewSectionReader(f.Device, start, f.Superblock.BlockCount/8))
 	var bbyte int64 = 0
 	for ; bbyte < f.Superblock.BlockCount/8; bbyte++ {
 		var word byte
-		err := binary.Read(f.File, binary.BigEndian, &word)
+		err := binary.Read(bitmap, binary.BigEndian, &word)
 		if err != nil {
 			return -1, err
 		}
@@ -53,17 +293,17 @@ func (f *FileSystem) FindFreeBlock() (Block, error) {
 		}
 	}
 
-	return -1, fmt.Errorf("out of memory")
+	return -1, ErrNoSpace
 }
 
 func (f *FileSystem) SetBlockBitmapOffset(block Block, status int) error {
 	byte_position := f.Superblock.BlockBitmapOffset + int64(block)/8
-	f.File.Seek(byte_position, io.SeekStart)
-	var bbyte byte
-	err := binary.Read(f.File, binary.BigEndian, &bbyte)
+	buffer := make([]byte, 1)
+	_, err := f.Device.ReadAt(buffer, byte_position)
 	if err != nil {
 		return err
 	}
+	bbyte := buffer[0]
 	bbit := block % 8
 	if status == FREE {
 		var mask byte = ^(1 << bbit) //  bbit = 3; 1 << bbit = 0b0000_1000
@@ -74,10 +314,6 @@ func (f *FileSystem) SetBlockBitmapOffset(block Block, status int) error {
 		// 0bxxxxxxxxx
 		// 0bxxxxx1xxx
 	}
-	f.File.Seek(byte_position, io.SeekStart)
-	err = binary.Write(f.File, binary.BigEndian, bbyte)
-	if err != nil {
-		return err
-	}
-	return nil
+	_, err = f.Device.WriteAt([]byte{bbyte}, byte_position)
+	return err
 }
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+const (
+	DEFAULT_BLOCK_CACHE = 256
+	DEFAULT_INODE_CACHE = 128
+)
+
+type cacheEntry[K comparable, V any] struct {
+	key   K
+	value V
+	dirty bool
+}
+
+// Cache keeps the most recently used values in memory. Dirty values are
+// written back with writeBack when they're evicted or flushed.
+type Cache[K comparable, V any] struct {
+	mu        sync.Mutex
+	capacity  int
+	entries   map[K]*list.Element
+	order     *list.List
+	writeBack func(K, V) error
+	hits      int64
+	misses    int64
+}
+
+func NewCache[K comparable, V any](capacity int, writeBack func(K, V) error) *Cache[K, V] {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &Cache[K, V]{
+		capacity:  capacity,
+		entries:   make(map[K]*list.Element),
+		order:     list.New(),
+		writeBack: writeBack,
+	}
+}
+
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		var empty V
+		return empty, false
+	}
+	c.hits++
+	c.order.MoveToFront(element)
+	return element.Value.(*cacheEntry[K, V]).value, true
+}
+
+// Fill adds a value that was just read from disk, unless the key was put
+// in the meantime. It returns the cached value.
+func (c *Cache[K, V]) Fill(key K, value V) (V, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		return element.Value.(*cacheEntry[K, V]).value, nil
+	}
+	return value, c.insert(key, value, false)
+}
+
+// Put replaces the value and marks it dirty
+func (c *Cache[K, V]) Put(key K, value V) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*cacheEntry[K, V])
+		entry.value = value
+		entry.dirty = true
+		c.order.MoveToFront(element)
+		return nil
+	}
+	return c.insert(key, value, true)
+}
+
+func (c *Cache[K, V]) insert(key K, value V, dirty bool) error {
+	// make room for the new entry
+	for c.order.Len() >= c.capacity {
+		last := c.order.Back()
+		entry := last.Value.(*cacheEntry[K, V])
+		if entry.dirty {
+			err := c.writeBack(entry.key, entry.value)
+			if err != nil {
+				return err
+			}
+		}
+		c.order.Remove(last)
+		delete(c.entries, entry.key)
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry[K, V]{
+		key:   key,
+		value: value,
+		dirty: dirty,
+	})
+	return nil
+}
+
+// Remove drops the value without writing it back
+func (c *Cache[K, V]) Remove(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.order.Remove(element)
+		delete(c.entries, key)
+	}
+}
+
+// FlushKey writes the value back if it's dirty
+func (c *Cache[K, V]) FlushKey(key K) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*cacheEntry[K, V])
+	if !entry.dirty {
+		return nil
+	}
+	err := c.writeBack(entry.key, entry.value)
+	if err != nil {
+		return err
+	}
+	entry.dirty = false
+	return nil
+}
+
+// Flush writes back every dirty value
+func (c *Cache[K, V]) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for element := c.order.Back(); element != nil; element = element.Prev() {
+		entry := element.Value.(*cacheEntry[K, V])
+		if !entry.dirty {
+			continue
+		}
+		err := c.writeBack(entry.key, entry.value)
+		if err != nil {
+			return err
+		}
+		entry.dirty = false
+	}
+	return nil
+}
+
+func (c *Cache[K, V]) Stats() (hits int64, misses int64, dirty int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for element := c.order.Front(); element != nil; element = element.Next() {
+		if element.Value.(*cacheEntry[K, V]).dirty {
+			dirty++
+		}
+	}
+	return c.hits, c.misses, dirty
+}
+
+type CacheStats struct {
+	BlockHits   int64
+	BlockMisses int64
+	BlockDirty  int
+	InodeHits   int64
+	InodeMisses int64
+	InodeDirty  int
+}
+
+func (f *FileSystem) CacheStats() CacheStats {
+	stats := CacheStats{}
+	stats.BlockHits, stats.BlockMisses, stats.BlockDirty = f.blocks.Stats()
+	stats.InodeHits, stats.InodeMisses, stats.InodeDirty = f.inodes.Stats()
+	return stats
+}
+
+// FlushCache writes every dirty inode and block to the image
+func (f *FileSystem) FlushCache() error {
+	err := f.inodes.Flush()
+	if err != nil {
+		return err
+	}
+	return f.blocks.Flush()
+}
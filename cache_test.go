@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	written := map[int]string{}
+	c := NewCache(2, func(key int, value string) error {
+		written[key] = value
+		return nil
+	})
+	if err := c.Put(1, "dirty"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Fill(2, "clean"); err != nil {
+		t.Fatal(err)
+	}
+	// 1 is used again, so 2 is the least recently used
+	if v, ok := c.Get(1); !ok || v != "dirty" {
+		t.Fatalf("get 1: %q %v", v, ok)
+	}
+	if err := c.Put(3, "new"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Get(2); ok {
+		t.Fatal("2 is still cached")
+	}
+	if len(written) != 0 {
+		t.Fatalf("the clean value was written back: %v", written)
+	}
+	// evicting 1 writes it back
+	if _, err := c.Fill(4, "clean"); err != nil {
+		t.Fatal(err)
+	}
+	if written[1] != "dirty" || len(written) != 1 {
+		t.Fatalf("written back: %v", written)
+	}
+	// a fill doesn't replace a value that was put
+	if v, err := c.Fill(3, "stale"); err != nil || v != "new" {
+		t.Fatalf("fill of a cached key: %q %v", v, err)
+	}
+	hits, misses, dirty := c.Stats()
+	if hits != 1 || misses != 1 || dirty != 1 {
+		t.Fatalf("%d hits, %d misses, %d dirty", hits, misses, dirty)
+	}
+}
+
+func TestCacheFlush(t *testing.T) {
+	written := map[int]int{}
+	c := NewCache(8, func(key int, value string) error {
+		written[key]++
+		return nil
+	})
+	for key := 0; key < 3; key++ {
+		if err := c.Put(key, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.FlushKey(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// the values are clean now, nothing is written again
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for key := 0; key < 3; key++ {
+		if written[key] != 1 {
+			t.Fatalf("%d written %d times", key, written[key])
+		}
+	}
+	// a removed value is dropped without being written
+	if err := c.Put(5, "v"); err != nil {
+		t.Fatal(err)
+	}
+	c.Remove(5)
+	if err := c.Flush(); err != nil || written[5] != 0 {
+		t.Fatalf("the removed value was written: %v", err)
+	}
+}
+
+func TestSmallCaches(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "img")
+	opts := MountOptions{BlockCache: 2, InodeCache: 2}
+	f, err := NewFileSystem(64, path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := f.Superblock.Root
+	// more blocks and inodes than the caches hold, they're written back
+	// as they're evicted
+	data := bytes.Repeat([]byte("cached data "), 500)
+	files := []int64{}
+	for _, name := range []string{"a", "b", "c"} {
+		file, err := f.Create(root, name, REGULAR, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteFile(file, 0, data); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err = OpenFileSystem(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, file := range files {
+		got := make([]byte, len(data))
+		n, err := f.ReadFile(file, 0, got)
+		if err != nil || !bytes.Equal(got[:n], data) {
+			t.Fatalf("%d: read %d bytes: %v", file, n, err)
+		}
+	}
+	// the data was read from the image
+	stats := f.CacheStats()
+	if stats.BlockMisses == 0 || stats.InodeMisses == 0 {
+		t.Fatalf("cache stats %+v", stats)
+	}
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The binary runs one command on the image and exits, or starts the REPL
+// when it's run without one:
+//
+//	fs [--image path] [--json] [--read-only] [command [args...]]
+//
+// With --json ls, stat, df, the REPL and the errors print JSON, see json.go.
+// The passphrase of encrypted images is taken from $FS_PASSPHRASE.
+
+const (
+	DEFAULT_IMAGE       = "fs"
+	DEFAULT_INODE_COUNT = 128
+	PASSPHRASE_ENV      = "FS_PASSPHRASE"
+)
+
+// exit codes, by the type of the error
+const (
+	EXIT_OK         = 0
+	EXIT_FAILURE    = 1
+	EXIT_USAGE      = 2
+	EXIT_NOT_FOUND  = 3
+	EXIT_EXISTS     = 4
+	EXIT_PERMISSION = 5
+	EXIT_NO_SPACE   = 6
+	EXIT_KEY        = 7
+	EXIT_CORRUPT    = 8
+)
+
+var ErrUsage error = errors.New("wrong usage")
+var ErrCorrupt error = newError("image has problems", syscall.EIO)
+
+type command struct {
+	name  string
+	usage string
+	// nil for mkfs, shell and run, the others run on the mounted image
+	run func(cli *cli, fs *FileSystem, args []string) error
+	// the command writes data, the image is mounted with the inline
+	// deduplication, which hashes every block first
+	dedupe bool
+}
+
+type cli struct {
+	image string
+	json  bool
+	// mount the image read-only
+	readOnly bool
+	stdin    io.Reader
+	stdout   io.Writer
+	stderr   io.Writer
+}
+
+var commands = []command{
+	{"mkfs", "[-inodes n] [-encrypt]", nil, false},
+	{"shell", "", nil, false},
+	{"run", "[-k] script|-", nil, false},
+	{"ls", "[-l] [-a] [-R] [-i] [-h] [-S|-t] [-r] [path...]", cliLs, false},
+	{"cat", "path...", cliCat, false},
+	{"put", "host-file|- path", cliPut, true},
+	{"get", "path [host-file|-]", cliGet, false},
+	{"mkdir", "[-p] path...", cliMkdir, false},
+	{"rm", "[-r] path...", cliRm, false},
+	{"cp", "[--reflink] from to", cliCp, true},
+	{"ln", "from to", cliLn, false},
+	{"stat", "path...", cliStat, false},
+	{"df", "", cliDf, false},
+	{"fsck", "", cliFsck, false},
+	{"trim", "", cliTrim, false},
+}
+
+// exitCode maps the errno of the error to the exit code of the command
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return EXIT_OK
+	case errors.Is(err, ErrUsage), errors.Is(err, ErrUnknownCommand):
+		return EXIT_USAGE
+	case errors.Is(err, ErrKeyRequired), errors.Is(err, ErrWrongKey):
+		return EXIT_KEY
+	case errors.Is(err, syscall.ENOENT):
+		return EXIT_NOT_FOUND
+	case errors.Is(err, syscall.EEXIST):
+		return EXIT_EXISTS
+	case errors.Is(err, syscall.EACCES), errors.Is(err, syscall.EPERM), errors.Is(err, syscall.EROFS):
+		return EXIT_PERMISSION
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT), errors.Is(err, syscall.EFBIG):
+		return EXIT_NO_SPACE
+	case errors.Is(err, syscall.EIO), errors.Is(err, ErrNotImage), errors.Is(err, ErrImageVersion):
+		return EXIT_CORRUPT
+	}
+	return EXIT_FAILURE
+}
+
+func usageError(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrUsage, fmt.Sprintf(format, args...))
+}
+
+func (c *cli) usage() {
+	fmt.Fprintln(c.stderr, "usage: fs [--image path] [--json] [--read-only] [command [args...]]")
+	fmt.Fprintln(c.stderr, "without a command the REPL is started, commands:")
+	for _, cmd := range commands {
+		fmt.Fprintln(c.stderr, strings.TrimRight("  "+cmd.name+" "+cmd.usage, " "))
+	}
+	fmt.Fprintf(c.stderr, "the passphrase of encrypted images is read from $%s\n", PASSPHRASE_ENV)
+}
+
+// runCli runs the command line and returns the exit code
+func runCli(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	c := &cli{stdin: stdin, stdout: stdout, stderr: stderr}
+	flags := flag.NewFlagSet("fs", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.StringVar(&c.image, "image", DEFAULT_IMAGE, "path of the image")
+	flags.BoolVar(&c.json, "json", false, "print JSON")
+	flags.BoolVar(&c.readOnly, "read-only", false, "mount the image read-only")
+	flags.Usage = c.usage
+	err := flags.Parse(args)
+	if err == flag.ErrHelp {
+		return EXIT_OK
+	}
+	if err != nil {
+		return EXIT_USAGE
+	}
+	args = flags.Args()
+	name := "shell"
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	switch name {
+	case "mkfs":
+		err = c.mkfs(args)
+	case "shell":
+		err = c.shell(args)
+	case "run":
+		err = c.runScript(args)
+	default:
+		err = c.run(name, args)
+	}
+	if err != nil && c.json {
+		printJSON(stderr, errorInfo(err))
+	} else if err != nil {
+		fmt.Fprintf(stderr, "fs: %s: %v\n", name, err)
+		if errors.Is(err, ErrUsage) {
+			c.usage()
+		}
+	}
+	return exitCode(err)
+}
+
+func (c *cli) run(name string, args []string) error {
+	for _, cmd := range commands {
+		if cmd.name != name || cmd.run == nil {
+			continue
+		}
+		// fsck only reports, the orphans it checks aren't cleaned by the
+		// mount
+		fs, err := OpenFileSystem(c.image, MountOptions{
+			Passphrase: os.Getenv(PASSPHRASE_ENV),
+			Dedupe:     cmd.dedupe,
+			ReadOnly:   c.readOnly || name == "fsck",
+		})
+		if err != nil {
+			return err
+		}
+		err = cmd.run(c, fs, args)
+		// the changes are written even if the command has failed half way
+		closeErr := fs.Close()
+		if err == nil {
+			err = closeErr
+		}
+		return err
+	}
+	return usageError("unknown command %q", name)
+}
+
+func (c *cli) mkfs(args []string) error {
+	flags := flag.NewFlagSet("mkfs", flag.ContinueOnError)
+	flags.SetOutput(c.stderr)
+	inodes := flags.Int64("inodes", DEFAULT_INODE_COUNT, "number of inodes")
+	encrypt := flags.Bool("encrypt", false, "encrypt with the passphrase from $"+PASSPHRASE_ENV)
+	err := flags.Parse(args)
+	if err != nil || flags.NArg() != 0 || *inodes <= 0 {
+		return usageError("mkfs [-inodes n] [-encrypt]")
+	}
+	opts := MountOptions{}
+	if *encrypt {
+		opts.Passphrase = os.Getenv(PASSPHRASE_ENV)
+		if opts.Passphrase == "" {
+			return ErrKeyRequired
+		}
+	}
+	fs, err := NewFileSystem(*inodes, c.image, opts)
+	if err != nil {
+		return err
+	}
+	return fs.Close()
+}
+
+// repl mounts the image for the REPL, a new one is made if it's missing
+// unless it's read-only
+func (c *cli) repl() (*Repl, error) {
+	opts := MountOptions{
+		FlushInterval: 5 * time.Second,
+		Dedupe:        true,
+		ReadOnly:      c.readOnly,
+	}
+	opts.Passphrase = os.Getenv(PASSPHRASE_ENV)
+	fs, err := OpenFileSystem(c.image, opts)
+	if errors.Is(err, os.ErrNotExist) && !c.readOnly {
+		fs, err = NewFileSystem(DEFAULT_INODE_COUNT, c.image, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	repl := NewRepl(fs)
+	repl.SetJSON(c.json)
+	return repl, nil
+}
+
+// unmount closes the image the REPL has ended with, mkfs and mount may
+// have replaced the one it started with
+func unmount(repl *Repl, err error) error {
+	closeErr := repl.FileSystem().Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (c *cli) shell(args []string) error {
+	if len(args) != 0 {
+		return usageError("shell takes no arguments")
+	}
+	repl, err := c.repl()
+	if err != nil {
+		return err
+	}
+	return unmount(repl, repl.Start())
+}
+
+// runScript runs the REPL commands of the script, see script.go
+func (c *cli) runScript(args []string) error {
+	keepGoing := len(args) > 0 && args[0] == "-k"
+	if keepGoing {
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		return usageError("run [-k] script|-")
+	}
+	var script io.Reader = c.stdin
+	name := "stdin"
+	if args[0] != "-" {
+		file, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		script, name = file, args[0]
+	}
+	repl, err := c.repl()
+	if err != nil {
+		return err
+	}
+	return unmount(repl, repl.Source(name, script, keepGoing))
+}
+
+func cliLs(c *cli, fs *FileSystem, args []string) error {
+	if c.json {
+		args = append([]string{"--json"}, args...)
+	}
+	return fs.LsCmd(fs.Session.pwd, args, c.stdout)
+}
+
+func cliCat(c *cli, fs *FileSystem, args []string) error {
+	if len(args) == 0 {
+		return usageError("cat path...")
+	}
+	for _, path := range args {
+		data, err := fs.GetCmd(fs.Session.pwd, path)
+		if err != nil {
+			return err
+		}
+		_, err = c.stdout.Write(data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cliPut(c *cli, fs *FileSystem, args []string) error {
+	if len(args) != 2 {
+		return usageError("put host-file|- path")
+	}
+	var data []byte
+	var err error
+	if args[0] == "-" {
+		data, err = io.ReadAll(c.stdin)
+	} else {
+		data, err = os.ReadFile(args[0])
+	}
+	if err != nil {
+		return err
+	}
+	return fs.PutCmd(fs.Session.pwd, args[1], data)
+}
+
+func cliGet(c *cli, fs *FileSystem, args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		return usageError("get path [host-file|-]")
+	}
+	data, err := fs.GetCmd(fs.Session.pwd, args[0])
+	if err != nil {
+		return err
+	}
+	if len(args) == 1 || args[1] == "-" {
+		_, err = c.stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(args[1], data, 0644)
+}
+
+func cliMkdir(c *cli, fs *FileSystem, args []string) error {
+	parents := len(args) > 0 && args[0] == "-p"
+	if parents {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return usageError("mkdir [-p] path...")
+	}
+	for _, path := range args {
+		if !parents {
+			err := fs.MkdirCmd(fs.Session.pwd, path)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		// every missing directory on the path is made
+		prefix := ""
+		if strings.HasPrefix(path, "/") {
+			prefix = "/"
+		}
+		for _, name := range splitPath(path) {
+			prefix += name
+			err := fs.MkdirCmd(fs.Session.pwd, prefix)
+			if errors.Is(err, ErrFileExists) {
+				var stat Stat
+				stat, err = fs.StatCmd(fs.Session.pwd, prefix)
+				if err == nil && stat.ftype != DIRECTORY {
+					err = &PathError{Op: "mkdir", Path: prefix, Err: ErrFileIsNotDir}
+				}
+			}
+			if err != nil {
+				return err
+			}
+			prefix += "/"
+		}
+	}
+	return nil
+}
+
+func cliRm(c *cli, fs *FileSystem, args []string) error {
+	recursive := len(args) > 0 && args[0] == "-r"
+	if recursive {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return usageError("rm [-r] path...")
+	}
+	for _, path := range args {
+		var err error
+		if recursive {
+			err = fs.RemoveAllCmd(fs.Session.pwd, path)
+		} else {
+			var stat Stat
+			stat, err = fs.StatCmd(fs.Session.pwd, path)
+			if err == nil && stat.ftype == DIRECTORY {
+				err = &PathError{Op: "remove", Path: path, Err: ErrFileIsDir}
+			}
+			if err == nil {
+				err = fs.UnlinkCmd(fs.Session.pwd, path)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cliCp(c *cli, fs *FileSystem, args []string) error {
+	reflink := len(args) > 0 && args[0] == "--reflink"
+	if reflink {
+		args = args[1:]
+	}
+	if len(args) != 2 {
+		return usageError("cp [--reflink] from to")
+	}
+	return fs.CopyCmd(fs.Session.pwd, args[0], args[1], reflink)
+}
+
+func cliLn(c *cli, fs *FileSystem, args []string) error {
+	if len(args) != 2 {
+		return usageError("ln from to")
+	}
+	return fs.LinkCmd(fs.Session.pwd, args[0], args[1])
+}
+
+func cliStat(c *cli, fs *FileSystem, args []string) error {
+	if len(args) == 0 {
+		return usageError("stat path...")
+	}
+	for i, path := range args {
+		stat, err := fs.StatCmd(fs.Session.pwd, path)
+		if err != nil {
+			return err
+		}
+		if c.json {
+			err = printJSON(c.stdout, stat.Info())
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if i > 0 {
+			fmt.Fprintln(c.stdout)
+		}
+		printStat(c.stdout, stat)
+	}
+	return nil
+}
+
+func cliDf(c *cli, fs *FileSystem, args []string) error {
+	if len(args) != 0 {
+		return usageError("df takes no arguments")
+	}
+	if c.json {
+		return printJSON(c.stdout, fs.StatFS())
+	}
+	printStatFS(c.stdout, fs.StatFS())
+	return nil
+}
+
+func cliFsck(c *cli, fs *FileSystem, args []string) error {
+	if len(args) != 0 {
+		return usageError("fsck takes no arguments")
+	}
+	report, err := fs.Fsck()
+	if err != nil {
+		return err
+	}
+	for _, problem := range report.Problems {
+		fmt.Fprintln(c.stdout, problem)
+	}
+	fmt.Fprintf(c.stdout, "%v inodes, %v blocks checked, %v problems\n",
+		report.Inodes, report.Blocks, len(report.Problems))
+	if len(report.Problems) != 0 {
+		return ErrCorrupt
+	}
+	return nil
+}
+
+func cliTrim(c *cli, fs *FileSystem, args []string) error {
+	if len(args) != 0 {
+		return usageError("trim takes no arguments")
+	}
+	trimmed, err := fs.Trim()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.stdout, "%v blocks trimmed\n", trimmed)
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fsCommand runs the command line on the image and returns the exit code
+// and what it printed
+func fsCommand(image string, stdin string, args ...string) (int, string) {
+	out := &bytes.Buffer{}
+	code := runCli(append([]string{"--image", image}, args...), strings.NewReader(stdin), out, out)
+	return code, out.String()
+}
+
+func TestCliCommands(t *testing.T) {
+	image := filepath.Join(t.TempDir(), "img")
+	for _, run := range []struct {
+		stdin string
+		args  []string
+		code  int
+		out   string
+	}{
+		{"", []string{"mkfs", "-inodes", "16"}, EXIT_OK, ""},
+		{"", []string{"mkdir", "d"}, EXIT_OK, ""},
+		{"hello\n", []string{"put", "-", "d/a"}, EXIT_OK, ""},
+		{"", []string{"cat", "d/a"}, EXIT_OK, "hello\n"},
+		{"", []string{"cp", "d/a", "b"}, EXIT_OK, ""},
+		{"", []string{"ls", "/"}, EXIT_OK, "b\nd\n"},
+		{"", []string{"cat", "missing"}, EXIT_NOT_FOUND, "fs: cat: read missing: "},
+		{"", []string{"mkdir", "d"}, EXIT_EXISTS, "fs: mkdir: "},
+		{"", []string{"fsck"}, EXIT_OK, ""},
+		{"", []string{"frobnicate"}, EXIT_USAGE, "fs: frobnicate: "},
+	} {
+		code, out := fsCommand(image, run.stdin, run.args...)
+		if code != run.code || !strings.HasPrefix(out, run.out) {
+			t.Fatalf("%v exited with %d: %q", run.args, code, out)
+		}
+	}
+}
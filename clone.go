@@ -0,0 +1,122 @@
+package main
+
+// shareBlocks gives the data of src to dst without copying it, the blocks
+// get a reference for dst and dst is charged for them. The caller holds the
+// lock of src.
+func (f *FileSystem) shareBlocks(src *Inode, dst *Inode) error {
+	blocks := src.dataBlocks()
+	err := f.charge(dst, int64(len(blocks)), 0)
+	if err != nil {
+		return err
+	}
+	for _, block := range blocks {
+		err := f.RefBlock(block)
+		if err != nil {
+			return err
+		}
+	}
+	dst.Blocks = src.Blocks
+	dst.Size = src.Size
+	return f.WriteInode(dst)
+}
+
+// Clone creates a new file in the directory that shares the data blocks of
+// src. The first write to either file copies the blocks it changes.
+func (f *FileSystem) Clone(src int64, dstDir int64, name string) (int64, error) {
+	if err := f.writable(); err != nil {
+		return -1, err
+	}
+	if src == dstDir {
+		return -1, ErrFileIsNotRegular
+	}
+	// the directory is locked until the new file is linked into it
+	lock := f.locks.Inode(dstDir)
+	lock.Lock()
+	defer lock.Unlock()
+	directory, err := f.ReadInode(dstDir)
+	if err != nil {
+		return -1, err
+	}
+	if directory.fileType != DIRECTORY {
+		return -1, ErrFileIsNotDir
+	}
+	err = f.access(&directory, MAY_WRITE|MAY_EXEC)
+	if err != nil {
+		return -1, err
+	}
+	// check the name before anything is allocated
+	if len(name) > NAME_MAX {
+		return -1, ErrNameTooLong
+	}
+	_, err = f.FindEntry(&directory, name)
+	if err == nil || (dstDir == f.Superblock.Root && name == SNAPSHOTS_DIR) {
+		return -1, ErrFileExists
+	}
+	if err != ErrFileNotFound {
+		return -1, err
+	}
+	srcLock := f.locks.Inode(src)
+	srcLock.RLock()
+	source, err := f.ReadInode(src)
+	if err == nil && source.fileType != REGULAR {
+		err = ErrFileIsNotRegular
+	}
+	if err == nil {
+		err = f.access(&source, MAY_READ)
+	}
+	var file Inode
+	allocated := false
+	if err == nil {
+		file, err = f.AllocateInode(Inode{
+			mode: source.mode,
+			// the blocks are in the layout of the source
+			flags:   source.flags & FLAG_COMPRESS,
+			uid:     f.Session.uid,
+			gid:     f.Session.gid,
+			project: directory.project,
+		})
+	}
+	if err == nil {
+		allocated = true
+		err = f.shareBlocks(&source, &file)
+	}
+	srcLock.RUnlock()
+	if err == nil {
+		err = f.inheritACL(&directory, &file)
+	}
+	if err != nil {
+		// nobody can reach the new file yet, it's dropped
+		if allocated {
+			f.DeallocateInode(&file)
+		}
+		return -1, err
+	}
+	// the file becomes visible to others here
+	fileLock := f.locks.Inode(file.id)
+	fileLock.Lock()
+	defer fileLock.Unlock()
+	err = f.AddFile(&directory, name, &file)
+	if err != nil {
+		f.DeallocateInode(&file)
+		return -1, err
+	}
+	return file.id, f.commit()
+}
+
+// blockUsage splits the data of the file into the bytes of blocks that are
+// shared with other files or snapshots and the bytes of the exclusive ones
+func (f *FileSystem) blockUsage(inode *Inode) (int64, int64, error) {
+	var shared, exclusive int64
+	for _, block := range inode.dataBlocks() {
+		refs, err := f.BlockRefs(block)
+		if err != nil {
+			return 0, 0, err
+		}
+		if refs > 1 {
+			shared += BLOCK_SIZE
+		} else {
+			exclusive += BLOCK_SIZE
+		}
+	}
+	return shared, exclusive, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestCloneSharesBlocks(t *testing.T) {
+	f := newTestFileSystem(t, MountOptions{})
+	root := f.Superblock.Root
+	data := bytes.Repeat([]byte("shared "), 4*BLOCK_SIZE/7+1)
+	disk := UpDivision(int64(len(data)), BLOCK_SIZE) * BLOCK_SIZE
+	if err := putFile(f, "a", data); err != nil {
+		t.Fatal(err)
+	}
+	a, err := f.Lookup(root, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := f.Clone(a, root, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := f.Stat(b)
+	if err != nil || stat.shared != disk || stat.exclusive != 0 {
+		t.Fatalf("clone uses %d shared and %d exclusive bytes: %v", stat.shared, stat.exclusive, err)
+	}
+	// the write copies the block it changes, a keeps its data
+	if _, err := f.WriteFile(b, 0, []byte("SHARED")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := getFile(f, "a"); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("the source changed: %v", err)
+	}
+	copy(data, "SHARED")
+	if got, err := getFile(f, "b"); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("the clone doesn't have the write: %v", err)
+	}
+	for _, file := range []int64{a, b} {
+		stat, err := f.Stat(file)
+		if err != nil || stat.exclusive != BLOCK_SIZE || stat.shared != disk-BLOCK_SIZE {
+			t.Fatalf("%d: %d shared and %d exclusive bytes: %v", file, stat.shared, stat.exclusive, err)
+		}
+	}
+	// the blocks are freed once neither file uses them
+	if err := f.UnlinkCmd(root, "a"); err != nil {
+		t.Fatal(err)
+	}
+	stat, err = f.Stat(b)
+	if err != nil || stat.shared != 0 || stat.exclusive != disk {
+		t.Fatalf("clone uses %d shared and %d exclusive bytes: %v", stat.shared, stat.exclusive, err)
+	}
+}
+
+func TestCloneInvalid(t *testing.T) {
+	f := newTestFileSystem(t, MountOptions{})
+	root := f.Superblock.Root
+	if err := f.MkdirCmd(root, "d"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "c"} {
+		if err := f.CreateCmd(root, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d, _ := f.Lookup(root, "d")
+	a, _ := f.Lookup(root, "a")
+	c, _ := f.Lookup(root, "c")
+	if _, err := f.Clone(d, root, "e"); !errors.Is(err, ErrFileIsNotRegular) {
+		t.Fatalf("clone of a directory: %v", err)
+	}
+	if _, err := f.Clone(a, root, "d"); !errors.Is(err, ErrFileExists) {
+		t.Fatalf("clone over a file: %v", err)
+	}
+	if _, err := f.Clone(a, c, "x"); !errors.Is(err, ErrFileIsNotDir) {
+		t.Fatalf("clone into a file: %v", err)
+	}
+	// the root, d, a and c
+	if used := usedInodes(t, f); used != 4 {
+		t.Fatalf("%d inodes are used", used)
+	}
+}
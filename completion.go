@@ -0,0 +1,117 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FD_COMMANDS take an fd as their first argument that isn't an option
+var FD_COMMANDS = map[string]bool{
+	"write": true,
+	"read":  true,
+	"seek":  true,
+	"close": true,
+	"fsync": true,
+}
+
+// completer completes the command names, the open fds and the paths of
+// the image for readline
+type completer struct {
+	r *Repl
+}
+
+func (c *completer) Do(line []rune, pos int) ([][]rune, int) {
+	text := string(line[:pos])
+	start := strings.LastIndexAny(text, " \t") + 1
+	current := text[start:]
+	before := strings.Fields(text[:start])
+	var candidates []string
+	// readline wants what is added after the typed part, the paths are
+	// completed from their last slash
+	base := current
+	switch {
+	case len(before) == 0 || (len(before) == 1 && before[0] == "help"):
+		candidates = c.commands(current)
+	case FD_COMMANDS[before[0]] && !hasOperand(before[1:]):
+		candidates = c.fds(current)
+	default:
+		candidates = c.paths(current)
+		base = current[strings.LastIndex(current, "/")+1:]
+	}
+	result := make([][]rune, len(candidates))
+	for i, candidate := range candidates {
+		result[i] = []rune(strings.TrimPrefix(candidate, base))
+	}
+	return result, len([]rune(base))
+}
+
+// hasOperand tells if one of the arguments isn't an option
+func hasOperand(args []string) bool {
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *completer) commands(prefix string) []string {
+	names := []string{}
+	for _, a := range c.r.actions {
+		if strings.HasPrefix(a.Name, prefix) {
+			names = append(names, a.Name+" ")
+		}
+	}
+	return names
+}
+
+func (c *completer) fds(prefix string) []string {
+	fs := c.r.fs
+	fs.locks.fds.Lock()
+	defer fs.locks.fds.Unlock()
+	fds := []string{}
+	for key := range fs.Session.fds {
+		fd := strconv.Itoa(int(key))
+		if strings.HasPrefix(fd, prefix) {
+			fds = append(fds, fd+" ")
+		}
+	}
+	sort.Strings(fds)
+	return fds
+}
+
+// paths lists the entries of the directory of the typed path that start
+// with its last name, the directories end with "/"
+func (c *completer) paths(prefix string) []string {
+	fs := c.r.fs
+	dir, base := ".", prefix
+	if slash := strings.LastIndex(prefix, "/"); slash >= 0 {
+		dir, base = prefix[:slash+1], prefix[slash+1:]
+	}
+	id, err := fs.LookupPath(fs.Session.pwd, dir)
+	if err != nil {
+		return nil
+	}
+	entries, err := fs.list(id)
+	if err != nil {
+		return nil
+	}
+	names := []string{}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name, base) || (strings.HasPrefix(entry.Name, ".") && base == "") {
+			continue
+		}
+		stat, err := fs.Stat(entry.Inode)
+		if err != nil {
+			continue
+		}
+		if stat.ftype == DIRECTORY {
+			names = append(names, entry.Name+"/")
+		} else {
+			names = append(names, entry.Name+" ")
+		}
+	}
+	sort.Strings(names)
+	return names
+}
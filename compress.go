@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+// Files with FLAG_COMPRESS are stored in clusters of CLUSTER_BLOCKS blocks.
+// A cluster is compressed with flate and kept in the first slots of its
+// part of Inode.Blocks, the unused slots are NO_BLOCK. When compression
+// doesn't save a block the cluster is stored as it is, so a cluster is
+// compressed exactly when it uses fewer blocks than it holds. Every write
+// compresses the clusters it changes again: the blocks a cluster takes are
+// only known once it's compressed, and allocating them in the write lets
+// it fail with ENOSPC or EDQUOT, which a later flush couldn't report.
+const (
+	CLUSTER_BLOCKS = 4
+	CLUSTER_SIZE   = CLUSTER_BLOCKS * BLOCK_SIZE
+)
+
+// dataBlocks returns the blocks holding the data of the inode
+func (i *Inode) dataBlocks() []Block {
+	blocks := []Block{}
+	for j := int64(0); j < UpDivision(i.Size, BLOCK_SIZE); j++ {
+		if i.Blocks[j] != NO_BLOCK {
+			blocks = append(blocks, Block(i.Blocks[j]))
+		}
+	}
+	return blocks
+}
+
+// clusterBlocks returns the number of blocks the cluster holds for a file
+// of the size
+func clusterBlocks(size int64, cluster int64) int64 {
+	return min(CLUSTER_BLOCKS, UpDivision(size, BLOCK_SIZE)-cluster*CLUSTER_BLOCKS)
+}
+
+// readCluster returns the n blocks of data of the cluster
+func (f *FileSystem) readCluster(inode *Inode, cluster int64, n int64) ([]byte, error) {
+	stored := []byte{}
+	first := cluster * CLUSTER_BLOCKS
+	for i := first; i < first+n && inode.Blocks[i] != NO_BLOCK; i++ {
+		data, err := f.readBlock(Block(inode.Blocks[i]))
+		if err != nil {
+			return nil, err
+		}
+		stored = append(stored, data...)
+	}
+	if int64(len(stored)) == n*BLOCK_SIZE {
+		return stored, nil
+	}
+	data := make([]byte, n*BLOCK_SIZE)
+	reader := flate.NewReader(bytes.NewReader(stored))
+	defer reader.Close()
+	_, err := io.ReadFull(reader, data)
+	if err != nil {
+		// the stored data is damaged
+		return nil, fmt.Errorf("%w: cluster %v of inode %v: %v", ErrIO, cluster, inode.id, err)
+	}
+	return data, nil
+}
+
+// freeCluster drops the blocks of the cluster
+func (f *FileSystem) freeCluster(inode *Inode, cluster int64, n int64) error {
+	first := cluster * CLUSTER_BLOCKS
+	for i := first; i < first+n; i++ {
+		if inode.Blocks[i] != NO_BLOCK {
+			err := f.FreeBlock(inode, Block(inode.Blocks[i]))
+			if err != nil {
+				return err
+			}
+		}
+		inode.Blocks[i] = NO_BLOCK
+	}
+	return nil
+}
+
+// writeCluster stores the data, a multiple of the block size, as the
+// cluster. The data goes to new blocks, so blocks shared with other files
+// are never changed, and the old ones are dropped once they are filled: a
+// failed write leaves the cluster as it was.
+func (f *FileSystem) writeCluster(inode *Inode, cluster int64, old int64, data []byte) error {
+	var compressed bytes.Buffer
+	writer, err := flate.NewWriter(&compressed, flate.DefaultCompression)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(data)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		return err
+	}
+	stored := data
+	if UpDivision(int64(compressed.Len()), BLOCK_SIZE) < int64(len(data))/BLOCK_SIZE {
+		stored = compressed.Bytes()
+	}
+	blocks := []Block{}
+	for i := int64(0); i*BLOCK_SIZE < int64(len(stored)); i++ {
+		block, err := f.AllocateBlock(inode)
+		if err == nil {
+			blocks = append(blocks, block)
+			content := make([]byte, BLOCK_SIZE)
+			copy(content, stored[i*BLOCK_SIZE:])
+			err = f.blocks.Put(block, content)
+		}
+		if err != nil {
+			// only the new blocks are released
+			for _, block := range blocks {
+				f.FreeBlock(inode, block)
+			}
+			return err
+		}
+	}
+	err = f.freeCluster(inode, cluster, old)
+	if err != nil {
+		return err
+	}
+	first := cluster * CLUSTER_BLOCKS
+	for i := int64(0); i < int64(len(data))/BLOCK_SIZE; i++ {
+		inode.Blocks[first+i] = NO_BLOCK
+		if i < int64(len(blocks)) {
+			inode.Blocks[first+i] = int64(blocks[i])
+		}
+	}
+	return nil
+}
+
+// writeCompressed resizes the compressed file to size and writes the buffer
+// at the offset. The clusters from the first changed byte to the new end
+// are compressed again. When one of them fails the ones before it are
+// kept, like a short write, and the size is set to match them. It returns
+// the number of bytes of the buffer in the clusters that were written.
+func (f *FileSystem) writeCompressed(inode *Inode, offset int64, buffer []byte, size int64) (int64, error) {
+	// the data up to here is kept
+	keep := min(inode.Size, size)
+	if len(buffer) != 0 {
+		keep = min(keep, offset)
+	}
+	oldClusters := UpDivision(inode.Size, CLUSTER_SIZE)
+	newClusters := UpDivision(size, CLUSTER_SIZE)
+	// the bytes of the buffer before the cluster
+	written := func(c int64) int64 {
+		if c*CLUSTER_SIZE <= offset {
+			return 0
+		}
+		return min(c*CLUSTER_SIZE-offset, int64(len(buffer)))
+	}
+	for c := keep / CLUSTER_SIZE; c < newClusters; c++ {
+		start := c * CLUSTER_SIZE
+		data := make([]byte, clusterBlocks(size, c)*BLOCK_SIZE)
+		var old int64
+		if c < oldClusters {
+			old = clusterBlocks(inode.Size, c)
+			stored, err := f.readCluster(inode, c, old)
+			if err != nil {
+				return written(c), err
+			}
+			// the bytes past the end are dropped, so growing the
+			// file reads zeros
+			copy(data, stored[:min(int64(len(stored)), min(inode.Size, size)-start)])
+		}
+		if len(buffer) != 0 && offset < start+int64(len(data)) && offset+int64(len(buffer)) > start {
+			if offset >= start {
+				copy(data[offset-start:], buffer)
+			} else {
+				copy(data, buffer[start-offset:])
+			}
+		}
+		err := f.writeCluster(inode, c, old, data)
+		if err != nil {
+			// the clusters before c are full, the file ends after
+			// them when it has grown past its old clusters
+			if c >= oldClusters {
+				inode.Size = c * CLUSTER_SIZE
+			}
+			f.WriteInode(inode)
+			return written(c), err
+		}
+	}
+	// the clusters past the new end are dropped once the last one is
+	// written
+	for c := newClusters; c < oldClusters; c++ {
+		err := f.freeCluster(inode, c, clusterBlocks(inode.Size, c))
+		if err != nil {
+			return int64(len(buffer)), err
+		}
+	}
+	inode.Size = size
+	return int64(len(buffer)), f.WriteInode(inode)
+}
+
+// readCompressed is Read for compressed files
+func (f *FileSystem) readCompressed(inode *Inode, offset int64, buffer []byte) (int64, error) {
+	to_read := min(int64(len(buffer)), inode.Size-offset)
+	for i := int64(0); i < to_read; {
+		c := (offset + i) / CLUSTER_SIZE
+		data, err := f.readCluster(inode, c, clusterBlocks(inode.Size, c))
+		if err != nil {
+			return i, err
+		}
+		n := copy(buffer[i:to_read], data[offset+i-c*CLUSTER_SIZE:])
+		i += int64(n)
+	}
+	return to_read, nil
+}
+
+// SetCompression turns the compression of the file on or off, the data is
+// stored again. New files in a compressed directory are compressed too.
+func (f *FileSystem) SetCompression(file int64, on bool) error {
+	if err := f.writable(); err != nil {
+		return err
+	}
+	lock := f.locks.Inode(file)
+	lock.Lock()
+	defer lock.Unlock()
+	inode, err := f.ReadInode(file)
+	if err != nil {
+		return err
+	}
+	if f.Session.uid != 0 && f.Session.uid != inode.uid {
+		return ErrPermission
+	}
+	if inode.flags&FLAG_SNAPSHOT != 0 {
+		return ErrReadOnlySnapshot
+	}
+	if (inode.flags&FLAG_COMPRESS != 0) == on {
+		return nil
+	}
+	data := make([]byte, inode.Size)
+	_, err = f.Read(&inode, 0, data)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(&inode, 0)
+	if err != nil {
+		return err
+	}
+	inode.flags ^= FLAG_COMPRESS
+	_, err = f.Write(&inode, 0, data)
+	if err != nil {
+		return err
+	}
+	return f.commit()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+// newCompressedFile makes a compressed file owned by the user 5, whose
+// blocks are limited to the hard limit
+func newCompressedFile(t *testing.T, f *FileSystem, hardBlocks int64) int64 {
+	t.Helper()
+	root, err := f.ReadInode(f.Superblock.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root.mode = 0777
+	if err := f.WriteInode(&root); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SetQuota(QuotaKey{USER_QUOTA, 5}, QuotaLimits{HardBlocks: hardBlocks}); err != nil {
+		t.Fatal(err)
+	}
+	f.Session.uid, f.Session.gid = 5, 5
+	file, err := f.Create(f.Superblock.Root, "log", REGULAR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SetCompression(file, true); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// checkFile fails the test when the file doesn't hold the data or fsck
+// finds a problem
+func checkFile(t *testing.T, f *FileSystem, file int64, data []byte) {
+	t.Helper()
+	buf := make([]byte, len(data)+10)
+	n, err := f.ReadFile(file, 0, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], data) {
+		t.Fatalf("read %d bytes other than the %d written", n, len(data))
+	}
+	report, err := f.Fsck()
+	if err != nil || len(report.Problems) != 0 {
+		t.Fatal(err, report.Problems)
+	}
+}
+
+func TestCompressedRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "img")
+	f, err := NewFileSystem(64, path, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { f.Close() }()
+	file := newCompressedFile(t, f, 0)
+	data := bytes.Repeat([]byte("line of the log file\n"), 600)
+	if _, err := f.WriteFile(file, 0, data); err != nil {
+		t.Fatal(err)
+	}
+	copy(data[5000:], "HELLO")
+	if _, err := f.WriteFile(file, 5000, []byte("HELLO")); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, f, file, data)
+	stat, err := f.Stat(file)
+	if err != nil || stat.disk >= stat.size/2 {
+		t.Fatalf("%d bytes on disk for %d: %v", stat.disk, stat.size, err)
+	}
+	if err := f.TruncateFile(file, 4500); err != nil {
+		t.Fatal(err)
+	}
+	data = data[:4500]
+	checkFile(t, f, file, data)
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err = OpenFileSystem(path, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, f, file, data)
+	if err := f.SetCompression(file, false); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, f, file, data)
+}
+
+func TestCompressedOverwriteOverQuota(t *testing.T) {
+	f := newTestFileSystem(t, MountOptions{})
+	file := newCompressedFile(t, f, 4)
+	// two clusters in a block each
+	data := bytes.Repeat([]byte("x"), 2*CLUSTER_SIZE)
+	if _, err := f.WriteFile(file, 0, data); err != nil {
+		t.Fatal(err)
+	}
+	// the first cluster can't be compressed, it needs all 4 blocks
+	noise := make([]byte, CLUSTER_SIZE)
+	rand.New(rand.NewSource(1)).Read(noise)
+	if _, err := f.WriteFile(file, 0, noise); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("write over the quota: %v", err)
+	}
+	checkFile(t, f, file, data)
+	if r := quotaReport(f, USER_QUOTA, 5); r.Blocks != 2 {
+		t.Fatalf("%d blocks charged after the failed write", r.Blocks)
+	}
+}
+
+func TestCompressedGrowOverQuota(t *testing.T) {
+	f := newTestFileSystem(t, MountOptions{})
+	file := newCompressedFile(t, f, 4)
+	data := bytes.Repeat([]byte("x"), CLUSTER_SIZE/2)
+	if _, err := f.WriteFile(file, 0, data); err != nil {
+		t.Fatal(err)
+	}
+	// the first cluster fits, the second one doesn't
+	noise := make([]byte, 2*CLUSTER_SIZE)
+	rand.New(rand.NewSource(1)).Read(noise)
+	n, err := f.WriteFile(file, CLUSTER_SIZE/2, noise)
+	if !errors.Is(err, ErrQuotaExceeded) || n != CLUSTER_SIZE/2 {
+		t.Fatalf("write over the quota: %d bytes, %v", n, err)
+	}
+	// the file ends after the cluster that was written
+	checkFile(t, f, file, append(data, noise[:CLUSTER_SIZE/2]...))
+}
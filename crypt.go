@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/crypto/xts"
+)
+
+// Encrypted images keep the data blocks encrypted with AES-256-XTS, the
+// block number is the tweak. Directories are stored in data blocks, so the
+// entry names are encrypted with them. The extended attributes kept in the
+// inodes are encrypted too, the rest of the metadata isn't.
+//
+// The master key is random. It's stored in the superblock encrypted with
+// AES-GCM under a key derived from the passphrase with scrypt, so a wrong
+// passphrase is detected before anything is read.
+const (
+	MASTER_KEY_SIZE  = 64
+	KEY_SALT_SIZE    = 16
+	KEY_NONCE_SIZE   = 12
+	WRAPPED_KEY_SIZE = KEY_NONCE_SIZE + MASTER_KEY_SIZE + 16
+	SCRYPT_N         = 1 << 15
+	SCRYPT_R         = 8
+	SCRYPT_P         = 1
+)
+
+var ErrKeyRequired error = newError("image is encrypted, the passphrase is required", ENOKEY)
+var ErrWrongKey error = newError("wrong passphrase", EKEYREJECTED)
+
+// keyWrapper returns the cipher that encrypts the master key
+func keyWrapper(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, SCRYPT_N, SCRYPT_R, SCRYPT_P, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// setupEncryption makes a new master key and stores it in the superblock
+func (f *FileSystem) setupEncryption(passphrase string) error {
+	master := make([]byte, MASTER_KEY_SIZE)
+	_, err := io.ReadFull(rand.Reader, master)
+	if err != nil {
+		return err
+	}
+	_, err = io.ReadFull(rand.Reader, f.Superblock.KeySalt[:])
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, KEY_NONCE_SIZE)
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return err
+	}
+	wrapper, err := keyWrapper(passphrase, f.Superblock.KeySalt[:])
+	if err != nil {
+		return err
+	}
+	wrapped := wrapper.Seal(nonce, nonce, master, nil)
+	copy(f.Superblock.WrappedKey[:], wrapped)
+	f.Superblock.Encrypted = true
+	f.cipher, err = xts.NewCipher(aes.NewCipher, master)
+	return err
+}
+
+// unlock recovers the master key of an encrypted image
+func (f *FileSystem) unlock(passphrase string) error {
+	if !f.Superblock.Encrypted {
+		return nil
+	}
+	if passphrase == "" {
+		return ErrKeyRequired
+	}
+	wrapper, err := keyWrapper(passphrase, f.Superblock.KeySalt[:])
+	if err != nil {
+		return err
+	}
+	wrapped := f.Superblock.WrappedKey[:]
+	master, err := wrapper.Open(nil, wrapped[:KEY_NONCE_SIZE], wrapped[KEY_NONCE_SIZE:], nil)
+	if err != nil {
+		return ErrWrongKey
+	}
+	f.cipher, err = xts.NewCipher(aes.NewCipher, master)
+	return err
+}
+
+// encrypt returns the data as it's stored, the data itself isn't changed
+func (f *FileSystem) encrypt(data []byte, sector uint64) []byte {
+	if f.cipher == nil {
+		return data
+	}
+	encrypted := make([]byte, len(data))
+	f.cipher.Encrypt(encrypted, data, sector)
+	return encrypted
+}
+
+// decrypt works in place on the data read from the image
+func (f *FileSystem) decrypt(data []byte, sector uint64) {
+	if f.cipher != nil {
+		f.cipher.Decrypt(data, data, sector)
+	}
+}
+
+// inodeSector is the tweak for the attributes of the inode, it's past the
+// numbers of the blocks
+func (f *FileSystem) inodeSector(id int64) uint64 {
+	return uint64(f.Superblock.BlockCount + id)
+}
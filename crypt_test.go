@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncryptedImage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "img")
+	f, err := NewFileSystem(64, path, MountOptions{Passphrase: "pw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := f.Superblock.Root
+	file, err := f.Create(root, "secret-name", REGULAR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteFile(file, 0, []byte("top secret contents")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SetXattr(file, "user.tag", []byte("hidden-tag"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, plain := range []string{"secret-name", "top secret", "hidden-tag"} {
+		if bytes.Contains(raw, []byte(plain)) {
+			t.Fatalf("%q is in the image", plain)
+		}
+	}
+	if _, err := OpenFileSystem(path, MountOptions{}); !errors.Is(err, ErrKeyRequired) {
+		t.Fatalf("mount without the passphrase: %v", err)
+	}
+	if _, err := OpenFileSystem(path, MountOptions{Passphrase: "bad"}); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("mount with a wrong passphrase: %v", err)
+	}
+	f, err = OpenFileSystem(path, MountOptions{Passphrase: "pw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if f.Options.Passphrase != "" {
+		t.Fatal("the passphrase is kept in the options")
+	}
+	file, err = f.Lookup(root, "secret-name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 19)
+	if _, err := f.ReadFile(file, 0, buf); err != nil || string(buf) != "top secret contents" {
+		t.Fatalf("read %q: %v", buf, err)
+	}
+	if tag, err := f.GetXattr(file, "user.tag"); err != nil || string(tag) != "hidden-tag" {
+		t.Fatalf("attribute %q: %v", tag, err)
+	}
+}
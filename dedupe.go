@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"sync"
+)
+
+type digest [sha256.Size]byte
+
+// dedupeIndex maps the digests of data blocks to the blocks. It's a hint:
+// a block may have changed since it was added, so the content is compared
+// before a block is shared. Freed blocks are dropped from it.
+type dedupeIndex struct {
+	mu      sync.Mutex
+	blocks  map[digest]Block
+	digests map[Block]digest
+}
+
+func newDedupeIndex() *dedupeIndex {
+	return &dedupeIndex{
+		blocks:  make(map[digest]Block),
+		digests: make(map[Block]digest),
+	}
+}
+
+func (d *dedupeIndex) find(sum digest) (Block, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	block, ok := d.blocks[sum]
+	return block, ok
+}
+
+func (d *dedupeIndex) add(sum digest, block Block) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if old, ok := d.digests[block]; ok && d.blocks[old] == block {
+		delete(d.blocks, old)
+	}
+	d.blocks[sum] = block
+	d.digests[block] = sum
+}
+
+func (d *dedupeIndex) forget(block Block) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if sum, ok := d.digests[block]; ok {
+		if d.blocks[sum] == block {
+			delete(d.blocks, sum)
+		}
+		delete(d.digests, block)
+	}
+}
+
+func (d *dedupeIndex) reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.blocks = make(map[digest]Block)
+	d.digests = make(map[Block]digest)
+}
+
+// dedupeBlock points the slot of the inode to a block with the same content
+// if there's one, and drops its own block. It returns true when it does,
+// the caller holds the lock of the inode and writes it.
+func (f *FileSystem) dedupeBlock(inode *Inode, slot int64) (bool, error) {
+	block := Block(inode.Blocks[slot])
+	data, err := f.readBlock(block)
+	if err != nil {
+		return false, err
+	}
+	sum := digest(sha256.Sum256(data))
+	f.locks.dedupe.Lock()
+	defer f.locks.dedupe.Unlock()
+	candidate, ok := f.index.find(sum)
+	if ok && candidate != block {
+		// the reference keeps the candidate from being freed while it's
+		// compared
+		ok, err = f.refUsedBlock(candidate)
+		if err != nil {
+			return false, err
+		}
+	}
+	if !ok || candidate == block {
+		f.index.add(sum, block)
+		return false, nil
+	}
+	other, err := f.readBlock(candidate)
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(data, other) {
+		f.index.add(sum, block)
+		return false, f.freeBlock(candidate)
+	}
+	inode.Blocks[slot] = int64(candidate)
+	return true, f.freeBlock(block)
+}
+
+// walkDataBlocks adds the blocks of every regular file to the index, with
+// merge the duplicates are shared too. It returns the bytes saved.
+func (f *FileSystem) walkDataBlocks(merge bool) (int64, error) {
+	var saved int64
+	for id := int64(0); id < f.Superblock.InodeCount; id++ {
+		lock := f.locks.Inode(id)
+		lock.Lock()
+		inode, err := f.ReadInode(id)
+		if err != nil {
+			lock.Unlock()
+			return saved, err
+		}
+		// free inodes have no links, orphans are left alone
+		if inode.fileType != REGULAR || inode.linkCount == 0 {
+			lock.Unlock()
+			continue
+		}
+		changed := false
+		for slot := int64(0); slot < UpDivision(inode.Size, BLOCK_SIZE); slot++ {
+			if inode.Blocks[slot] == NO_BLOCK {
+				continue
+			}
+			if !merge {
+				data, err := f.readBlock(Block(inode.Blocks[slot]))
+				if err != nil {
+					lock.Unlock()
+					return saved, err
+				}
+				f.index.add(digest(sha256.Sum256(data)), Block(inode.Blocks[slot]))
+				continue
+			}
+			shared, err := f.dedupeBlock(&inode, slot)
+			if err != nil {
+				lock.Unlock()
+				return saved, err
+			}
+			if shared {
+				saved += BLOCK_SIZE
+				changed = true
+			}
+		}
+		if changed {
+			err = f.WriteInode(&inode)
+		}
+		lock.Unlock()
+		if err != nil {
+			return saved, err
+		}
+	}
+	return saved, nil
+}
+
+// Dedupe shares every data block with the blocks of the same content and
+// returns the bytes saved
+func (f *FileSystem) Dedupe() (int64, error) {
+	if err := f.writable(); err != nil {
+		return 0, err
+	}
+	f.index.reset()
+	saved, err := f.walkDataBlocks(true)
+	if err != nil {
+		return saved, err
+	}
+	return saved, f.commit()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// blocksOf returns data of n blocks that differ from each other
+func blocksOf(n int) []byte {
+	data := []byte{}
+	for i := 0; i < n; i++ {
+		data = append(data, bytes.Repeat([]byte{'a' + byte(i)}, BLOCK_SIZE)...)
+	}
+	return data
+}
+
+// putTwice writes the same data to a and b and returns their inodes
+func putTwice(t *testing.T, f *FileSystem, data []byte) (int64, int64) {
+	t.Helper()
+	root := f.Superblock.Root
+	ids := []int64{}
+	for _, name := range []string{"a", "b"} {
+		if err := putFile(f, name, data); err != nil {
+			t.Fatal(err)
+		}
+		id, err := f.Lookup(root, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	return ids[0], ids[1]
+}
+
+func TestDedupeInline(t *testing.T) {
+	f := newTestFileSystem(t, MountOptions{Dedupe: true})
+	data := blocksOf(3)
+	a, b := putTwice(t, f, data)
+	stat, err := f.Stat(b)
+	if err != nil || stat.shared != 3*BLOCK_SIZE {
+		t.Fatalf("%d bytes of b are shared: %v", stat.shared, err)
+	}
+	// the write to b copies the block first
+	if _, err := f.WriteFile(b, 0, []byte("THE")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(data))
+	if _, err := f.ReadFile(a, 0, got); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("a changed with b: %v", err)
+	}
+	stat, err = f.Stat(a)
+	if err != nil || stat.shared != 2*BLOCK_SIZE || stat.exclusive != BLOCK_SIZE {
+		t.Fatalf("a uses %d shared and %d exclusive bytes: %v", stat.shared, stat.exclusive, err)
+	}
+}
+
+func TestDedupeOffline(t *testing.T) {
+	f := newTestFileSystem(t, MountOptions{})
+	data := blocksOf(3)
+	a, b := putTwice(t, f, data)
+	stat, err := f.Stat(b)
+	if err != nil || stat.shared != 0 {
+		t.Fatalf("%d bytes of b are shared without dedupe: %v", stat.shared, err)
+	}
+	saved, err := f.Dedupe()
+	if err != nil || saved != 3*BLOCK_SIZE {
+		t.Fatalf("dedupe saved %d bytes: %v", saved, err)
+	}
+	for _, file := range []int64{a, b} {
+		stat, err := f.Stat(file)
+		if err != nil || stat.shared != 3*BLOCK_SIZE {
+			t.Fatalf("%d bytes of %d are shared: %v", stat.shared, file, err)
+		}
+	}
+	// nothing is left to share
+	if saved, err := f.Dedupe(); err != nil || saved != 0 {
+		t.Fatalf("second dedupe saved %d bytes: %v", saved, err)
+	}
+	if err := f.UnlinkCmd(f.Superblock.Root, "a"); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(data))
+	if _, err := f.ReadFile(b, 0, got); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("b changed with a: %v", err)
+	}
+}
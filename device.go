@@ -0,0 +1,184 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// Device is the storage the image is kept on. Offsets past Size fail, the
+// device doesn't grow.
+type Device interface {
+	io.ReaderAt
+	io.WriterAt
+	// Sync waits until the written data is stored
+	Sync() error
+	Size() (int64, error)
+	Close() error
+}
+
+// readOnlyDevice is a device that can't be written, it's always mounted
+// read-only
+type readOnlyDevice interface {
+	ReadOnly() bool
+}
+
+// discarder is a device that can give ranges back to the storage below,
+// they read as zeros after that
+type discarder interface {
+	Discard(offset int64, length int64) error
+}
+
+var ErrDeviceTooSmall error = newError("device is too small for the image", syscall.ENOSPC)
+var ErrNoDiscard error = newError("device can't discard blocks", syscall.ENOTSUP)
+
+// FileDevice keeps the image in a host file. The file is sparse, the
+// ranges that are discarded are punched out of it where the host allows it.
+type FileDevice struct {
+	*os.File
+}
+
+func (d *FileDevice) Size() (int64, error) {
+	info, err := d.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// WriteAt fails past the end of the file, like the other devices, instead
+// of growing it
+func (d *FileDevice) WriteAt(p []byte, off int64) (int, error) {
+	size, err := d.Size()
+	if err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	if off+int64(len(p)) > size {
+		return 0, ErrDeviceTooSmall
+	}
+	return d.File.WriteAt(p, off)
+}
+
+// MemoryDevice keeps the image in memory, for tests and scratch images
+type MemoryDevice struct {
+	mu   sync.RWMutex
+	data []byte
+}
+
+func NewMemoryDevice(size int64) *MemoryDevice {
+	return &MemoryDevice{data: make([]byte, size)}
+}
+
+func (d *MemoryDevice) ReadAt(p []byte, off int64) (int, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	if off >= int64(len(d.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, d.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (d *MemoryDevice) WriteAt(p []byte, off int64) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	if off+int64(len(p)) > int64(len(d.data)) {
+		return 0, ErrDeviceTooSmall
+	}
+	return copy(d.data[off:], p), nil
+}
+
+func (d *MemoryDevice) Sync() error {
+	return nil
+}
+
+func (d *MemoryDevice) Size() (int64, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return int64(len(d.data)), nil
+}
+
+func (d *MemoryDevice) Close() error {
+	return nil
+}
+
+func (d *MemoryDevice) Discard(offset int64, length int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if offset < 0 || length < 0 || offset+length > int64(len(d.data)) {
+		return syscall.EINVAL
+	}
+	for i := offset; i < offset+length; i++ {
+		d.data[i] = 0
+	}
+	return nil
+}
+
+// Bytes returns the content of the device, it must not be changed
+func (d *MemoryDevice) Bytes() []byte {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.data
+}
+
+// ReaderDevice serves an image from any io.ReaderAt, like an archive
+// member or a remote object. It's read-only.
+type ReaderDevice struct {
+	reader io.ReaderAt
+	size   int64
+}
+
+func NewReaderDevice(reader io.ReaderAt, size int64) *ReaderDevice {
+	return &ReaderDevice{reader: reader, size: size}
+}
+
+func (d *ReaderDevice) ReadAt(p []byte, off int64) (int, error) {
+	if off >= d.size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > d.size-off {
+		n, err := d.reader.ReadAt(p[:d.size-off], off)
+		if err == nil {
+			err = io.EOF
+		}
+		return n, err
+	}
+	return d.reader.ReadAt(p, off)
+}
+
+func (d *ReaderDevice) WriteAt(p []byte, off int64) (int, error) {
+	return 0, ErrReadOnly
+}
+
+func (d *ReaderDevice) Sync() error {
+	return nil
+}
+
+func (d *ReaderDevice) Size() (int64, error) {
+	return d.size, nil
+}
+
+// Close closes the reader when it's an io.Closer
+func (d *ReaderDevice) Close() error {
+	if closer, ok := d.reader.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (d *ReaderDevice) ReadOnly() bool {
+	return true
+}
@@ -0,0 +1,8 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// Discard punches the range out of the host file, the size stays the same
+func (d *FileDevice) Discard(offset int64, length int64) error {
+	return unix.Fallocate(int(d.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, offset, length)
+}
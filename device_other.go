@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "syscall"
+
+// Discard isn't supported on this host, the file only stays sparse where
+// it was never written
+func (d *FileDevice) Discard(offset int64, length int64) error {
+	return syscall.ENOTSUP
+}
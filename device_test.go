@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestMemoryAndReaderDevices(t *testing.T) {
+	dev := NewMemoryDevice(ImageSize(64))
+	f, err := Format(dev, 64, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.PutCmd(f.Session.pwd, "a", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// a reader can only be mounted read-only
+	g, err := Mount(NewReaderDevice(bytes.NewReader(dev.Bytes()), int64(len(dev.Bytes()))), MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	if data, err := g.GetCmd(g.Session.pwd, "a"); err != nil || string(data) != "hello" {
+		t.Fatalf("read %q: %v", data, err)
+	}
+	if err := g.PutCmd(g.Session.pwd, "b", nil); !errors.Is(err, syscall.EROFS) {
+		t.Fatalf("write to a reader: %v", err)
+	}
+	if _, err := Format(NewMemoryDevice(100), 64, MountOptions{}); !errors.Is(err, ErrDeviceTooSmall) {
+		t.Fatalf("format of a small device: %v", err)
+	}
+	// a used device is formatted again
+	h, err := Format(dev, 64, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if _, err := h.GetCmd(h.Session.pwd, "a"); err == nil {
+		t.Fatal("the old file is in the new image")
+	}
+}
+
+func TestFreedBlocksDiscarded(t *testing.T) {
+	dev := NewMemoryDevice(ImageSize(64))
+	f, err := Format(dev, 64, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	root := f.Superblock.Root
+	data := bytes.Repeat([]byte("freed data "), 300)
+	if err := f.PutCmd(root, "a", data); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(dev.Bytes(), data[:BLOCK_SIZE]) {
+		t.Fatal("the data isn't on the device")
+	}
+	// the blocks are punched on the next sync
+	if err := f.UnlinkCmd(root, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(dev.Bytes(), data[:BLOCK_SIZE]) {
+		t.Fatal("the freed blocks are left on the device")
+	}
+	// trim punches the free blocks that were written by other means
+	location := f.Superblock.BlocksOffset + (f.usableBlocks()-1)*BLOCK_SIZE
+	if _, err := dev.WriteAt(data[:BLOCK_SIZE], location); err != nil {
+		t.Fatal(err)
+	}
+	trimmed, err := f.Trim()
+	if err != nil || trimmed == 0 {
+		t.Fatalf("%d blocks trimmed: %v", trimmed, err)
+	}
+	if bytes.Contains(dev.Bytes(), data[:BLOCK_SIZE]) {
+		t.Fatal("the free block is left after the trim")
+	}
+	checkClean(t, f)
+}
+
+func TestFileDeviceDoesntGrow(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Truncate(100); err != nil {
+		t.Fatal(err)
+	}
+	dev := &FileDevice{file}
+	defer dev.Close()
+	if _, err := dev.WriteAt([]byte("end"), 97); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dev.WriteAt([]byte("past"), 97); !errors.Is(err, ErrDeviceTooSmall) {
+		t.Fatalf("write past the end: %v", err)
+	}
+	if size, err := dev.Size(); err != nil || size != 100 {
+		t.Fatalf("size %d: %v", size, err)
+	}
+}
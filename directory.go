@@ -2,7 +2,7 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
+	"syscall"
 )
 
 type Entry struct {
@@ -10,33 +10,65 @@ type Entry struct {
 	Inode int64  `json:"inode"`
 }
 
-var ErrFileIsNotDir error = errors.New("file is not directory")
-var ErrFileNotFound error = errors.New("file is not found")
+var ErrFileIsNotDir error = newError("file is not directory", syscall.ENOTDIR)
+var ErrFileNotFound error = newError("file is not found", syscall.ENOENT)
+var ErrFileExists error = newError("file already exists", syscall.EEXIST)
+var ErrNameTooLong error = newError("file name is too long", syscall.ENAMETOOLONG)
 
-func (f *FileSystem) AllocateDirectory() (Inode, error) {
+// the longest name of a directory entry, in bytes
+const NAME_MAX = 255
+
+func (f *FileSystem) AllocateDirectory(template Inode) (Inode, error) {
 	// allocate inode
 	// set file type to directory
 	// return
-	inode, err := f.AllocateInode()
+	inode, err := f.AllocateInode(template)
 	if err != nil {
 		return Inode{}, err
 	}
 	inode.fileType = DIRECTORY
 	err = f.WriteDirectory(&inode, []Entry{})
-	return inode, err
+	if err != nil {
+		// the inode isn't linked anywhere yet
+		f.DeallocateInode(&inode)
+		return Inode{}, err
+	}
+	return inode, nil
+}
+
+// FindEntry returns the inode of the name in the directory
+func (f *FileSystem) FindEntry(dir *Inode, name string) (int64, error) {
+	entries, err := f.ReadDirectory(dir)
+	if err != nil {
+		return -1, err
+	}
+	for _, entry := range entries {
+		if entry.Name == name {
+			return entry.Inode, nil
+		}
+	}
+	return -1, ErrFileNotFound
 }
 
+// AddFile links the file into the directory. The caller holds the locks of
+// both inodes, so reading, changing and writing the entries is atomic.
 func (f *FileSystem) AddFile(dir *Inode, name string, file *Inode) error {
+	if err := f.writable(); err != nil {
+		return err
+	}
 	if dir.fileType != DIRECTORY {
 		return ErrFileIsNotDir
 	}
+	if len(name) > NAME_MAX {
+		return ErrNameTooLong
+	}
 	entries, err := f.ReadDirectory(dir)
 	if err != nil {
 		return err
 	}
 	for _, entry := range entries {
 		if entry.Name == name {
-			return errors.New("file already exists")
+			return ErrFileExists
 		}
 	}
 	entries = append(entries, Entry{
@@ -48,11 +80,17 @@ func (f *FileSystem) AddFile(dir *Inode, name string, file *Inode) error {
 		return err
 	}
 	file.linkCount++
+	file.touchChanged()
 	err = f.WriteInode(file)
 	return err
 }
 
+// RemoveFile unlinks the name from the directory. The caller holds the lock
+// of the directory and of the removed file.
 func (f *FileSystem) RemoveFile(dir *Inode, name string) (Inode, error) {
+	if err := f.writable(); err != nil {
+		return Inode{}, err
+	}
 	if dir.fileType != DIRECTORY {
 		return Inode{}, ErrFileIsNotDir
 	}
@@ -60,26 +98,34 @@ func (f *FileSystem) RemoveFile(dir *Inode, name string) (Inode, error) {
 	if err != nil {
 		return Inode{}, err
 	}
-	file := Inode{}
-	var remove bool
+	var id int64 = -1
 	for i, entry := range entries {
 		if entry.Name == name {
-			file, err = f.ReadInode(entry.Inode)
-			if err != nil {
-				return Inode{}, err
-			}
+			id = entry.Inode
 			entries = append(entries[:i], entries[i+1:]...)
-			remove = true
+			break
 		}
 	}
-	if !remove {
+	if id == -1 {
 		return Inode{}, ErrFileNotFound
 	}
 	err = f.WriteDirectory(dir, entries)
 	if err != nil {
 		return Inode{}, err
 	}
+	// "." points to the directory itself, so the counter is updated in place
+	if id == dir.id {
+		dir.linkCount--
+		dir.touchChanged()
+		err = f.WriteInode(dir)
+		return *dir, err
+	}
+	file, err := f.ReadInode(id)
+	if err != nil {
+		return Inode{}, err
+	}
 	file.linkCount--
+	file.touchChanged()
 	err = f.WriteInode(&file)
 	return file, err
 }
@@ -102,6 +148,9 @@ func (f *FileSystem) ReadDirectory(dir *Inode) ([]Entry, error) {
 }
 
 func (f *FileSystem) WriteDirectory(dir *Inode, entry []Entry) error {
+	if err := f.writable(); err != nil {
+		return err
+	}
 	if dir.fileType != DIRECTORY {
 		return ErrFileIsNotDir
 	}
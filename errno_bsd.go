@@ -0,0 +1,17 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import "syscall"
+
+// the hosts have no errnos for the keys, a wrong or missing passphrase is
+// a permission error
+const (
+	ENOKEY       = syscall.EACCES
+	EKEYREJECTED = syscall.EACCES
+	ENOATTR      = syscall.ENOATTR
+)
+
+func init() {
+	errnoNames[ENOATTR] = "ENOATTR"
+}
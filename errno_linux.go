@@ -0,0 +1,19 @@
+//go:build linux
+
+package main
+
+import "syscall"
+
+// the errnos that are only on some hosts, a missing attribute is ENODATA
+// on linux
+const (
+	ENOKEY       = syscall.ENOKEY
+	EKEYREJECTED = syscall.EKEYREJECTED
+	ENOATTR      = syscall.ENODATA
+)
+
+func init() {
+	errnoNames[ENOKEY] = "ENOKEY"
+	errnoNames[EKEYREJECTED] = "EKEYREJECTED"
+	errnoNames[ENOATTR] = "ENODATA"
+}
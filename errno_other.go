@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package main
+
+import "syscall"
+
+// the hosts have no errnos for the keys nor for a missing attribute
+const (
+	ENOKEY       = syscall.EACCES
+	EKEYREJECTED = syscall.EACCES
+	ENOATTR      = syscall.EINVAL
+)
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// The errors of the file system map to an errno, so errors.Is(err,
+// syscall.ENOENT) and errors.Is(err, fs.ErrNotExist) work, and errors.As
+// with a *syscall.Errno gets the number a FUSE or network server has to
+// return. The path API wraps them in a PathError with the operation and
+// the path, or a LinkError with both paths.
+
+// PathError is the error of an operation on a path
+type PathError = fs.PathError
+
+// ErrnoError is an error with the errno it maps to
+type ErrnoError struct {
+	Msg   string
+	Errno syscall.Errno
+}
+
+func newError(msg string, errno syscall.Errno) *ErrnoError {
+	return &ErrnoError{Msg: msg, Errno: errno}
+}
+
+func (e *ErrnoError) Error() string {
+	return e.Msg
+}
+
+func (e *ErrnoError) Is(target error) bool {
+	return target == e.Errno || e.Errno.Is(target)
+}
+
+func (e *ErrnoError) As(target interface{}) bool {
+	errno, ok := target.(*syscall.Errno)
+	if ok {
+		*errno = e.Errno
+	}
+	return ok
+}
+
+var ErrNoSpace error = newError("no space left on device", syscall.ENOSPC)
+var ErrNoInodes error = newError("no free inodes left", syscall.ENOSPC)
+var ErrFileTooBig error = newError("file is too big", syscall.EFBIG)
+var ErrInvalidSize error = newError("invalid size", syscall.EINVAL)
+var ErrIO error = newError("input/output error", syscall.EIO)
+
+// LinkError is the error of an operation on two paths, like link or copy
+type LinkError = os.LinkError
+
+// wrapPath wraps the error of the operation with the path, nil stays nil.
+// An error that has a path already keeps it, it's the more precise one.
+func wrapPath(err *error, op string, path string) {
+	if *err == nil || hasPath(*err) {
+		return
+	}
+	*err = &PathError{Op: op, Path: path, Err: *err}
+}
+
+func wrapLink(err *error, op string, from string, to string) {
+	if *err == nil || hasPath(*err) {
+		return
+	}
+	*err = &LinkError{Op: op, Old: from, New: to, Err: *err}
+}
+
+func hasPath(err error) bool {
+	var pathErr *PathError
+	var linkErr *LinkError
+	return errors.As(err, &pathErr) || errors.As(err, &linkErr)
+}
+
+var errnoNames = map[syscall.Errno]string{
+	syscall.EPERM:        "EPERM",
+	syscall.ENOENT:       "ENOENT",
+	syscall.EIO:          "EIO",
+	syscall.EBADF:        "EBADF",
+	syscall.EACCES:       "EACCES",
+	syscall.EEXIST:       "EEXIST",
+	syscall.ENOTDIR:      "ENOTDIR",
+	syscall.EISDIR:       "EISDIR",
+	syscall.EINVAL:       "EINVAL",
+	syscall.EFBIG:        "EFBIG",
+	syscall.ENOSPC:       "ENOSPC",
+	syscall.EROFS:        "EROFS",
+	syscall.ENAMETOOLONG: "ENAMETOOLONG",
+	syscall.ENOTEMPTY:    "ENOTEMPTY",
+	syscall.ENOTSUP:      "ENOTSUP",
+	syscall.EDQUOT:       "EDQUOT",
+}
+
+// errnoName is the name of the errno of the error, "" when it has none
+func errnoName(err error) string {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return ""
+	}
+	if name, ok := errnoNames[errno]; ok {
+		return name
+	}
+	return errno.Error()
+}
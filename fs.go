@@ -1,19 +1,48 @@
 package main
 
-import "errors"
+import (
+	"syscall"
+	"time"
+)
 
-var ErrFileIsNotRegular error = errors.New("file is not regular")
-var ErrDirIsNotEmpty error = errors.New("directory is not empty")
-var ErrDelDot error = errors.New("can't delete \".\" or \"..\"")
+var ErrFileIsNotRegular error = newError("file is not regular", syscall.EINVAL)
+var ErrDirIsNotEmpty error = newError("directory is not empty", syscall.ENOTEMPTY)
+var ErrDelDot error = newError("can't delete \".\" or \"..\"", syscall.EINVAL)
+var ErrFileIsDir error = newError("file is directory", syscall.EISDIR)
 
 type Stat struct {
 	inode int64
 	ftype FileType
-	size  int64
+	mode  uint16
+	uid   uint32
+	gid   uint32
+	// project of the file, 0 when it's in none
+	project uint32
+	size    int64
+	// bytes of the blocks holding the data, less than size when it's
+	// compressed
+	disk  int64
+	flags uint16
 	links int64
+	atime time.Time
+	mtime time.Time
+	ctime time.Time
+	// bytes in blocks shared with other files or snapshots, and in the
+	// blocks only this file uses
+	shared    int64
+	exclusive int64
+	// extended attributes by name
+	xattrs map[string][]byte
 }
 
-func (f *FileSystem) Create(dir int64, name string, ftype FileType) (int64, error) {
+func (f *FileSystem) Create(dir int64, name string, ftype FileType, mode uint16) (int64, error) {
+	if err := f.writable(); err != nil {
+		return -1, err
+	}
+	// the directory is locked until the new file is linked into it
+	lock := f.locks.Inode(dir)
+	lock.Lock()
+	defer lock.Unlock()
 	directory, err := f.ReadInode(dir)
 	if err != nil {
 		return -1, err
@@ -21,9 +50,32 @@ func (f *FileSystem) Create(dir int64, name string, ftype FileType) (int64, erro
 	if directory.fileType != DIRECTORY {
 		return -1, ErrFileIsNotDir
 	}
+	err = f.access(&directory, MAY_WRITE|MAY_EXEC)
+	if err != nil {
+		return -1, err
+	}
+	// check the name before anything is allocated
+	if len(name) > NAME_MAX {
+		return -1, ErrNameTooLong
+	}
+	_, err = f.FindEntry(&directory, name)
+	if err == nil || (dir == f.Superblock.Root && name == SNAPSHOTS_DIR) {
+		return -1, ErrFileExists
+	}
+	if err != ErrFileNotFound {
+		return -1, err
+	}
+	// the new file is in the project of the directory
+	template := Inode{
+		mode:    mode,
+		flags:   directory.flags & FLAG_COMPRESS,
+		uid:     f.Session.uid,
+		gid:     f.Session.gid,
+		project: directory.project,
+	}
 	file := Inode{}
 	if ftype == REGULAR {
-		file, err = f.AllocateInode()
+		file, err = f.AllocateInode(template)
 		if err != nil {
 			return -1, err
 		}
@@ -33,7 +85,8 @@ func (f *FileSystem) Create(dir int64, name string, ftype FileType) (int64, erro
 		}
 
 	} else {
-		file, err = f.AllocateDirectory()
+		// the empty directory is stored as it is, so the flag can be set
+		file, err = f.AllocateDirectory(template)
 		if err != nil {
 			return -1, err
 		}
@@ -46,42 +99,86 @@ func (f *FileSystem) Create(dir int64, name string, ftype FileType) (int64, erro
 			return -1, err
 		}
 	}
+	err = f.inheritACL(&directory, &file)
+	if err != nil {
+		return -1, err
+	}
 
+	// the file becomes visible to others here
+	fileLock := f.locks.Inode(file.id)
+	fileLock.Lock()
+	defer fileLock.Unlock()
 	err = f.AddFile(&directory, name, &file)
 	if err != nil {
 		return -1, err
 	}
-	return file.id, nil
+	return file.id, f.commit()
 }
 
 func (f *FileSystem) List(dir int64) ([]Entry, error) {
+	entries, err := f.list(dir)
+	if err != nil {
+		return nil, err
+	}
+	return entries, f.touchAccessed(dir)
+}
+
+func (f *FileSystem) list(dir int64) ([]Entry, error) {
+	lock := f.locks.Inode(dir)
+	lock.RLock()
+	defer lock.RUnlock()
 	// read inode
 	inode, err := f.ReadInode(dir)
 	if err != nil {
 		return nil, err
 	}
+	err = f.access(&inode, MAY_READ)
+	if err != nil {
+		return nil, err
+	}
 	// read directory entries
 	entry, err := f.ReadDirectory(&inode)
 	return entry, err
 }
 
 func (f *FileSystem) Lookup(dir int64, name string) (int64, error) {
+	lock := f.locks.Inode(dir)
+	lock.RLock()
+	defer lock.RUnlock()
 	// read inode
-	// read directory entries
-	entry, err := f.List(dir)
+	inode, err := f.ReadInode(dir)
 	if err != nil {
 		return -1, err
 	}
-	// find the file with the given name and return the inode
-	for _, file := range entry {
-		if file.Name == name {
-			return file.Inode, nil
+	// searching needs the execute permission
+	err = f.access(&inode, MAY_EXEC)
+	if err != nil {
+		return -1, err
+	}
+	if dir == f.Superblock.Root && name == SNAPSHOTS_DIR {
+		if snapshots := f.snapshotsInode(); snapshots != NO_INODE {
+			return snapshots, nil
 		}
 	}
-	return -1, ErrFileNotFound
+	// find the file with the given name and return the inode
+	return f.FindEntry(&inode, name)
 }
 
 func (f *FileSystem) ReadFile(file int64, offset int64, buffer []byte) (int64, error) {
+	if offset < 0 {
+		return -1, ErrInvalidSize
+	}
+	n, err := f.readFile(file, offset, buffer)
+	if err != nil {
+		return n, err
+	}
+	return n, f.touchAccessed(file)
+}
+
+func (f *FileSystem) readFile(file int64, offset int64, buffer []byte) (int64, error) {
+	lock := f.locks.Inode(file)
+	lock.RLock()
+	defer lock.RUnlock()
 	// read the inode
 	inode, err := f.ReadInode(file)
 	if err != nil {
@@ -91,26 +188,105 @@ func (f *FileSystem) ReadFile(file int64, offset int64, buffer []byte) (int64, e
 	if inode.fileType != REGULAR {
 		return -1, ErrFileIsNotRegular
 	}
+	err = f.access(&inode, MAY_READ)
+	if err != nil {
+		return -1, err
+	}
 	// read data
 	return f.Read(&inode, offset, buffer)
 
 }
 
 func (f *FileSystem) WriteFile(file int64, offset int64, buffer []byte) (int64, error) {
+	return f.writeFile(file, offset, buffer, false)
+}
+
+// AppendFile writes the buffer at the end of the file. The size is taken
+// under the lock, so appends that run at the same time don't overlap.
+func (f *FileSystem) AppendFile(file int64, buffer []byte) (int64, error) {
+	return f.writeFile(file, 0, buffer, true)
+}
+
+func (f *FileSystem) writeFile(file int64, offset int64, buffer []byte, append bool) (int64, error) {
+	if err := f.writable(); err != nil {
+		return 0, err
+	}
+	if offset < 0 {
+		return 0, ErrInvalidSize
+	}
+	lock := f.locks.Inode(file)
+	lock.Lock()
+	defer lock.Unlock()
 	// read the inode
 	inode, err := f.ReadInode(file)
 	if err != nil {
-		return -1, err
+		return 0, err
 	}
 	// check that it's file
 	if inode.fileType != REGULAR {
-		return -1, ErrFileIsNotRegular
+		return 0, ErrFileIsNotRegular
+	}
+	err = f.access(&inode, MAY_WRITE)
+	if err != nil {
+		return 0, err
+	}
+	if append {
+		offset = inode.Size
 	}
 	// write data
-	return f.Write(&inode, offset, buffer)
+	n, err := f.Write(&inode, offset, buffer)
+	if err != nil {
+		return n, err
+	}
+	return n, f.commit()
+}
+
+// TruncateFile changes the size of the file
+func (f *FileSystem) TruncateFile(file int64, size int64) error {
+	if err := f.writable(); err != nil {
+		return err
+	}
+	lock := f.locks.Inode(file)
+	lock.Lock()
+	defer lock.Unlock()
+	inode, err := f.ReadInode(file)
+	if err != nil {
+		return err
+	}
+	if inode.fileType != REGULAR {
+		return ErrFileIsNotRegular
+	}
+	err = f.access(&inode, MAY_WRITE)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(&inode, size)
+	if err != nil {
+		return err
+	}
+	return f.commit()
 }
 
 func (f *FileSystem) LinkFile(dir int64, name string, file int64) error {
+	if err := f.writable(); err != nil {
+		return err
+	}
+	// only files can be linked, a directory is rejected before the lock of
+	// dir is taken: it may be dir itself or one of its parents, whose locks
+	// come first
+	fileLock := f.locks.Inode(file)
+	fileLock.RLock()
+	fileForLink, err := f.ReadInode(file)
+	fileLock.RUnlock()
+	if err != nil {
+		return err
+	}
+	if fileForLink.fileType != REGULAR {
+		return ErrFileIsNotRegular
+	}
+	dirLock := f.locks.Inode(dir)
+	dirLock.Lock()
+	defer dirLock.Unlock()
 	// read the dir
 	// check that it's directory
 	directory, err := f.ReadInode(dir)
@@ -120,24 +296,53 @@ func (f *FileSystem) LinkFile(dir int64, name string, file int64) error {
 	if directory.fileType != DIRECTORY {
 		return ErrFileIsNotDir
 	}
-	// read the file, check that it's file
-	fileForLink, err := f.ReadInode(file)
+	err = f.access(&directory, MAY_WRITE|MAY_EXEC)
+	if err != nil {
+		return err
+	}
+	// the inode may have been freed and used for dir in the meantime
+	if file == dir {
+		return ErrFileIsNotRegular
+	}
+	// read the file again, it can have changed before its lock was taken
+	fileLock.Lock()
+	defer fileLock.Unlock()
+	fileForLink, err = f.ReadInode(file)
 	if err != nil {
 		return err
 	}
 	if fileForLink.fileType != REGULAR {
 		return ErrFileIsNotRegular
 	}
+	if fileForLink.flags&FLAG_SNAPSHOT != 0 {
+		return ErrReadOnlySnapshot
+	}
+	if dir == f.Superblock.Root && name == SNAPSHOTS_DIR {
+		return ErrFileExists
+	}
+	// it was unlinked in the meantime
+	if fileForLink.linkCount == 0 {
+		return ErrFileNotFound
+	}
 	// add the file to the directory
 	err = f.AddFile(&directory, name, &fileForLink)
-	return err
+	if err != nil {
+		return err
+	}
+	return f.commit()
 }
 
 func (f *FileSystem) UnlinkFile(dir int64, name string) error {
+	if err := f.writable(); err != nil {
+		return err
+	}
 	// forbid "." and ".."
 	if name == "." || name == ".." {
 		return ErrDelDot
 	}
+	dirLock := f.locks.Inode(dir)
+	dirLock.Lock()
+	defer dirLock.Unlock()
 	// read the dir
 	// check that it's directory
 	directory, err := f.ReadInode(dir)
@@ -147,16 +352,23 @@ func (f *FileSystem) UnlinkFile(dir int64, name string) error {
 	if directory.fileType != DIRECTORY {
 		return ErrFileIsNotDir
 	}
-	in, err := f.Lookup(dir, name)
+	err = f.access(&directory, MAY_WRITE|MAY_EXEC)
+	if err != nil {
+		return err
+	}
+	in, err := f.FindEntry(&directory, name)
 	if err != nil {
 		return err
 	}
+	fileLock := f.locks.Inode(in)
+	fileLock.Lock()
+	defer fileLock.Unlock()
 	file, err := f.ReadInode(in)
 	if err != nil {
 		return err
 	}
 	if file.fileType == DIRECTORY {
-		entry, err := f.List(file.id)
+		entry, err := f.ReadDirectory(&file)
 		if err != nil {
 			return err
 		}
@@ -171,35 +383,73 @@ func (f *FileSystem) UnlinkFile(dir int64, name string) error {
 		if err != nil {
 			return err
 		}
-
+		// ".." was pointing to the directory, so its link counter has changed
+		directory, err = f.ReadInode(dir)
+		if err != nil {
+			return err
+		}
 	}
 	// remove the file
 	file, err = f.RemoveFile(&directory, name)
 	if err != nil {
 		return err
 	}
-	// deallocate the inode, it the counter is 0
 	if file.linkCount == 0 {
-		err = f.DeallocateInode(&file)
+		err = f.releaseUnlinked(&file)
 		if err != nil {
 			return err
 		}
 	}
+	return f.commit()
+}
 
-	return nil
+func (f *FileSystem) releaseUnlinked(file *Inode) error {
+	// the file is still open, so it's deallocated on the last close
+	f.locks.orphans.Lock()
+	if f.openCount[file.id] > 0 {
+		err := f.AddOrphan(file)
+		f.locks.orphans.Unlock()
+		return err
+	}
+	f.locks.orphans.Unlock()
+	// deallocate the inode, it the counter is 0
+	return f.DeallocateInode(file)
 }
 
 func (f *FileSystem) Stat(file int64) (Stat, error) {
+	lock := f.locks.Inode(file)
+	lock.RLock()
+	defer lock.RUnlock()
 	// read inode
 	inode, err := f.ReadInode(file)
 	if err != nil {
 		return Stat{}, err
 	}
+	xattrs, err := f.readXattrs(&inode)
+	if err != nil {
+		return Stat{}, err
+	}
+	shared, exclusive, err := f.blockUsage(&inode)
+	if err != nil {
+		return Stat{}, err
+	}
 	// fill struct
 	return Stat{
-		inode: inode.id,
-		ftype: inode.fileType,
-		size:  inode.Size,
-		links: inode.linkCount,
+		inode:     inode.id,
+		ftype:     inode.fileType,
+		mode:      inode.mode,
+		uid:       inode.uid,
+		gid:       inode.gid,
+		project:   inode.project,
+		size:      inode.Size,
+		disk:      int64(len(inode.dataBlocks())) * BLOCK_SIZE,
+		flags:     inode.flags,
+		links:     inode.linkCount,
+		atime:     time.Unix(0, inode.atime),
+		mtime:     time.Unix(0, inode.mtime),
+		ctime:     time.Unix(0, inode.ctime),
+		shared:    shared,
+		exclusive: exclusive,
+		xattrs:    xattrs,
 	}, err
 }
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// FsckReport lists the problems Fsck has found, it's clean when there are
+// none
+type FsckReport struct {
+	Inodes   int64
+	Blocks   int64
+	Problems []string
+}
+
+func (r *FsckReport) problem(format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+// fsckState is what the walk has found so far
+type fsckState struct {
+	// number of directory entries pointing to every reached inode
+	links map[int64]int64
+	// references to every block from the reached inodes
+	refs   map[Block]uint32
+	inodes map[int64]Inode
+}
+
+// Fsck checks that the tree, the orphan list, the quota file, the bitmaps,
+// the block references and the link counters agree. It only reports, the
+// image isn't changed. The result is reliable only when nothing else uses
+// the image.
+func (f *FileSystem) Fsck() (FsckReport, error) {
+	report := FsckReport{}
+	state := &fsckState{
+		links:  make(map[int64]int64),
+		refs:   make(map[Block]uint32),
+		inodes: make(map[int64]Inode),
+	}
+	err := f.fsckTree(&report, state, f.Superblock.Root, "/")
+	if err != nil {
+		return report, err
+	}
+	if snapshots := f.snapshotsInode(); snapshots != NO_INODE {
+		err = f.fsckTree(&report, state, snapshots, "/"+SNAPSHOTS_DIR+"/")
+		if err != nil {
+			return report, err
+		}
+	}
+	// the files that aren't in any directory
+	extra := map[int64]int64{}
+	f.locks.orphans.Lock()
+	for id := f.Superblock.OrphanHead; id != NO_ORPHAN; {
+		if _, ok := extra[id]; ok {
+			report.problem("orphan list has a loop at inode %v", id)
+			break
+		}
+		if !f.fsckRange(&report, id) {
+			break
+		}
+		extra[id] = 0
+		inode, err := f.fsckInode(&report, state, id)
+		if err != nil {
+			f.locks.orphans.Unlock()
+			return report, err
+		}
+		id = inode.nextOrphan
+	}
+	f.locks.orphans.Unlock()
+	if quota := f.Superblock.QuotaInode; quota != NO_INODE && f.fsckRange(&report, quota) {
+		extra[quota] = 1
+		_, err = f.fsckInode(&report, state, quota)
+		if err != nil {
+			return report, err
+		}
+	}
+	// link counters
+	ids := make([]int64, 0, len(state.inodes))
+	for id := range state.inodes {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		want, ok := extra[id]
+		if !ok {
+			want = state.links[id]
+		}
+		if state.inodes[id].linkCount != want {
+			report.problem("inode %v has %v links, %v entries point to it", id, state.inodes[id].linkCount, want)
+		}
+	}
+	err = f.fsckBitmaps(&report, state)
+	return report, err
+}
+
+// fsckRange reports the inode numbers past the inode table
+func (f *FileSystem) fsckRange(report *FsckReport, id int64) bool {
+	if id < 0 || id >= f.Superblock.InodeCount {
+		report.problem("inode %v is out of range", id)
+		return false
+	}
+	return true
+}
+
+// fsckInode reads the inode the first time it's reached and counts the
+// references to its blocks
+func (f *FileSystem) fsckInode(report *FsckReport, state *fsckState, id int64) (Inode, error) {
+	if inode, ok := state.inodes[id]; ok {
+		return inode, nil
+	}
+	lock := f.locks.Inode(id)
+	lock.RLock()
+	inode, err := f.ReadInode(id)
+	lock.RUnlock()
+	if err != nil {
+		return inode, err
+	}
+	state.inodes[id] = inode
+	report.Inodes++
+	if inode.Size < 0 || inode.Size > MAX_FILE_SIZE {
+		report.problem("inode %v has size %v", id, inode.Size)
+		return inode, nil
+	}
+	blocks := inode.dataBlocks()
+	if inode.xattrBlock != NO_BLOCK {
+		blocks = append(blocks, Block(inode.xattrBlock))
+	}
+	for _, block := range blocks {
+		if block < 0 || int64(block) >= f.Superblock.BlockCount {
+			report.problem("inode %v points to block %v, out of range", id, block)
+			continue
+		}
+		state.refs[block]++
+	}
+	return inode, nil
+}
+
+// fsckTree walks the file and everything under it, the path of a directory
+// ends with "/"
+func (f *FileSystem) fsckTree(report *FsckReport, state *fsckState, id int64, path string) error {
+	if !f.fsckRange(report, id) {
+		return nil
+	}
+	inode, err := f.fsckInode(report, state, id)
+	if err != nil {
+		return err
+	}
+	if inode.fileType != DIRECTORY {
+		return nil
+	}
+	lock := f.locks.Inode(id)
+	lock.RLock()
+	entries, err := f.ReadDirectory(&inode)
+	lock.RUnlock()
+	if err != nil {
+		report.problem("directory %v (inode %v) can't be read: %v", path, id, err)
+		return nil
+	}
+	names := map[string]bool{}
+	for _, entry := range entries {
+		if names[entry.Name] {
+			report.problem("directory %v has %q twice", path, entry.Name)
+		}
+		names[entry.Name] = true
+		state.links[entry.Inode]++
+		if entry.Name == "." || entry.Name == ".." {
+			if entry.Name == "." && entry.Inode != id {
+				report.problem("\".\" of %v points to inode %v", path, entry.Inode)
+			}
+			continue
+		}
+		// hard links to directories aren't allowed, so a directory that's
+		// been reached already is in a loop
+		child := path + entry.Name
+		if !f.fsckRange(report, entry.Inode) {
+			continue
+		}
+		if inode, seen := state.inodes[entry.Inode]; seen {
+			if inode.fileType == DIRECTORY {
+				report.problem("directory %v is reached twice", child)
+			}
+			continue
+		}
+		err = f.fsckTree(report, state, entry.Inode, child+"/")
+		if err != nil {
+			return err
+		}
+	}
+	if !names["."] || !names[".."] {
+		report.problem("directory %v misses \".\" or \"..\"", path)
+	}
+	return nil
+}
+
+// fsckBitmaps compares the bitmaps and the reference counts with what the
+// walk has found
+func (f *FileSystem) fsckBitmaps(report *FsckReport, state *fsckState) error {
+	f.locks.inodeBitmap.Lock()
+	inodeBitmap, err := f.readBitmap(f.Superblock.InodeBitmapOffset, f.Superblock.InodeCount/8)
+	f.locks.inodeBitmap.Unlock()
+	if err != nil {
+		return err
+	}
+	for id := int64(0); id < f.Superblock.InodeCount; id++ {
+		used := inodeBitmap[id/8]&(1<<(id%8)) != 0
+		_, reached := state.inodes[id]
+		if used && !reached {
+			report.problem("inode %v is used, but nothing points to it", id)
+		}
+		if !used && reached {
+			report.problem("inode %v is in use, but it's free in the bitmap", id)
+		}
+	}
+	f.locks.blockBitmap.Lock()
+	defer f.locks.blockBitmap.Unlock()
+	blockBitmap, err := f.readBitmap(f.Superblock.BlockBitmapOffset, f.Superblock.BlockCount/8)
+	if err != nil {
+		return err
+	}
+	refs := make([]byte, f.Superblock.BlockCount*BLOCK_REF_SIZE)
+	_, err = io.ReadFull(io.NewSectionReader(f.Device, f.Superblock.BlockRefsOffset, int64(len(refs))), refs)
+	if err != nil {
+		return err
+	}
+	for block := Block(0); int64(block) < f.usableBlocks(); block++ {
+		used := blockBitmap[block/8]&(1<<(block%8)) != 0
+		stored := binary.BigEndian.Uint32(refs[int64(block)*BLOCK_REF_SIZE:])
+		want := state.refs[block]
+		if want != 0 {
+			report.Blocks++
+		}
+		if used != (want != 0) {
+			report.problem("block %v is %v in the bitmap, %v references found", block, bitmapState(used), want)
+		}
+		if stored != want {
+			report.problem("block %v has %v references, %v found", block, stored, want)
+		}
+	}
+	return nil
+}
+
+func bitmapState(used bool) string {
+	if used {
+		return "used"
+	}
+	return "free"
+}
+
+func (f *FileSystem) readBitmap(offset int64, size int64) ([]byte, error) {
+	bitmap := make([]byte, size)
+	_, err := io.ReadFull(io.NewSectionReader(f.Device, offset, size), bitmap)
+	return bitmap, err
+}
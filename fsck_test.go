@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+// checkClean fails the test when fsck finds a problem
+func checkClean(t *testing.T, f *FileSystem) {
+	t.Helper()
+	report, err := f.Fsck()
+	if err != nil || len(report.Problems) != 0 {
+		t.Fatal(err, report.Problems)
+	}
+}
+
+func TestFsck(t *testing.T) {
+	f := newTestFileSystem(t, MountOptions{Dedupe: true})
+	root := f.Superblock.Root
+	for _, run := range []func() error{
+		func() error { return f.MkdirCmd(root, "d") },
+		func() error { return f.CreateCmd(root, "d/a") },
+		func() error { return f.MkdirCmd(root, "c") },
+		func() error { return f.CreateCmd(root, "c/x") },
+	} {
+		if err := run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, _ := f.LookupPath(root, "d/a")
+	c, _ := f.LookupPath(root, "c")
+	x, _ := f.LookupPath(root, "c/x")
+	// shared blocks from links, clones, snapshots, attributes and
+	// compressed clusters
+	for _, run := range []func() error{
+		func() error { _, err := f.WriteFile(a, 0, bytes.Repeat([]byte("ab"), 3000)); return err },
+		func() error { return f.LinkCmd(root, "d/a", "hard") },
+		func() error { return f.CopyCmd(root, "d/a", "clone", true) },
+		func() error { return f.SetXattr(a, "user.big", bytes.Repeat([]byte("v"), 300), 0) },
+		func() error { return f.CreateSnapshot("s") },
+		func() error { _, err := f.WriteFile(a, 5, []byte("zz")); return err },
+		func() error { return f.SetCompression(c, true) },
+		func() error { _, err := f.WriteFile(x, 0, bytes.Repeat([]byte("q"), 5000)); return err },
+	} {
+		if err := run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// an open unlinked file is an orphan, not a lost inode
+	fd, err := f.Open(root, "clone", O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.UnlinkCmd(root, "clone"); err != nil {
+		t.Fatal(err)
+	}
+	checkClean(t, f)
+	if err := f.CloseCmd(fd); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.DeleteSnapshot("s"); err != nil {
+		t.Fatal(err)
+	}
+	checkClean(t, f)
+	// a block used by nothing and a wrong link count
+	if err := f.SetBlockBitmapOffset(Block(f.Superblock.BlockCount-1), USED); err != nil {
+		t.Fatal(err)
+	}
+	inode, err := f.ReadInode(x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inode.linkCount = 5
+	if err := f.WriteInode(&inode); err != nil {
+		t.Fatal(err)
+	}
+	report, err := f.Fsck()
+	if err != nil || len(report.Problems) != 2 {
+		t.Fatal(err, report.Problems)
+	}
+}
+
+func TestFsckCommandLeavesImage(t *testing.T) {
+	path := loopedOrphanImage(t)
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	code := runCli([]string{"--image", path, "fsck"}, nil, out, out)
+	if code != EXIT_CORRUPT || !strings.Contains(out.String(), "orphan list has a loop") {
+		t.Fatalf("fsck exited with %d: %s", code, out)
+	}
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Fatal("fsck changed the image")
+	}
+}
@@ -3,7 +3,7 @@ module file-system
 go 1.20
 
 require (
-	github.com/chzyer/readline v1.5.1 // indirect
-	github.com/xandout/gorpl v0.0.0-20180117214338-a45223323021 // indirect
-	golang.org/x/sys v0.0.0-20220310020820-b874c991c1a5 // indirect
+	github.com/chzyer/readline v1.5.1
+	golang.org/x/crypto v0.10.0
+	golang.org/x/sys v0.9.0
 )
@@ -1,10 +1,11 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
-	"fmt"
 	"io"
-	"os"
+	"time"
 )
 
 type FileType byte
@@ -13,22 +14,77 @@ const (
 	DIRECTORY    FileType = 0
 	REGULAR      FileType = 1
 	DIRECT_LINKS          = 16
+	// the indirect block isn't used, so the direct links hold the data
+	MAX_FILE_SIZE = BLOCK_SIZE * DIRECT_LINKS
+)
+
+// marks an inode pointer that isn't set
+const NO_INODE int64 = -1
+
+const (
+	// the inode belongs to a snapshot and can't be changed
+	FLAG_SNAPSHOT uint16 = 0x1
+	// the data is compressed, see compress.go
+	FLAG_COMPRESS uint16 = 0x2
+	// the inode is used by the file system itself, like the quota file
+	FLAG_SYSTEM uint16 = 0x4
+)
+
+const (
+	DEFAULT_FILE_MODE uint16 = 0644
+	DEFAULT_DIR_MODE  uint16 = 0755
 )
 
 type Inode struct {
-	id            int64
-	fileType      FileType
-	linkCount     int64
-	Size          int64
+	id       int64
+	fileType FileType
+	mode     uint16
+	// FLAG_* bits
+	flags uint16
+	uid   uint32
+	gid   uint32
+	// project of the directory tree, for the project quotas
+	project   uint32
+	linkCount int64
+	Size      int64
+	// access, modification and change times, in nanoseconds since the epoch
+	atime         int64
+	mtime         int64
+	ctime         int64
 	Blocks        [DIRECT_LINKS]int64
 	IndirectBlock int64
+	// next inode in the orphan list
+	nextOrphan int64
+	// extended attributes that don't fit inline are kept in a block
+	xattrBlock int64
+	xattrs     [XATTR_INLINE_SIZE]byte
 }
 
-func (i *Inode) Write(file *os.File) error {
+func (i *Inode) Write(file io.Writer) error {
 	err := binary.Write(file, binary.BigEndian, i.fileType)
 	if err != nil {
 		return err
 	}
+	err = binary.Write(file, binary.BigEndian, i.mode)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(file, binary.BigEndian, i.flags)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(file, binary.BigEndian, i.uid)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(file, binary.BigEndian, i.gid)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(file, binary.BigEndian, i.project)
+	if err != nil {
+		return err
+	}
 	err = binary.Write(file, binary.BigEndian, i.linkCount)
 	if err != nil {
 		return err
@@ -37,6 +93,18 @@ func (i *Inode) Write(file *os.File) error {
 	if err != nil {
 		return err
 	}
+	err = binary.Write(file, binary.BigEndian, i.atime)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(file, binary.BigEndian, i.mtime)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(file, binary.BigEndian, i.ctime)
+	if err != nil {
+		return err
+	}
 
 	for j := 0; j < DIRECT_LINKS; j++ {
 		err = binary.Write(file, binary.BigEndian, i.Blocks[j])
@@ -49,15 +117,47 @@ func (i *Inode) Write(file *os.File) error {
 	if err != nil {
 		return err
 	}
+	err = binary.Write(file, binary.BigEndian, i.nextOrphan)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(file, binary.BigEndian, i.xattrBlock)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(file, binary.BigEndian, i.xattrs)
+	if err != nil {
+		return err
+	}
 
 	return nil
 }
 
-func (i *Inode) Read(file *os.File) error {
+func (i *Inode) Read(file io.Reader) error {
 	err := binary.Read(file, binary.BigEndian, &i.fileType)
 	if err != nil {
 		return err
 	}
+	err = binary.Read(file, binary.BigEndian, &i.mode)
+	if err != nil {
+		return err
+	}
+	err = binary.Read(file, binary.BigEndian, &i.flags)
+	if err != nil {
+		return err
+	}
+	err = binary.Read(file, binary.BigEndian, &i.uid)
+	if err != nil {
+		return err
+	}
+	err = binary.Read(file, binary.BigEndian, &i.gid)
+	if err != nil {
+		return err
+	}
+	err = binary.Read(file, binary.BigEndian, &i.project)
+	if err != nil {
+		return err
+	}
 	err = binary.Read(file, binary.BigEndian, &i.linkCount)
 	if err != nil {
 		return err
@@ -66,6 +166,18 @@ func (i *Inode) Read(file *os.File) error {
 	if err != nil {
 		return err
 	}
+	err = binary.Read(file, binary.BigEndian, &i.atime)
+	if err != nil {
+		return err
+	}
+	err = binary.Read(file, binary.BigEndian, &i.mtime)
+	if err != nil {
+		return err
+	}
+	err = binary.Read(file, binary.BigEndian, &i.ctime)
+	if err != nil {
+		return err
+	}
 
 	for j := 0; j < DIRECT_LINKS; j++ {
 		err = binary.Read(file, binary.BigEndian, &i.Blocks[j])
@@ -78,54 +190,166 @@ func (i *Inode) Read(file *os.File) error {
 	if err != nil {
 		return err
 	}
+	err = binary.Read(file, binary.BigEndian, &i.nextOrphan)
+	if err != nil {
+		return err
+	}
+	err = binary.Read(file, binary.BigEndian, &i.xattrBlock)
+	if err != nil {
+		return err
+	}
+	err = binary.Read(file, binary.BigEndian, &i.xattrs)
+	if err != nil {
+		return err
+	}
 
 	return nil
 }
 
 func (f *FileSystem) ReadInode(inode int64) (Inode, error) {
+	i, ok := f.inodes.Get(inode)
+	if ok {
+		return i, nil
+	}
+	i, err := f.readInodeFromDisk(inode)
+	if err != nil {
+		return i, err
+	}
+	return f.inodes.Fill(inode, i)
+}
+
+func (f *FileSystem) WriteInode(inode *Inode) error {
+	if err := f.writable(); err != nil {
+		return err
+	}
+	// the inode reaches the disk on sync or when it's evicted
+	return f.inodes.Put(inode.id, *inode)
+}
+
+func (f *FileSystem) readInodeFromDisk(inode int64) (Inode, error) {
 	// find the location of inode
 	// and read it
 	location := f.Superblock.InodesOffset + inode*INODE_SIZE
-	f.File.Seek(location, io.SeekStart)
 	i := Inode{
 		id: inode,
 	}
-	err := i.Read(f.File)
+	// read the whole inode with a single call
+	buffer := make([]byte, INODE_SIZE)
+	_, err := f.Device.ReadAt(buffer, location)
+	if err != nil {
+		return i, err
+	}
+	// the attributes are at the end
+	f.decrypt(buffer[INODE_SIZE-XATTR_INLINE_SIZE:], f.inodeSector(inode))
+	err = i.Read(bytes.NewReader(buffer))
 	return i, err
 }
 
-func (f *FileSystem) WriteInode(inode *Inode) error {
-	location := f.Superblock.InodesOffset + inode.id*INODE_SIZE
-	f.File.Seek(location, io.SeekStart)
-	err := inode.Write(f.File)
+func (f *FileSystem) writeInodeToDisk(id int64, inode Inode) error {
+	// serialize the inode first, so it's written with a single call
+	location := f.Superblock.InodesOffset + id*INODE_SIZE
+	var buffer bytes.Buffer
+	err := inode.Write(&buffer)
+	if err != nil {
+		return err
+	}
+	data := buffer.Bytes()
+	// the attributes are at the end
+	copy(data[INODE_SIZE-XATTR_INLINE_SIZE:], f.encrypt(data[INODE_SIZE-XATTR_INLINE_SIZE:], f.inodeSector(id)))
+	_, err = f.Device.WriteAt(data, location)
 	return err
 }
 
-func (f *FileSystem) AllocateInode() (Inode, error) {
-	id, err := f.FindFreeInode()
+// touchModified sets the modification and the change times to now
+func (i *Inode) touchModified() {
+	now := time.Now().UnixNano()
+	i.mtime = now
+	i.ctime = now
+}
+
+// touchChanged sets the change time to now, for changes of the metadata
+func (i *Inode) touchChanged() {
+	i.ctime = time.Now().UnixNano()
+}
+
+// ATIME_INTERVAL is how often the access time is updated when the file
+// hasn't changed since the last access, like relatime
+const ATIME_INTERVAL = 24 * time.Hour
+
+// touchAccessed updates the access time after a read. The caller must not
+// hold the lock of the inode.
+func (f *FileSystem) touchAccessed(id int64) error {
+	// reading doesn't change a read-only image
+	if f.Options.ReadOnly {
+		return nil
+	}
+	lock := f.locks.Inode(id)
+	lock.Lock()
+	defer lock.Unlock()
+	inode, err := f.ReadInode(id)
 	if err != nil {
-		return Inode{}, err
+		return err
 	}
+	if inode.flags&FLAG_SNAPSHOT != 0 {
+		return nil
+	}
+	now := time.Now().UnixNano()
+	if inode.atime > inode.mtime && inode.atime > inode.ctime && now-inode.atime < int64(ATIME_INTERVAL) {
+		return nil
+	}
+	inode.atime = now
+	return f.WriteInode(&inode)
+}
 
-	err = f.SetInodeBitmapOffset(id, USED)
+// AllocateInode returns a new regular file with the mode, the flags and the
+// owners of the template. The owners are charged for the inode.
+func (f *FileSystem) AllocateInode(template Inode) (Inode, error) {
+	if err := f.writable(); err != nil {
+		return Inode{}, err
+	}
+	err := f.charge(&template, 0, 1)
+	if err != nil {
+		return Inode{}, err
+	}
+	f.locks.inodeBitmap.Lock()
+	id, err := f.FindFreeInode()
+	if err == nil {
+		err = f.SetInodeBitmapOffset(id, USED)
+	}
+	if err == nil {
+		f.freeInodes--
+	}
+	f.locks.inodeBitmap.Unlock()
 	if err != nil {
+		f.charge(&template, 0, -1)
 		return Inode{}, err
 	}
 
+	now := time.Now().UnixNano()
 	return Inode{
-		id:        id,
-		fileType:  REGULAR,
-		linkCount: 0,
-		Size:      0,
+		id:         id,
+		fileType:   REGULAR,
+		mode:       template.mode,
+		flags:      template.flags,
+		uid:        template.uid,
+		gid:        template.gid,
+		project:    template.project,
+		linkCount:  0,
+		Size:       0,
+		atime:      now,
+		mtime:      now,
+		ctime:      now,
+		nextOrphan: NO_ORPHAN,
+		xattrBlock: NO_BLOCK,
 	}, nil
 }
 func (f *FileSystem) FindFreeInode() (int64, error) {
 	start := f.Superblock.InodeBitmapOffset
-	f.File.Seek(start, io.SeekStart)
+	bitmap := bufio.NewReader(io.NewSectionReader(f.Device, start, f.Superblock.InodeCount/8))
 	var bbyte int64 = 0
 	for ; bbyte < f.Superblock.InodeCount/8; bbyte++ {
 		var word byte
-		err := binary.Read(f.File, binary.BigEndian, &word)
+		err := binary.Read(bitmap, binary.BigEndian, &word)
 		if err != nil {
 			return -1, err
 		}
@@ -140,17 +364,17 @@ func (f *FileSystem) FindFreeInode() (int64, error) {
 		}
 	}
 
-	return -1, fmt.Errorf("out of memory")
+	return -1, ErrNoInodes
 }
 
 func (f *FileSystem) SetInodeBitmapOffset(inode int64, status int) error {
 	byte_position := f.Superblock.InodeBitmapOffset + inode/8
-	f.File.Seek(byte_position, io.SeekStart)
-	var bbyte byte
-	err := binary.Read(f.File, binary.BigEndian, &bbyte)
+	buffer := make([]byte, 1)
+	_, err := f.Device.ReadAt(buffer, byte_position)
 	if err != nil {
 		return err
 	}
+	bbyte := buffer[0]
 	bbit := inode % 8
 	if status == FREE {
 		var mask byte = ^(1 << bbit) //  bbit = 3; 1 << bbit = 0b0000_1000
@@ -161,12 +385,8 @@ func (f *FileSystem) SetInodeBitmapOffset(inode int64, status int) error {
 		// 0bxxxxxxxxx
 		// 0bxxxxx1xxx
 	}
-	f.File.Seek(byte_position, io.SeekStart)
-	err = binary.Write(f.File, binary.BigEndian, bbyte)
-	if err != nil {
-		return err
-	}
-	return nil
+	_, err = f.Device.WriteAt([]byte{bbyte}, byte_position)
+	return err
 }
 
 func (f *FileSystem) DeallocateInode(file *Inode) error {
@@ -174,5 +394,25 @@ func (f *FileSystem) DeallocateInode(file *Inode) error {
 	if err != nil {
 		return err
 	}
-	return f.SetInodeBitmapOffset(file.id, FREE)
+	if file.xattrBlock != NO_BLOCK {
+		err = f.FreeBlock(file, Block(file.xattrBlock))
+		if err != nil {
+			return err
+		}
+		file.xattrBlock = NO_BLOCK
+		err = f.WriteInode(file)
+		if err != nil {
+			return err
+		}
+	}
+	f.locks.inodeBitmap.Lock()
+	err = f.SetInodeBitmapOffset(file.id, FREE)
+	if err == nil {
+		f.freeInodes++
+	}
+	f.locks.inodeBitmap.Unlock()
+	if err != nil {
+		return err
+	}
+	return f.charge(file, 0, -1)
 }
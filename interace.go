@@ -2,127 +2,615 @@ package main
 
 import (
 	"errors"
-	"fmt"
+	"strings"
+	"syscall"
 )
 
-var ErrUnknownFS error = errors.New("unknown file descriptor")
+const (
+	O_RDONLY  = 0x0
+	O_WRONLY  = 0x1
+	O_RDWR    = 0x2
+	O_ACCMODE = 0x3
+	O_CREAT   = 0x40
+	O_EXCL    = 0x80
+	O_TRUNC   = 0x200
+	O_APPEND  = 0x400
+)
+
+// the first descriptor handed out, 0-2 are reserved like stdin/stdout/stderr
+const FIRST_FD Fkey = 3
+
+var ErrUnknownFS error = newError("unknown file descriptor", syscall.EBADF)
+var ErrBadFd error = newError("bad file descriptor", syscall.EBADF)
+var ErrInvalidFlags error = newError("invalid open flags", syscall.EINVAL)
 
-func (f *FileSystem) CreateCmd(pwd int64, path string) error {
-	_, err := f.Create(pwd, path, REGULAR)
+func (f *FileSystem) CreateCmd(pwd int64, path string) (err error) {
+	defer wrapPath(&err, "create", path)
+	dir, name, err := f.ResolveParent(pwd, path)
+	if err != nil {
+		return err
+	}
+	_, err = f.Create(dir, name, REGULAR, DEFAULT_FILE_MODE)
 	return err
 }
 
-func (f *FileSystem) LinkCmd(pwd int64, from string, to string) error {
-	inode, err := f.Lookup(pwd, from)
+func (f *FileSystem) MkdirCmd(pwd int64, path string) (err error) {
+	defer wrapPath(&err, "mkdir", path)
+	dir, name, err := f.ResolveParent(pwd, path)
 	if err != nil {
 		return err
 	}
-	err = f.LinkFile(pwd, to, inode)
+	_, err = f.Create(dir, name, DIRECTORY, DEFAULT_DIR_MODE)
 	return err
 }
 
-func (f *FileSystem) UnlinkCmd(pwd int64, name string) error {
-	err := f.UnlinkFile(pwd, name)
+// CopyCmd copies the file, with reflink the copy shares the blocks of the
+// original
+func (f *FileSystem) CopyCmd(pwd int64, from string, to string, reflink bool) (err error) {
+	defer wrapLink(&err, "copy", from, to)
+	src, err := f.LookupPath(pwd, from)
+	if err != nil {
+		return err
+	}
+	dir, name, err := f.ResolveParent(pwd, to)
+	if err != nil {
+		return err
+	}
+	if reflink {
+		_, err = f.Clone(src, dir, name)
+		return err
+	}
+	stat, err := f.Stat(src)
+	if err != nil {
+		return err
+	}
+	if stat.ftype != REGULAR {
+		return ErrFileIsNotRegular
+	}
+	data := make([]byte, stat.size)
+	n, err := f.ReadFile(src, 0, data)
+	if err != nil {
+		return err
+	}
+	file, err := f.Create(dir, name, REGULAR, stat.mode)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteFile(file, 0, data[:n])
 	return err
 }
 
-func (f *FileSystem) TruncateCmd(pwd int64, name string, size int64) error {
-	inodeId, err := f.Lookup(pwd, name)
+func (f *FileSystem) LinkCmd(pwd int64, from string, to string) (err error) {
+	defer wrapLink(&err, "link", from, to)
+	inode, err := f.LookupPath(pwd, from)
 	if err != nil {
 		return err
 	}
-	inode, err := f.ReadInode(inodeId)
+	dir, name, err := f.ResolveParent(pwd, to)
+	if err != nil {
+		return err
+	}
+	err = f.LinkFile(dir, name, inode)
+	return err
+}
+
+func (f *FileSystem) UnlinkCmd(pwd int64, path string) (err error) {
+	defer wrapPath(&err, "unlink", path)
+	dir, name, err := f.ResolveParent(pwd, path)
+	if err != nil {
+		return err
+	}
+	err = f.UnlinkFile(dir, name)
+	return err
+}
+
+// RemoveAllCmd removes the file, or the directory and everything under it
+func (f *FileSystem) RemoveAllCmd(pwd int64, path string) (err error) {
+	defer wrapPath(&err, "remove", path)
+	inodeId, err := f.LookupPath(pwd, path)
+	if err != nil {
+		return err
+	}
+	stat, err := f.Stat(inodeId)
+	if err != nil {
+		return err
+	}
+	if stat.ftype == DIRECTORY {
+		entries, err := f.List(inodeId)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.Name == "." || entry.Name == ".." {
+				continue
+			}
+			err = f.RemoveAllCmd(inodeId, entry.Name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return f.UnlinkCmd(pwd, path)
+}
+
+func (f *FileSystem) TruncateCmd(pwd int64, path string, size int64) (err error) {
+	defer wrapPath(&err, "truncate", path)
+	inodeId, err := f.LookupPath(pwd, path)
 	if err != nil {
 		return err
 	}
-	err = f.Truncate(&inode, size)
+	return f.TruncateFile(inodeId, size)
+}
+
+// GetCmd returns the content of the file
+func (f *FileSystem) GetCmd(pwd int64, path string) (_ []byte, err error) {
+	defer wrapPath(&err, "read", path)
+	inodeId, err := f.LookupPath(pwd, path)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := f.Stat(inodeId)
+	if err != nil {
+		return nil, err
+	}
+	if stat.ftype != REGULAR {
+		return nil, ErrFileIsDir
+	}
+	data := make([]byte, stat.size)
+	n, err := f.ReadFile(inodeId, 0, data)
+	if err != nil {
+		return nil, err
+	}
+	return data[:n], nil
+}
+
+// HeadCmd returns the first count lines of the file, or bytes when lines
+// is false
+func (f *FileSystem) HeadCmd(pwd int64, path string, count int64, lines bool) (_ []byte, err error) {
+	defer wrapPath(&err, "head", path)
+	if count > MAX_FILE_SIZE {
+		count = MAX_FILE_SIZE
+	}
+	if !lines {
+		inodeId, err := f.LookupPath(pwd, path)
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, count)
+		n, err := f.ReadFile(inodeId, 0, data)
+		if err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	}
+	data, err := f.GetCmd(pwd, path)
+	if err != nil || count <= 0 {
+		return nil, err
+	}
+	for i, c := range data {
+		if c != '\n' {
+			continue
+		}
+		count--
+		if count <= 0 {
+			return data[:i+1], nil
+		}
+	}
+	return data, nil
+}
+
+// TailCmd returns the last count lines of the file, or bytes when lines
+// is false
+func (f *FileSystem) TailCmd(pwd int64, path string, count int64, lines bool) (_ []byte, err error) {
+	defer wrapPath(&err, "tail", path)
+	if !lines {
+		inodeId, err := f.LookupPath(pwd, path)
+		if err != nil {
+			return nil, err
+		}
+		stat, err := f.Stat(inodeId)
+		if err != nil {
+			return nil, err
+		}
+		offset := stat.size - count
+		if offset < 0 {
+			offset = 0
+		}
+		data := make([]byte, stat.size-offset)
+		n, err := f.ReadFile(inodeId, offset, data)
+		if err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	}
+	data, err := f.GetCmd(pwd, path)
+	if err != nil || count <= 0 {
+		return nil, err
+	}
+	// the newline that ends the last line doesn't start another one
+	end := len(data)
+	if end > 0 && data[end-1] == '\n' {
+		end--
+	}
+	for i := end - 1; i >= 0; i-- {
+		if data[i] != '\n' {
+			continue
+		}
+		count--
+		if count == 0 {
+			return data[i+1:], nil
+		}
+	}
+	return data, nil
+}
+
+// lookupOrCreate finds the file, a regular one is created when it's missing
+func (f *FileSystem) lookupOrCreate(pwd int64, path string) (int64, error) {
+	inodeId, err := f.LookupPath(pwd, path)
+	if !errors.Is(err, ErrFileNotFound) {
+		return inodeId, err
+	}
+	dir, name, err := f.ResolveParent(pwd, path)
+	if err != nil {
+		return -1, err
+	}
+	return f.Create(dir, name, REGULAR, DEFAULT_FILE_MODE)
+}
+
+// PutCmd replaces the content of the file, it's created when it's missing
+func (f *FileSystem) PutCmd(pwd int64, path string, data []byte) (err error) {
+	defer wrapPath(&err, "write", path)
+	inodeId, err := f.lookupOrCreate(pwd, path)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteFile(inodeId, 0, data)
+	if err != nil {
+		return err
+	}
+	return f.TruncateFile(inodeId, int64(len(data)))
+}
+
+// AppendCmd adds the data at the end of the file, it's created when it's
+// missing
+func (f *FileSystem) AppendCmd(pwd int64, path string, data []byte) (err error) {
+	defer wrapPath(&err, "append", path)
+	inodeId, err := f.lookupOrCreate(pwd, path)
+	if err != nil {
+		return err
+	}
+	_, err = f.AppendFile(inodeId, data)
 	return err
 }
 
-func (f *FileSystem) StatCmd(pwd int64, name string) (Stat, error) {
-	inodeId, err := f.Lookup(pwd, name)
+func (f *FileSystem) StatCmd(pwd int64, path string) (_ Stat, err error) {
+	defer wrapPath(&err, "stat", path)
+	inodeId, err := f.LookupPath(pwd, path)
 	if err != nil {
 		return Stat{}, err
 	}
 	return f.Stat(inodeId)
 }
 
-func (f *FileSystem) OpenCmd(pwd int64, name string) (Fkey, error) {
-	// read inode
-	inodeId, err := f.Lookup(pwd, name)
+func (f *FileSystem) SetXattrCmd(pwd int64, path string, name string, value []byte, flags int) (err error) {
+	defer wrapPath(&err, "setxattr", path)
+	inodeId, err := f.LookupPath(pwd, path)
 	if err != nil {
-		return "", err
+		return err
+	}
+	return f.SetXattr(inodeId, name, value, flags)
+}
+
+func (f *FileSystem) GetXattrCmd(pwd int64, path string, name string) (_ []byte, err error) {
+	defer wrapPath(&err, "getxattr", path)
+	inodeId, err := f.LookupPath(pwd, path)
+	if err != nil {
+		return nil, err
+	}
+	return f.GetXattr(inodeId, name)
+}
+
+func (f *FileSystem) ListXattrCmd(pwd int64, path string) (_ []string, err error) {
+	defer wrapPath(&err, "listxattr", path)
+	inodeId, err := f.LookupPath(pwd, path)
+	if err != nil {
+		return nil, err
+	}
+	return f.ListXattr(inodeId)
+}
+
+func (f *FileSystem) RemoveXattrCmd(pwd int64, path string, name string) (err error) {
+	defer wrapPath(&err, "removexattr", path)
+	inodeId, err := f.LookupPath(pwd, path)
+	if err != nil {
+		return err
+	}
+	return f.RemoveXattr(inodeId, name)
+}
+
+func (f *FileSystem) SetCompressionCmd(pwd int64, path string, on bool) (err error) {
+	defer wrapPath(&err, "chattr", path)
+	inodeId, err := f.LookupPath(pwd, path)
+	if err != nil {
+		return err
+	}
+	return f.SetCompression(inodeId, on)
+}
+
+func (f *FileSystem) SetProjectCmd(pwd int64, path string, project uint32) (err error) {
+	defer wrapPath(&err, "project", path)
+	inodeId, err := f.LookupPath(pwd, path)
+	if err != nil {
+		return err
+	}
+	return f.SetProject(inodeId, project)
+}
+
+func (f *FileSystem) GetACLCmd(pwd int64, path string, kind ACLType) (_ ACL, err error) {
+	defer wrapPath(&err, "getacl", path)
+	inodeId, err := f.LookupPath(pwd, path)
+	if err != nil {
+		return nil, err
+	}
+	return f.GetACL(inodeId, kind)
+}
+
+func (f *FileSystem) SetACLCmd(pwd int64, path string, kind ACLType, acl ACL) (err error) {
+	defer wrapPath(&err, "setacl", path)
+	inodeId, err := f.LookupPath(pwd, path)
+	if err != nil {
+		return err
+	}
+	return f.SetACL(inodeId, kind, acl)
+}
+
+// ParseOpenFlags parses flags written like "O_RDWR|O_CREAT|O_TRUNC"
+func ParseOpenFlags(str string) (int, error) {
+	names := map[string]int{
+		"O_RDONLY": O_RDONLY,
+		"O_WRONLY": O_WRONLY,
+		"O_RDWR":   O_RDWR,
+		"O_CREAT":  O_CREAT,
+		"O_EXCL":   O_EXCL,
+		"O_TRUNC":  O_TRUNC,
+		"O_APPEND": O_APPEND,
+	}
+	flags := 0
+	for _, name := range strings.Split(str, "|") {
+		flag, ok := names[strings.ToUpper(name)]
+		if !ok {
+			return 0, ErrInvalidFlags
+		}
+		flags |= flag
+	}
+	return flags, nil
+}
+
+// allocateFkey is called with f.locks.fds held
+func (s *Session) allocateFkey() Fkey {
+	// POSIX hands out the lowest free descriptor
+	key := FIRST_FD
+	for {
+		if _, ok := s.fds[key]; !ok {
+			return key
+		}
+		key++
+	}
+}
+
+func (f *FileSystem) Open(pwd int64, path string, flags int, mode uint16) (_ Fkey, err error) {
+	defer wrapPath(&err, "open", path)
+	access := flags & O_ACCMODE
+	if access != O_RDONLY && access != O_WRONLY && access != O_RDWR {
+		return -1, ErrInvalidFlags
+	}
+	// find the file, create it if it's missing and O_CREAT is set
+	inodeId, err := f.LookupPath(pwd, path)
+	created := false
+	if err == nil && flags&O_CREAT != 0 && flags&O_EXCL != 0 {
+		return -1, ErrFileExists
+	}
+	if errors.Is(err, ErrFileNotFound) && flags&O_CREAT != 0 {
+		dir, name, err := f.ResolveParent(pwd, path)
+		if err != nil {
+			return -1, err
+		}
+		inodeId, err = f.Create(dir, name, REGULAR, mode)
+		created = err == nil
+		// somebody else has created it first
+		if err == ErrFileExists && flags&O_EXCL == 0 {
+			inodeId, err = f.Lookup(dir, name)
+		}
+		if err != nil {
+			return -1, err
+		}
+	} else if err != nil {
+		return -1, err
+	}
+	lock := f.locks.Inode(inodeId)
+	lock.Lock()
+	defer lock.Unlock()
+	inode, err := f.ReadInode(inodeId)
+	if err != nil {
+		return -1, err
+	}
+	// it was unlinked after the lookup
+	if inode.linkCount == 0 {
+		return -1, ErrFileNotFound
 	}
-	// allocate new Fkey
-	key := fmt.Sprintf("%v", f.Session.counter)
-	f.Session.counter++
+	// directories can be opened only for reading
+	if inode.fileType == DIRECTORY && (access != O_RDONLY || flags&O_TRUNC != 0) {
+		return -1, ErrFileIsDir
+	}
+	if access != O_RDONLY || flags&O_TRUNC != 0 {
+		err = f.writable()
+		if err != nil {
+			return -1, err
+		}
+	}
+	// the new file can be opened whatever its mode is
+	if !created {
+		var want uint16
+		if access != O_WRONLY {
+			want |= MAY_READ
+		}
+		if access != O_RDONLY {
+			want |= MAY_WRITE
+		}
+		err = f.access(&inode, want)
+		if err != nil {
+			return -1, err
+		}
+	}
+	if flags&O_TRUNC != 0 && access != O_RDONLY {
+		err = f.Truncate(&inode, 0)
+		if err == nil {
+			err = f.commit()
+		}
+		if err != nil {
+			return -1, err
+		}
+	}
+	// the counter is updated under the inode lock, so unlink sees it
+	f.locks.orphans.Lock()
+	f.openCount[inodeId]++
+	f.locks.orphans.Unlock()
 	// add Fd to sessions
-	f.Session.fds[Fkey(key)] = &Fd{
+	f.locks.fds.Lock()
+	defer f.locks.fds.Unlock()
+	key := f.Session.allocateFkey()
+	f.Session.fds[key] = &Fd{
 		inode:    inodeId,
 		location: 0,
+		flags:    flags,
 	}
-	return Fkey(key), nil
+	return key, nil
 }
 
-func (f *FileSystem) WriteCmd(fd Fkey, data string) error {
-	// get inode from sessions
+func (f *FileSystem) getFd(fd Fkey) (*Fd, error) {
+	f.locks.fds.Lock()
+	defer f.locks.fds.Unlock()
 	fileDesc, ok := f.Session.fds[fd]
 	if !ok {
-		return ErrUnknownFS
+		return nil, ErrUnknownFS
 	}
+	return fileDesc, nil
+}
+
+func (f *FileSystem) WriteCmd(fd Fkey, data string) error {
+	// get inode from sessions
+	fileDesc, err := f.getFd(fd)
+	if err != nil {
+		return err
+	}
+	if fileDesc.flags&O_ACCMODE == O_RDONLY {
+		return ErrBadFd
+	}
+	fileDesc.mu.Lock()
+	defer fileDesc.mu.Unlock()
 	inodeId := fileDesc.inode
+	lock := f.locks.Inode(inodeId)
+	lock.Lock()
+	defer lock.Unlock()
 	inode, err := f.ReadInode(inodeId)
 	if err != nil {
 		return err
 	}
+	// appending always starts at the current end of file
+	if fileDesc.flags&O_APPEND != 0 {
+		fileDesc.location = inode.Size
+	}
 	// write data to the file
 	n, err := f.Write(&inode, fileDesc.location, []byte(data))
+	// update location, past the bytes of a short write too
+	fileDesc.location += n
 	if err != nil {
 		return err
 	}
-	// update location
-	fileDesc.location += n
-	return nil
+	return f.commit()
 }
 
 func (f *FileSystem) ReadCmd(fd Fkey, length int64) (string, error) {
-	// get inode from sessions
-	fileDesc, ok := f.Session.fds[fd]
-	if !ok {
-		return "", ErrUnknownFS
+	if length < 0 {
+		return "", ErrInvalidSize
 	}
-	inodeId := fileDesc.inode
-	inode, err := f.ReadInode(inodeId)
+	// no file has more to read
+	length = min(length, MAX_FILE_SIZE)
+	// get inode from sessions
+	fileDesc, err := f.getFd(fd)
 	if err != nil {
 		return "", err
 	}
+	if fileDesc.flags&O_ACCMODE == O_WRONLY {
+		return "", ErrBadFd
+	}
+	fileDesc.mu.Lock()
+	defer fileDesc.mu.Unlock()
 	// read data from file
 	buff := make([]byte, length)
-	n, err := f.Read(&inode, fileDesc.location, buff)
+	n, err := f.readFd(fileDesc.inode, fileDesc.location, buff)
 	if err != nil {
 		return "", err
 	}
 	// update location
 	fileDesc.location += n
-	return string(buff), nil
+	// only the bytes before the end of the file are returned
+	return string(buff[:n]), f.touchAccessed(fileDesc.inode)
+}
+
+// readFd reads the file of an fd under the lock of its inode, the access
+// was checked when it was opened
+func (f *FileSystem) readFd(id int64, offset int64, buffer []byte) (int64, error) {
+	lock := f.locks.Inode(id)
+	lock.RLock()
+	defer lock.RUnlock()
+	inode, err := f.ReadInode(id)
+	if err != nil {
+		return 0, err
+	}
+	if inode.fileType != REGULAR {
+		return 0, ErrFileIsDir
+	}
+	return f.Read(&inode, offset, buffer)
 }
 
 func (f *FileSystem) SeekCmd(fd Fkey, offset int64) error {
+	if offset < 0 {
+		return ErrInvalidSize
+	}
 	// get inode from sessions
-	fileDesc, ok := f.Session.fds[fd]
-	if !ok {
-		return ErrUnknownFS
+	fileDesc, err := f.getFd(fd)
+	if err != nil {
+		return err
 	}
 	// set the location to the offset
+	fileDesc.mu.Lock()
 	fileDesc.location = offset
+	fileDesc.mu.Unlock()
 	return nil
 }
 
 func (f *FileSystem) CloseCmd(fd Fkey) error {
 	// remove entry from the sessions
-	if _, ok := f.Session.fds[fd]; !ok {
+	f.locks.fds.Lock()
+	fileDesc, ok := f.Session.fds[fd]
+	if !ok {
+		f.locks.fds.Unlock()
 		return ErrUnknownFS
 	}
 	delete(f.Session.fds, fd)
-	return nil
+	f.locks.fds.Unlock()
+	f.locks.orphans.Lock()
+	defer f.locks.orphans.Unlock()
+	f.openCount[fileDesc.inode]--
+	if f.openCount[fileDesc.inode] > 0 {
+		return nil
+	}
+	delete(f.openCount, fileDesc.inode)
+	// the file could be unlinked while it was open
+	err := f.ReleaseOrphan(fileDesc.inode)
+	if err != nil {
+		return err
+	}
+	return f.commit()
 }
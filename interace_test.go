@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNegativeOffsets(t *testing.T) {
+	f := newTestFileSystem(t, MountOptions{})
+	root := f.Superblock.Root
+	fd, err := f.Open(root, "a", O_RDWR|O_CREAT, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.WriteCmd(fd, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SeekCmd(fd, -5000); !errors.Is(err, ErrInvalidSize) {
+		t.Fatalf("seek to a negative offset: %v", err)
+	}
+	// the location is kept
+	if err := f.WriteCmd(fd, "!"); err != nil {
+		t.Fatal(err)
+	}
+	file, err := f.Lookup(root, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.ReadFile(file, -4, make([]byte, 4)); !errors.Is(err, ErrInvalidSize) {
+		t.Fatalf("read at a negative offset: %v", err)
+	}
+	if _, err := f.WriteFile(file, -4, []byte("x")); !errors.Is(err, ErrInvalidSize) {
+		t.Fatalf("write at a negative offset: %v", err)
+	}
+	buf := make([]byte, 10)
+	if n, err := f.ReadFile(file, 0, buf); err != nil || string(buf[:n]) != "hello!" {
+		t.Fatalf("read %q: %v", buf[:n], err)
+	}
+}
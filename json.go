@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+	"unicode/utf8"
+)
+
+// The JSON output prints one object per line, the field names below are
+// kept stable for the tools that parse them.
+
+// FileInfo is Stat for the users of the package
+type FileInfo struct {
+	Inode int64 `json:"inode"`
+	// "regular" or "directory"
+	Type    string `json:"type"`
+	Mode    uint16 `json:"mode"`
+	Uid     uint32 `json:"uid"`
+	Gid     uint32 `json:"gid"`
+	Project uint32 `json:"project"`
+	Size    int64  `json:"size"`
+	Disk    int64  `json:"disk"`
+	// "compress" and "snapshot"
+	Flags     []string  `json:"flags"`
+	Links     int64     `json:"links"`
+	Atime     time.Time `json:"atime"`
+	Mtime     time.Time `json:"mtime"`
+	Ctime     time.Time `json:"ctime"`
+	Shared    int64     `json:"shared"`
+	Exclusive int64     `json:"exclusive"`
+	// the values are base64 in JSON
+	Xattrs map[string][]byte `json:"xattrs"`
+}
+
+// EntryInfo is a file listed by ls, the path is the one ls was given
+// joined with the name
+type EntryInfo struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	FileInfo
+}
+
+type FdInfo struct {
+	Fd Fkey `json:"fd"`
+}
+
+type DataInfo struct {
+	Fd     Fkey  `json:"fd"`
+	Length int64 `json:"length"`
+	// "text", "hex" or "base64", text that isn't UTF-8 is sent as base64
+	Encoding string `json:"encoding"`
+	Data     string `json:"data"`
+}
+
+type ErrorInfo struct {
+	Error string `json:"error"`
+	// like "ENOENT", missing when the error has no errno
+	Errno string `json:"errno,omitempty"`
+	Op    string `json:"op,omitempty"`
+	Path  string `json:"path,omitempty"`
+}
+
+func (s Stat) Info() FileInfo {
+	info := FileInfo{
+		Inode:     s.inode,
+		Type:      "regular",
+		Mode:      s.mode,
+		Uid:       s.uid,
+		Gid:       s.gid,
+		Project:   s.project,
+		Size:      s.size,
+		Disk:      s.disk,
+		Flags:     []string{},
+		Links:     s.links,
+		Atime:     s.atime,
+		Mtime:     s.mtime,
+		Ctime:     s.ctime,
+		Shared:    s.shared,
+		Exclusive: s.exclusive,
+		Xattrs:    s.xattrs,
+	}
+	if s.ftype == DIRECTORY {
+		info.Type = "directory"
+	}
+	if s.flags&FLAG_COMPRESS != 0 {
+		info.Flags = append(info.Flags, "compress")
+	}
+	if s.flags&FLAG_SNAPSHOT != 0 {
+		info.Flags = append(info.Flags, "snapshot")
+	}
+	if info.Xattrs == nil {
+		info.Xattrs = map[string][]byte{}
+	}
+	return info
+}
+
+func newDataInfo(fd Fkey, data []byte, mode dataMode) DataInfo {
+	if mode == TEXT_DATA && !utf8.Valid(data) {
+		mode = BASE64_DATA
+	}
+	return DataInfo{
+		Fd:       fd,
+		Length:   int64(len(data)),
+		Encoding: mode.String(),
+		Data:     mode.encode(data),
+	}
+}
+
+func errorInfo(err error) ErrorInfo {
+	info := ErrorInfo{Error: err.Error(), Errno: errnoName(err)}
+	var pathErr *PathError
+	var linkErr *LinkError
+	if errors.As(err, &pathErr) {
+		info.Op, info.Path = pathErr.Op, pathErr.Path
+	} else if errors.As(err, &linkErr) {
+		info.Op, info.Path = linkErr.Op, linkErr.Old
+	}
+	return info
+}
+
+func printJSON(w io.Writer, v interface{}) error {
+	return json.NewEncoder(w).Encode(v)
+}
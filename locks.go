@@ -0,0 +1,49 @@
+package main
+
+import "sync"
+
+// Locks is shared by every copy of the FileSystem value.
+//
+// The order in which they're taken is: snapshots, a directory before the
+// files in it, then the quota file and its inode, then orphans, then
+// dedupe, then the allocators and the superblock. Inode locks are
+// held by the public functions of the FileSystem; the lower level ones,
+// like Read, Write, Truncate, AddFile and RemoveFile, expect the caller to
+// hold the lock of every inode they change.
+type Locks struct {
+	inodeBitmap sync.Mutex
+	blockBitmap sync.Mutex
+	superblock  sync.Mutex
+	// open counters and the orphan list
+	orphans sync.Mutex
+	// open file descriptors of the session
+	fds sync.Mutex
+	// serializes the snapshot operations
+	snapshots sync.Mutex
+	// taken for writing to share a block with dedupe, and for reading to
+	// change a block in place
+	dedupe sync.RWMutex
+	// writes of the quota file
+	quotaFile sync.Mutex
+
+	table  sync.Mutex
+	inodes map[int64]*sync.RWMutex
+}
+
+func NewLocks() *Locks {
+	return &Locks{
+		inodes: make(map[int64]*sync.RWMutex),
+	}
+}
+
+// Inode returns the reader/writer lock of the inode
+func (l *Locks) Inode(id int64) *sync.RWMutex {
+	l.table.Lock()
+	defer l.table.Unlock()
+	lock, ok := l.inodes[id]
+	if !ok {
+		lock = &sync.RWMutex{}
+		l.inodes[id] = lock
+	}
+	return lock
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestFileSystem makes an image with 64 inodes in a temporary directory,
+// it's closed at the end of the test
+func newTestFileSystem(t *testing.T, opts MountOptions) *FileSystem {
+	t.Helper()
+	f, err := NewFileSystem(64, filepath.Join(t.TempDir(), "img"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+// usedInodes counts the inodes set in the bitmap on disk
+func usedInodes(t *testing.T, f *FileSystem) int64 {
+	t.Helper()
+	used, err := f.countBits(f.Superblock.InodeBitmapOffset, f.Superblock.InodeCount/8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return used
+}
+
+// inTime fails the test when run doesn't return in a few seconds, a
+// deadlock would hang it
+func inTime(t *testing.T, run func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		run()
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("deadlock")
+	}
+}
+
+// writeConcurrently has 8 goroutines write and read back their own file,
+// and create and unlink an open file next to it
+func writeConcurrently(t *testing.T, f *FileSystem, data func(g int) byte) {
+	t.Helper()
+	done := make(chan error)
+	for g := 0; g < 8; g++ {
+		go func(g int) {
+			done <- func() error {
+				name := string(rune('a' + g))
+				id, err := f.Create(f.Superblock.Root, name, REGULAR, 0644)
+				if err != nil {
+					return err
+				}
+				for i := 0; i < 50; i++ {
+					buf := bytes.Repeat([]byte{data(g)}, 700)
+					_, err := f.WriteFile(id, int64(i%20)*700, buf)
+					if err != nil {
+						return err
+					}
+					out := make([]byte, 700)
+					_, err = f.ReadFile(id, int64(i%20)*700, out)
+					if err != nil {
+						return err
+					}
+					if !bytes.Equal(out, buf) {
+						return fmt.Errorf("%s: read other data than written", name)
+					}
+					fd, err := f.Open(f.Superblock.Root, name+"x", O_RDWR|O_CREAT, 0644)
+					if err != nil {
+						return err
+					}
+					err = f.WriteCmd(fd, "hi")
+					if err == nil {
+						err = f.UnlinkCmd(f.Superblock.Root, name+"x")
+					}
+					if err == nil {
+						err = f.CloseCmd(fd)
+					}
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			}()
+		}(g)
+	}
+	for g := 0; g < 8; g++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := f.List(f.Superblock.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// "." and ".." and the 8 files
+	if len(entries) != 10 {
+		t.Fatalf("%v entries in the root", len(entries))
+	}
+	// the unlinked files are freed by their last close
+	if used := usedInodes(t, f); used != 9 {
+		t.Fatalf("%v inodes are used", used)
+	}
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	f := newTestFileSystem(t, MountOptions{})
+	writeConcurrently(t, f, func(g int) byte { return byte(g) })
+}
+
+func TestConcurrentWritesDedupe(t *testing.T) {
+	f := newTestFileSystem(t, MountOptions{Dedupe: true})
+	// the goroutines write the same blocks, so they get shared
+	writeConcurrently(t, f, func(g int) byte { return byte(g % 2) })
+	report, err := f.Fsck()
+	if err != nil || len(report.Problems) != 0 {
+		t.Fatal(err, report.Problems)
+	}
+}
+
+func TestLinkDirectory(t *testing.T) {
+	f := newTestFileSystem(t, MountOptions{})
+	root := f.Superblock.Root
+	err := f.MkdirCmd(root, "d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inTime(t, func() {
+		for _, link := range [][2]string{{".", "x"}, {"/", "/y"}, {"d", "d/z"}} {
+			err := f.LinkCmd(root, link[0], link[1])
+			if !errors.Is(err, ErrFileIsNotRegular) {
+				t.Errorf("link %s %s: %v", link[0], link[1], err)
+			}
+		}
+	})
+}
+
+func TestLinkParentWhileUnlinking(t *testing.T) {
+	f := newTestFileSystem(t, MountOptions{})
+	root := f.Superblock.Root
+	inTime(t, func() {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 200; i++ {
+				// fails, x is a directory and a parent of the new name
+				f.LinkCmd(root, "/x", "/x/child/n")
+			}
+		}()
+		for i := 0; i < 200; i++ {
+			f.MkdirCmd(root, "/x")
+			f.MkdirCmd(root, "/x/child")
+			f.UnlinkCmd(root, "/x/child")
+			f.UnlinkCmd(root, "/x")
+		}
+		<-done
+	})
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ls [-l] [-a] [-R] [-i] [-h] [-S|-t|--sort=name|size|time] [-r] [--json] [path...]
+// lists like coreutils: the file operands first, then the directories,
+// with a header when there's more than one group. With --json all the
+// entries are printed as one JSON array of EntryInfo.
+
+type lsOptions struct {
+	long      bool
+	all       bool
+	recursive bool
+	inode     bool
+	human     bool
+	reverse   bool
+	// name, size or time
+	sort string
+	// set by --json, the entries are collected here and printed at the end
+	found *[]EntryInfo
+}
+
+type lsEntry struct {
+	name string
+	stat Stat
+}
+
+func parseLsArgs(args []string) (lsOptions, []string, error) {
+	opts := lsOptions{sort: "name"}
+	paths := []string{}
+	for i, arg := range args {
+		if arg == "--" {
+			paths = append(paths, args[i+1:]...)
+			break
+		}
+		if arg == "--json" {
+			opts.found = &[]EntryInfo{}
+			continue
+		}
+		if strings.HasPrefix(arg, "--sort=") {
+			opts.sort = strings.TrimPrefix(arg, "--sort=")
+			if opts.sort != "name" && opts.sort != "size" && opts.sort != "time" {
+				return opts, nil, fmt.Errorf("invalid sort %q, need name, size or time", opts.sort)
+			}
+			continue
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			paths = append(paths, arg)
+			continue
+		}
+		for _, flag := range arg[1:] {
+			switch flag {
+			case 'l':
+				opts.long = true
+			case 'a':
+				opts.all = true
+			case 'R':
+				opts.recursive = true
+			case 'i':
+				opts.inode = true
+			case 'h':
+				opts.human = true
+			case 'r':
+				opts.reverse = true
+			case 'S':
+				opts.sort = "size"
+			case 't':
+				opts.sort = "time"
+			default:
+				return opts, nil, fmt.Errorf("invalid option -%c", flag)
+			}
+		}
+	}
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	return opts, paths, nil
+}
+
+func (opts lsOptions) sortEntries(entries []lsEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if opts.reverse {
+			a, b = b, a
+		}
+		// the biggest and the newest come first
+		switch {
+		case opts.sort == "size" && a.stat.size != b.stat.size:
+			return a.stat.size > b.stat.size
+		case opts.sort == "time" && !a.stat.mtime.Equal(b.stat.mtime):
+			return a.stat.mtime.After(b.stat.mtime)
+		}
+		return a.name < b.name
+	})
+}
+
+// formatMode shows the type and the permissions, with "+" when the file
+// has an ACL
+func formatMode(stat Stat) string {
+	ftype := "-"
+	if stat.ftype == DIRECTORY {
+		ftype = "d"
+	}
+	mode := ftype + permString(stat.mode>>6&7) + permString(stat.mode>>3&7) + permString(stat.mode&7)
+	if _, ok := stat.xattrs[XATTR_ACL_ACCESS]; ok {
+		mode += "+"
+	}
+	return mode
+}
+
+// formatTime shows the time of the last six months with the clock, older
+// ones with the year
+func formatTime(t time.Time) string {
+	if time.Since(t) > 183*24*time.Hour || t.After(time.Now().Add(time.Hour)) {
+		return t.Format("Jan _2  2006")
+	}
+	return t.Format("Jan _2 15:04")
+}
+
+func (opts lsOptions) formatSize(size int64) string {
+	if opts.human {
+		return formatSize(size)
+	}
+	return fmt.Sprint(size)
+}
+
+// print writes a group of entries of the directory, the columns of the
+// long format are aligned within the group
+func (opts lsOptions) print(w io.Writer, dir string, entries []lsEntry, total bool) {
+	if opts.found != nil {
+		for _, entry := range entries {
+			path := entry.name
+			if dir != "" {
+				path = strings.TrimSuffix(dir, "/") + "/" + entry.name
+			}
+			*opts.found = append(*opts.found, EntryInfo{Name: entry.name, Path: path, FileInfo: entry.stat.Info()})
+		}
+		return
+	}
+	if !opts.long {
+		for _, entry := range entries {
+			if opts.inode {
+				fmt.Fprintf(w, "%v ", entry.stat.inode)
+			}
+			fmt.Fprintln(w, entry.name)
+		}
+		return
+	}
+	var disk int64
+	rows := make([][]string, len(entries))
+	widths := make([]int, 6)
+	for i, entry := range entries {
+		stat := entry.stat
+		disk += stat.disk
+		rows[i] = []string{
+			fmt.Sprint(stat.inode),
+			formatMode(stat),
+			fmt.Sprint(stat.links),
+			fmt.Sprint(stat.uid),
+			fmt.Sprint(stat.gid),
+			opts.formatSize(stat.size),
+		}
+		for col, value := range rows[i] {
+			if len(value) > widths[col] {
+				widths[col] = len(value)
+			}
+		}
+	}
+	if total {
+		if opts.human {
+			fmt.Fprintf(w, "total %v\n", formatSize(disk))
+		} else {
+			fmt.Fprintf(w, "total %v\n", UpDivision(disk, 1024))
+		}
+	}
+	for i, entry := range entries {
+		row := rows[i]
+		if opts.inode {
+			fmt.Fprintf(w, "%*s ", widths[0], row[0])
+		}
+		fmt.Fprintf(w, "%-*s %*s %-*s %-*s %*s %s %s\n",
+			widths[1], row[1], widths[2], row[2], widths[3], row[3], widths[4], row[4],
+			widths[5], row[5], formatTime(entry.stat.mtime), entry.name)
+	}
+}
+
+// listDir writes the entries of the directory, and with -R the
+// directories under it
+func (f *FileSystem) listDir(w io.Writer, opts lsOptions, path string, dir int64, header bool) error {
+	if header && opts.found == nil {
+		fmt.Fprintf(w, "%s:\n", path)
+	}
+	list, err := f.List(dir)
+	if err != nil {
+		return fmt.Errorf("cannot open directory '%s': %w", path, err)
+	}
+	var errs []error
+	entries := []lsEntry{}
+	for _, entry := range list {
+		if strings.HasPrefix(entry.Name, ".") && !opts.all {
+			continue
+		}
+		stat, err := f.Stat(entry.Inode)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cannot access '%s': %w", entry.Name, err))
+			continue
+		}
+		entries = append(entries, lsEntry{name: entry.Name, stat: stat})
+	}
+	opts.sortEntries(entries)
+	opts.print(w, path, entries, true)
+	if !opts.recursive {
+		return errors.Join(errs...)
+	}
+	for _, entry := range entries {
+		if entry.stat.ftype != DIRECTORY || entry.name == "." || entry.name == ".." {
+			continue
+		}
+		if opts.found == nil {
+			fmt.Fprintln(w)
+		}
+		err = f.listDir(w, opts, strings.TrimSuffix(path, "/")+"/"+entry.name, entry.stat.inode, true)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// LsCmd writes the listing of the paths, the args are the options and the
+// paths of the ls command. The paths that can't be listed are reported
+// in the error, the others are listed anyway.
+func (f *FileSystem) LsCmd(pwd int64, args []string, w io.Writer) error {
+	opts, paths, err := parseLsArgs(args)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	files := []lsEntry{}
+	dirs := []lsEntry{}
+	for _, path := range paths {
+		id, err := f.LookupPath(pwd, path)
+		var stat Stat
+		if err == nil {
+			stat, err = f.Stat(id)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cannot access '%s': %w", path, err))
+			continue
+		}
+		if stat.ftype == DIRECTORY {
+			dirs = append(dirs, lsEntry{name: path, stat: stat})
+		} else {
+			files = append(files, lsEntry{name: path, stat: stat})
+		}
+	}
+	opts.sortEntries(files)
+	opts.sortEntries(dirs)
+	opts.print(w, "", files, false)
+	header := len(paths) > 1 || opts.recursive
+	for i, dir := range dirs {
+		if (i > 0 || len(files) > 0) && opts.found == nil {
+			fmt.Fprintln(w)
+		}
+		err = f.listDir(w, opts, dir.name, dir.stat.inode, header)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if opts.found != nil {
+		err = printJSON(w, *opts.found)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
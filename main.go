@@ -1,101 +1,356 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
 	"io"
 	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/xts"
 )
 
 const (
-	SUPERBLOCK_SIZE = 64
-	INODE_SIZE      = 1 + 2*8 + 8*DIRECT_LINKS + 8
+	SUPERBLOCK_SIZE = 256
+	INODE_SIZE      = 1 + 2 + 2 + 3*4 + 5*8 + 8*DIRECT_LINKS + 8 + 8 + 8 + XATTR_INLINE_SIZE
 	BLOCK_SIZE      = 1024
 	FREE            = 0
 	USED            = 1
+	// the superblock starts with the magic and the version of the layout,
+	// the version changes with the layout of the superblock or the inodes
+	SUPERBLOCK_MAGIC = 0x474f4653
+	FORMAT_VERSION   = 1
 )
 
+var ErrReadOnly error = newError("read-only file system", syscall.EROFS)
+var ErrNotImage error = newError("not an image of this file system", syscall.EINVAL)
+var ErrImageVersion error = newError("image has another format version", syscall.EINVAL)
+
 type FileSystem struct {
-	File       *os.File
+	Device     Device
 	Superblock Superblock
 	Session    Session
+	Options    MountOptions
+	locks      *Locks
+	flusher    *flusher
+	// encrypts the data, nil if the image isn't encrypted
+	cipher *xts.Cipher
+	// digests of the data blocks, for Dedupe
+	index *dedupeIndex
+	// limits and usage of the users and the projects
+	quotas *quotaTable
+	blocks *Cache[Block, []byte]
+	inodes *Cache[int64, Inode]
+	// free blocks and inodes, guarded by the locks of the bitmaps
+	freeBlocks int64
+	freeInodes int64
+	// number of open descriptors for every inode
+	openCount map[int64]int64
+	// inodes that are in the orphan list
+	orphans map[int64]bool
+	// blocks freed since the last Sync, they are punched once no inode on
+	// disk points to them. Guarded by the lock of the block bitmap.
+	discards map[Block]bool
 }
 
 type Superblock struct {
 	Size              int64
 	InodeBitmapOffset int64
 	BlockBitmapOffset int64
+	BlockRefsOffset   int64
 	InodesOffset      int64
 	BlocksOffset      int64
 	InodeCount        int64
 	BlockCount        int64
 	Root              int64
+	OrphanHead        int64
+	// directory of the snapshots, NO_INODE until the first one is taken
+	Snapshots int64
+	// the master key encrypted with the passphrase, see crypt.go
+	Encrypted  bool
+	KeySalt    [KEY_SALT_SIZE]byte
+	WrappedKey [WRAPPED_KEY_SIZE]byte
+	// file with the quota limits, NO_INODE until the first one is set
+	QuotaInode int64
+}
+
+type MountOptions struct {
+	// number of blocks and inodes kept in memory, defaults are used for 0
+	BlockCache int
+	InodeCache int
+	// write everything to disk at the end of every update
+	Sync bool
+	// write the cache back periodically, 0 turns it off
+	FlushInterval time.Duration
+	// encrypts a new image or unlocks an encrypted one, it's dropped
+	// once the key is known
+	Passphrase string
+	// share the written blocks with blocks of the same content
+	Dedupe bool
+	// the image is opened read-only and every change fails with EROFS, the
+	// orphans are left for the next read-write mount
+	ReadOnly bool
 }
 
 type Fd struct {
+	// guards the location
+	mu       sync.Mutex
 	inode    int64
 	location int64
+	flags    int
 }
 
-type Fkey string
+type Fkey int
 
 type Session struct {
-	pwd     int64
-	fds     map[Fkey]*Fd
-	counter int64
+	pwd int64
+	fds map[Fkey]*Fd
+	// credentials used for the permission checks
+	uid    uint32
+	gid    uint32
+	groups []uint32
+}
+
+func newFileSystem(dev Device, opts MountOptions) *FileSystem {
+	if opts.BlockCache == 0 {
+		opts.BlockCache = DEFAULT_BLOCK_CACHE
+	}
+	if opts.InodeCache == 0 {
+		opts.InodeCache = DEFAULT_INODE_CACHE
+	}
+	opts.Passphrase = ""
+	fileS := &FileSystem{
+		Device:    dev,
+		Options:   opts,
+		locks:     NewLocks(),
+		openCount: make(map[int64]int64),
+		orphans:   make(map[int64]bool),
+		discards:  make(map[Block]bool),
+		index:     newDedupeIndex(),
+		quotas:    newQuotaTable(),
+	}
+	fileS.blocks = NewCache(opts.BlockCache, fileS.writeBlockToDisk)
+	fileS.inodes = NewCache(opts.InodeCache, fileS.writeInodeToDisk)
+	fileS.Session.fds = make(map[Fkey]*Fd)
+	return fileS
 }
 
-func NewFileSystem(count int64, path string) (FileSystem, error) {
+// layout places the parts of an image with count inodes, the count is
+// rounded up to fill the bytes of the bitmap
+func layout(count int64) Superblock {
 	count = UpDivision(count, 8) * 8
 	var inode_count int64 = count
 	var block_count int64 = 10 + 10*count
 	bitmap_size := inode_count/8 + block_count/8
-	system_size := SUPERBLOCK_SIZE + inode_count*INODE_SIZE + block_count*BLOCK_SIZE + bitmap_size
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
-	if err != nil {
-		return FileSystem{}, err
-	}
-	err = f.Truncate(system_size)
-	if err != nil {
-		return FileSystem{}, err
-	}
+	refs_size := block_count * BLOCK_REF_SIZE
+	system_size := SUPERBLOCK_SIZE + inode_count*INODE_SIZE + block_count*BLOCK_SIZE + bitmap_size + refs_size
 	var inode_bitmap int64 = SUPERBLOCK_SIZE
 	var block_bitmap int64 = inode_bitmap + inode_count/8
-	var inode int64 = block_bitmap + block_count/8
+	var block_refs int64 = block_bitmap + block_count/8
+	var inode int64 = block_refs + refs_size
 	var block int64 = inode + inode_count*INODE_SIZE
-	superblock := Superblock{
+	return Superblock{
 		Size:              system_size,
 		InodeBitmapOffset: inode_bitmap,
 		BlockBitmapOffset: block_bitmap,
+		BlockRefsOffset:   block_refs,
 		InodesOffset:      inode,
 		BlocksOffset:      block,
 		InodeCount:        inode_count,
 		BlockCount:        block_count,
 		Root:              0,
+		OrphanHead:        NO_ORPHAN,
+		Snapshots:         NO_INODE,
+		QuotaInode:        NO_INODE,
+	}
+}
+
+// ImageSize is the size of the device an image with count inodes needs
+func ImageSize(count int64) int64 {
+	return layout(count).Size
+}
+
+// NewFileSystem creates an image with count inodes in the host file
+func NewFileSystem(count int64, path string, opts MountOptions) (*FileSystem, error) {
+	if opts.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = f.Truncate(ImageSize(count))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	fileS, err := Format(&FileDevice{f}, count, opts)
+	if err != nil {
+		f.Close()
+		return nil, err
 	}
-	fileS := FileSystem{
-		File:       f,
-		Superblock: superblock,
+	return fileS, nil
+}
+
+// Format creates an image with count inodes on the device, what was on it
+// is lost. The file system owns the device and closes it in Close, a
+// failed Format leaves it open. A read-only or too small device is
+// rejected before anything is written.
+func Format(dev Device, count int64, opts MountOptions) (*FileSystem, error) {
+	if ro, ok := dev.(readOnlyDevice); opts.ReadOnly || (ok && ro.ReadOnly()) {
+		return nil, ErrReadOnly
 	}
-	root, err := fileS.AllocateDirectory()
+	superblock := layout(count)
+	size, err := dev.Size()
 	if err != nil {
-		return FileSystem{}, err
+		return nil, err
+	}
+	if size < superblock.Size {
+		return nil, ErrDeviceTooSmall
+	}
+	// the bitmaps and the reference counts of a used device are cleared,
+	// the inodes and the blocks are written when they are allocated. They
+	// are discarded so a new host file stays sparse, zeros are written on
+	// the devices that can't.
+	offset, length := superblock.InodeBitmapOffset, superblock.InodesOffset-superblock.InodeBitmapOffset
+	d, ok := dev.(discarder)
+	if !ok || d.Discard(offset, length) != nil {
+		_, err = dev.WriteAt(make([]byte, length), offset)
+		if err != nil {
+			return nil, err
+		}
+	}
+	fileS := newFileSystem(dev, opts)
+	fileS.Superblock = superblock
+	fileS.freeBlocks = fileS.usableBlocks()
+	fileS.freeInodes = superblock.InodeCount
+	if opts.Passphrase != "" {
+		err = fileS.setupEncryption(opts.Passphrase)
+		if err != nil {
+			return nil, err
+		}
+	}
+	root, err := fileS.AllocateDirectory(Inode{mode: DEFAULT_DIR_MODE})
+	if err != nil {
+		return nil, err
 	}
 	err = fileS.AddFile(&root, ".", &root)
 	if err != nil {
-		return FileSystem{}, err
+		return nil, err
 	}
 	err = fileS.AddFile(&root, "..", &root)
 	if err != nil {
-		return FileSystem{}, err
+		return nil, err
 	}
 	fileS.Superblock.Root = root.id
 	fileS.Session.pwd = root.id
-	fileS.Session.fds = make(map[Fkey]*Fd)
+	err = fileS.FlushCache()
+	if err != nil {
+		return nil, err
+	}
+	err = fileS.WriteSuperblock()
+	if err != nil {
+		return nil, err
+	}
+	fileS.startFlusher()
+	return fileS, nil
+}
+
+// OpenFileSystem mounts the image in the host file
+func OpenFileSystem(path string, opts MountOptions) (*FileSystem, error) {
+	mode := os.O_RDWR
+	if opts.ReadOnly {
+		mode = os.O_RDONLY
+	}
+	f, err := os.OpenFile(path, mode, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return Mount(&FileDevice{f}, opts)
+}
+
+// Mount mounts the image on the device, a device that can't be written is
+// mounted read-only. Files that were unlinked while still open are
+// released here, in case the image wasn't closed cleanly. The device is
+// closed when the mount fails.
+func Mount(dev Device, opts MountOptions) (*FileSystem, error) {
+	if ro, ok := dev.(readOnlyDevice); ok && ro.ReadOnly() {
+		opts.ReadOnly = true
+	}
+	fileS, err := mount(dev, opts)
+	if err != nil {
+		dev.Close()
+		return nil, err
+	}
 	return fileS, nil
 }
 
-func (s *Superblock) Write(file *os.File) error {
-	err := binary.Write(file, binary.BigEndian, s.Size)
+func mount(dev Device, opts MountOptions) (*FileSystem, error) {
+	fileS := newFileSystem(dev, opts)
+	err := fileS.Superblock.Read(io.NewSectionReader(dev, 0, SUPERBLOCK_SIZE))
+	if err != nil {
+		return nil, err
+	}
+	size, err := dev.Size()
+	if err != nil {
+		return nil, err
+	}
+	if size < fileS.Superblock.Size {
+		return nil, ErrDeviceTooSmall
+	}
+	err = fileS.unlock(opts.Passphrase)
+	if err != nil {
+		return nil, err
+	}
+	err = fileS.countFree()
+	if err != nil {
+		return nil, err
+	}
+	fileS.Session.pwd = fileS.Superblock.Root
+	// the orphans are charged until they are deallocated
+	err = fileS.loadQuotas()
+	if err != nil {
+		return nil, err
+	}
+	if !opts.ReadOnly {
+		err = fileS.CleanOrphans()
+		if err != nil {
+			return nil, err
+		}
+	}
+	// the blocks written before are found by the inline deduplication too
+	if opts.Dedupe && !opts.ReadOnly {
+		_, err = fileS.walkDataBlocks(false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !opts.ReadOnly {
+		fileS.startFlusher()
+	}
+	return fileS, nil
+}
+
+// writable fails with ErrReadOnly on a read-only mount
+func (f *FileSystem) writable() error {
+	if f.Options.ReadOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+func (s *Superblock) Write(file io.Writer) error {
+	err := binary.Write(file, binary.BigEndian, uint32(SUPERBLOCK_MAGIC))
+	if err != nil {
+		return err
+	}
+	err = binary.Write(file, binary.BigEndian, uint32(FORMAT_VERSION))
+	if err != nil {
+		return err
+	}
+	err = binary.Write(file, binary.BigEndian, s.Size)
 	if err != nil {
 		return err
 	}
@@ -107,6 +362,10 @@ func (s *Superblock) Write(file *os.File) error {
 	if err != nil {
 		return err
 	}
+	err = binary.Write(file, binary.BigEndian, s.BlockRefsOffset)
+	if err != nil {
+		return err
+	}
 	err = binary.Write(file, binary.BigEndian, s.InodesOffset)
 	if err != nil {
 		return err
@@ -127,20 +386,87 @@ func (s *Superblock) Write(file *os.File) error {
 	if err != nil {
 		return err
 	}
+	err = binary.Write(file, binary.BigEndian, s.OrphanHead)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(file, binary.BigEndian, s.Snapshots)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(file, binary.BigEndian, s.Encrypted)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(file, binary.BigEndian, s.KeySalt)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(file, binary.BigEndian, s.WrappedKey)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(file, binary.BigEndian, s.QuotaInode)
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
+func (f *FileSystem) WriteSuperblock() error {
+	if err := f.writable(); err != nil {
+		return err
+	}
+	f.locks.superblock.Lock()
+	defer f.locks.superblock.Unlock()
+	var buffer bytes.Buffer
+	err := f.Superblock.Write(&buffer)
+	if err != nil {
+		return err
+	}
+	_, err = f.Device.WriteAt(buffer.Bytes(), 0)
+	return err
+}
+
+// release closes the device without writing to it, for an image that
+// was synced after its flusher was stopped
+func (f *FileSystem) release() error {
+	return f.Device.Close()
+}
+
 func (f *FileSystem) Close() error {
-	f.File.Seek(0, io.SeekStart)
-	err := f.Superblock.Write(f.File)
+	f.stopFlusher()
+	// nothing has changed on a read-only mount
+	if f.Options.ReadOnly {
+		return f.Device.Close()
+	}
+	err := f.Sync()
 	if err != nil {
+		f.Device.Close()
 		return err
 	}
-	return f.File.Close()
+	return f.Device.Close()
 }
 
-func (s *Superblock) Read(file *os.File) error {
-	err := binary.Read(file, binary.BigEndian, &s.Size)
+// Read fails with ErrNotImage when the magic is missing, and with
+// ErrImageVersion for another layout
+func (s *Superblock) Read(file io.Reader) error {
+	var magic, version uint32
+	err := binary.Read(file, binary.BigEndian, &magic)
+	if err == io.EOF || err == io.ErrUnexpectedEOF || (err == nil && magic != SUPERBLOCK_MAGIC) {
+		return ErrNotImage
+	}
+	if err != nil {
+		return err
+	}
+	err = binary.Read(file, binary.BigEndian, &version)
+	if err != nil {
+		return err
+	}
+	if version != FORMAT_VERSION {
+		return ErrImageVersion
+	}
+	err = binary.Read(file, binary.BigEndian, &s.Size)
 	if err != nil {
 		return err
 	}
@@ -152,6 +478,10 @@ func (s *Superblock) Read(file *os.File) error {
 	if err != nil {
 		return err
 	}
+	err = binary.Read(file, binary.BigEndian, &s.BlockRefsOffset)
+	if err != nil {
+		return err
+	}
 	err = binary.Read(file, binary.BigEndian, &s.InodesOffset)
 	if err != nil {
 		return err
@@ -172,16 +502,33 @@ func (s *Superblock) Read(file *os.File) error {
 	if err != nil {
 		return err
 	}
+	err = binary.Read(file, binary.BigEndian, &s.OrphanHead)
+	if err != nil {
+		return err
+	}
+	err = binary.Read(file, binary.BigEndian, &s.Snapshots)
+	if err != nil {
+		return err
+	}
+	err = binary.Read(file, binary.BigEndian, &s.Encrypted)
+	if err != nil {
+		return err
+	}
+	err = binary.Read(file, binary.BigEndian, &s.KeySalt)
+	if err != nil {
+		return err
+	}
+	err = binary.Read(file, binary.BigEndian, &s.WrappedKey)
+	if err != nil {
+		return err
+	}
+	err = binary.Read(file, binary.BigEndian, &s.QuotaInode)
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
 func main() {
-	f, err := NewFileSystem(128, "fs")
-	if err != nil {
-		panic(err)
-	}
-
-	repl := NewRepl(&f)
-	repl.Start()
-	f.Close()
+	os.Exit(runCli(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
 }
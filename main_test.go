@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"syscall"
+	"testing"
+)
+
+func TestMountChecksMagicAndVersion(t *testing.T) {
+	for _, dev := range []*MemoryDevice{NewMemoryDevice(11), NewMemoryDevice(ImageSize(64))} {
+		if _, err := Mount(dev, MountOptions{}); !errors.Is(err, ErrNotImage) || !errors.Is(err, syscall.EINVAL) {
+			t.Fatalf("mount of %d bytes without a superblock: %v", len(dev.Bytes()), err)
+		}
+	}
+	dev := NewMemoryDevice(ImageSize(64))
+	f, err := Format(dev, 64, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	version := make([]byte, 4)
+	binary.BigEndian.PutUint32(version, FORMAT_VERSION+1)
+	if _, err := dev.WriteAt(version, 4); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Mount(dev, MountOptions{}); !errors.Is(err, ErrImageVersion) {
+		t.Fatalf("mount of another version: %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import "syscall"
+
+// marks the end of the orphan list
+const NO_ORPHAN int64 = -1
+
+var ErrBadOrphanList error = newError("orphan list is damaged", syscall.EIO)
+
+// Orphans are inodes without links that are still open. They're kept in a
+// list on disk, starting at Superblock.OrphanHead, so they can be released
+// on the next mount if the system goes down before the last close.
+//
+// Every function here expects the caller to hold f.locks.orphans.
+
+func (f *FileSystem) setOrphanHead(id int64) error {
+	f.locks.superblock.Lock()
+	f.Superblock.OrphanHead = id
+	f.locks.superblock.Unlock()
+	return f.WriteSuperblock()
+}
+
+// AddOrphan pushes the file to the head of the list, the caller holds the
+// lock of the file
+func (f *FileSystem) AddOrphan(file *Inode) error {
+	file.nextOrphan = f.Superblock.OrphanHead
+	err := f.WriteInode(file)
+	if err != nil {
+		return err
+	}
+	// the list has to be on disk before the superblock points to it
+	err = f.inodes.FlushKey(file.id)
+	if err != nil {
+		return err
+	}
+	f.orphans[file.id] = true
+	return f.setOrphanHead(file.id)
+}
+
+// RemoveOrphan takes the file out of the list, the caller holds the lock of
+// the file
+func (f *FileSystem) RemoveOrphan(file *Inode) error {
+	if f.Superblock.OrphanHead == file.id {
+		err := f.setOrphanHead(file.nextOrphan)
+		if err != nil {
+			return err
+		}
+	} else {
+		// find the previous inode and unchain the file
+		id := f.Superblock.OrphanHead
+		for id != NO_ORPHAN {
+			lock := f.locks.Inode(id)
+			lock.Lock()
+			prev, err := f.ReadInode(id)
+			if err != nil {
+				lock.Unlock()
+				return err
+			}
+			if prev.nextOrphan == file.id {
+				prev.nextOrphan = file.nextOrphan
+				err = f.WriteInode(&prev)
+				if err == nil {
+					err = f.inodes.FlushKey(prev.id)
+				}
+				lock.Unlock()
+				if err != nil {
+					return err
+				}
+				break
+			}
+			lock.Unlock()
+			id = prev.nextOrphan
+		}
+	}
+	delete(f.orphans, file.id)
+	file.nextOrphan = NO_ORPHAN
+	return f.WriteInode(file)
+}
+
+// ReleaseOrphan deallocates the orphan once nothing refers to it anymore
+func (f *FileSystem) ReleaseOrphan(id int64) error {
+	if !f.orphans[id] || f.openCount[id] > 0 {
+		return nil
+	}
+	lock := f.locks.Inode(id)
+	lock.Lock()
+	defer lock.Unlock()
+	file, err := f.ReadInode(id)
+	if err != nil {
+		return err
+	}
+	err = f.RemoveOrphan(&file)
+	if err != nil {
+		return err
+	}
+	return f.DeallocateInode(&file)
+}
+
+// orphanList returns the inodes of the list. A list that loops or points
+// out of the inode table fails with ErrBadOrphanList.
+func (f *FileSystem) orphanList() ([]int64, error) {
+	ids := []int64{}
+	seen := map[int64]bool{}
+	for id := f.Superblock.OrphanHead; id != NO_ORPHAN; {
+		if id < 0 || id >= f.Superblock.InodeCount || seen[id] {
+			return nil, ErrBadOrphanList
+		}
+		seen[id] = true
+		file, err := f.ReadInode(id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+		id = file.nextOrphan
+	}
+	return ids, nil
+}
+
+// CleanOrphans deallocates every orphan left from the previous mount
+func (f *FileSystem) CleanOrphans() error {
+	f.locks.orphans.Lock()
+	defer f.locks.orphans.Unlock()
+	ids, err := f.orphanList()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		file, err := f.ReadInode(id)
+		if err != nil {
+			return err
+		}
+		file.nextOrphan = NO_ORPHAN
+		err = f.DeallocateInode(&file)
+		if err != nil {
+			return err
+		}
+	}
+	f.Superblock.OrphanHead = NO_ORPHAN
+	return f.WriteSuperblock()
+}
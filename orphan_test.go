@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestOrphanReadableUntilClosed(t *testing.T) {
+	f, err := NewFileSystem(64, filepath.Join(t.TempDir(), "img"), MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	root := f.Superblock.Root
+	fd, err := f.Open(root, "a", O_RDWR|O_CREAT, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.WriteCmd(fd, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	id, err := f.Lookup(root, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.UnlinkCmd(root, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if f.Superblock.OrphanHead != id {
+		t.Fatalf("orphan list starts at %d, not at %d", f.Superblock.OrphanHead, id)
+	}
+	if err := f.SeekCmd(fd, 0); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := f.ReadCmd(fd, 5); data != "hello" {
+		t.Fatalf("read %q from the orphan: %v", data, err)
+	}
+	// the inode isn't reused while the file is open
+	if err := f.CreateCmd(root, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := f.Lookup(root, "b"); b == id {
+		t.Fatal("the inode of the orphan was reused")
+	}
+	if err := f.CloseCmd(fd); err != nil {
+		t.Fatal(err)
+	}
+	if f.Superblock.OrphanHead != NO_ORPHAN {
+		t.Fatal("the orphan is left after the last close")
+	}
+	if free, err := f.FindFreeInode(); err != nil || free != id {
+		t.Fatalf("the first free inode is %d, not %d: %v", free, id, err)
+	}
+}
+
+func TestOrphanCleanedAfterCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "img")
+	f, err := NewFileSystem(64, path, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := f.Superblock.Root
+	fd, err := f.Open(root, "a", O_RDWR|O_CREAT, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.WriteCmd(fd, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	id, err := f.Lookup(root, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.UnlinkCmd(root, "a"); err != nil {
+		t.Fatal(err)
+	}
+	// crash without closing the file
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	f.Device.Close()
+	f, err = OpenFileSystem(path, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if f.Superblock.OrphanHead != NO_ORPHAN {
+		t.Fatal("the orphan is left after the mount")
+	}
+	if free, err := f.FindFreeInode(); err != nil || free != id {
+		t.Fatalf("the first free inode is %d, not %d: %v", free, id, err)
+	}
+	checkClean(t, f)
+}
+
+// loopedOrphanImage returns the path of an image whose orphan list points
+// back to its own head
+func loopedOrphanImage(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "img")
+	f, err := NewFileSystem(64, path, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := f.Superblock.Root
+	if _, err := f.Open(root, "a", O_RDWR|O_CREAT, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.UnlinkCmd(root, "a"); err != nil {
+		t.Fatal(err)
+	}
+	orphan, err := f.ReadInode(f.Superblock.OrphanHead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphan.nextOrphan = orphan.id
+	if err := f.WriteInode(&orphan); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	f.release()
+	return path
+}
+
+func TestOrphanLoopFailsMount(t *testing.T) {
+	path := loopedOrphanImage(t)
+	inTime(t, func() {
+		_, err := OpenFileSystem(path, MountOptions{})
+		if !errors.Is(err, ErrBadOrphanList) || !errors.Is(err, syscall.EIO) {
+			t.Errorf("mount with a looping orphan list: %v", err)
+		}
+	})
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"syscall"
+)
+
+var ErrInvalidPath error = newError("invalid path", syscall.EINVAL)
+
+func splitPath(path string) []string {
+	parts := []string{}
+	for _, part := range strings.Split(path, "/") {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+// LookupPath finds the inode of the path. Relative paths start at dir,
+// absolute ones at the root directory.
+func (f *FileSystem) LookupPath(dir int64, path string) (int64, error) {
+	if strings.HasPrefix(path, "/") {
+		dir = f.Superblock.Root
+	}
+	for _, name := range splitPath(path) {
+		var err error
+		dir, err = f.Lookup(dir, name)
+		if err != nil {
+			return -1, err
+		}
+	}
+	return dir, nil
+}
+
+// ResolveParent returns the directory holding the last element of the path
+// and the name of that element.
+func (f *FileSystem) ResolveParent(dir int64, path string) (int64, string, error) {
+	parts := splitPath(path)
+	if len(parts) == 0 {
+		return -1, "", ErrInvalidPath
+	}
+	parent := strings.Join(parts[:len(parts)-1], "/")
+	if strings.HasPrefix(path, "/") {
+		parent = "/" + parent
+	}
+	dir, err := f.LookupPath(dir, parent)
+	if err != nil {
+		return -1, "", err
+	}
+	return dir, parts[len(parts)-1], nil
+}
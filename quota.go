@@ -0,0 +1,624 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Quotas limit the blocks and the inodes charged to a user, the owner of
+// the files, and to a project, a directory tree. The files are in the
+// project of the directory they're created in, project 0 means none.
+//
+// A file is charged for every block it points to, so clones are charged in
+// full and the blocks shared by dedupe aren't refunded. Snapshots and the
+// inodes of the file system itself aren't charged.
+//
+// Going over the soft limit starts the grace period, the allocations fail
+// when it's over or when they'd go over the hard limit. Root isn't limited.
+// The limits and the start of the grace periods are kept in the quota file,
+// the usage is counted on mount.
+
+type QuotaType byte
+
+const (
+	USER_QUOTA    QuotaType = 0
+	PROJECT_QUOTA QuotaType = 1
+)
+
+const DEFAULT_QUOTA_GRACE = 7 * 24 * time.Hour
+
+var ErrQuotaExceeded error = newError("disk quota exceeded", syscall.EDQUOT)
+var ErrInvalidQuota error = newError("invalid quota limits", syscall.EINVAL)
+
+func (t QuotaType) String() string {
+	if t == PROJECT_QUOTA {
+		return "project"
+	}
+	return "user"
+}
+
+type QuotaKey struct {
+	Type QuotaType
+	Id   uint32
+}
+
+// QuotaLimits are in blocks and inodes, 0 is no limit
+type QuotaLimits struct {
+	SoftBlocks int64
+	HardBlocks int64
+	SoftInodes int64
+	HardInodes int64
+}
+
+// QuotaReport is the usage of a user or a project. The grace fields are
+// the ends of the grace periods, zero when the usage is under the soft
+// limit.
+type QuotaReport struct {
+	QuotaKey
+	QuotaLimits
+	Blocks     int64
+	Inodes     int64
+	BlockGrace time.Time
+	InodeGrace time.Time
+}
+
+// QuotaError tells whose quota was exceeded, it matches ErrQuotaExceeded
+type QuotaError struct {
+	Key      QuotaKey
+	Resource string
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%v: %v of %v %v", ErrQuotaExceeded, e.Resource, e.Key.Type, e.Key.Id)
+}
+
+func (e *QuotaError) Unwrap() error {
+	return ErrQuotaExceeded
+}
+
+// quotaUsage is the usage of blocks or inodes, since is when the soft limit
+// was passed
+type quotaUsage struct {
+	used  int64
+	soft  int64
+	hard  int64
+	since time.Time
+}
+
+// exceeds tells whether adding n goes over the limits
+func (u *quotaUsage) exceeds(n int64, grace time.Duration, now time.Time) bool {
+	used := u.used + n
+	if u.hard != 0 && used > u.hard {
+		return true
+	}
+	return u.soft != 0 && used > u.soft && !u.since.IsZero() && now.Sub(u.since) > grace
+}
+
+// update starts or stops the grace period, it returns true when it does
+func (u *quotaUsage) update(now time.Time) bool {
+	over := u.soft != 0 && u.used > u.soft
+	if over && u.since.IsZero() {
+		u.since = now
+		return true
+	}
+	if !over && !u.since.IsZero() {
+		u.since = time.Time{}
+		return true
+	}
+	return false
+}
+
+type quotaEntry struct {
+	blocks quotaUsage
+	inodes quotaUsage
+}
+
+type quotaTable struct {
+	mu         sync.Mutex
+	blockGrace time.Duration
+	inodeGrace time.Duration
+	entries    map[QuotaKey]*quotaEntry
+	// the table is saved when version is past saved
+	version int64
+	saved   int64
+}
+
+func newQuotaTable() *quotaTable {
+	return &quotaTable{
+		blockGrace: DEFAULT_QUOTA_GRACE,
+		inodeGrace: DEFAULT_QUOTA_GRACE,
+		entries:    make(map[QuotaKey]*quotaEntry),
+	}
+}
+
+// entry expects the caller to hold the lock
+func (t *quotaTable) entry(key QuotaKey) *quotaEntry {
+	e, ok := t.entries[key]
+	if !ok {
+		e = &quotaEntry{}
+		t.entries[key] = e
+	}
+	return e
+}
+
+// charge adds the blocks and the inodes to every key, with enforce it fails
+// without changing anything when one of them would go over its limits
+func (t *quotaTable) charge(keys []QuotaKey, blocks, inodes int64, enforce bool, now time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if enforce {
+		for _, key := range keys {
+			e, ok := t.entries[key]
+			if !ok {
+				continue
+			}
+			if blocks > 0 && e.blocks.exceeds(blocks, t.blockGrace, now) {
+				return &QuotaError{Key: key, Resource: "blocks"}
+			}
+			if inodes > 0 && e.inodes.exceeds(inodes, t.inodeGrace, now) {
+				return &QuotaError{Key: key, Resource: "inodes"}
+			}
+		}
+	}
+	for _, key := range keys {
+		e := t.entry(key)
+		e.blocks.used += blocks
+		e.inodes.used += inodes
+		changed := e.blocks.update(now)
+		changed = e.inodes.update(now) || changed
+		if changed {
+			t.version++
+		}
+	}
+	return nil
+}
+
+func (t *quotaTable) setLimits(key QuotaKey, limits QuotaLimits, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e := t.entry(key)
+	e.blocks.soft = limits.SoftBlocks
+	e.blocks.hard = limits.HardBlocks
+	e.inodes.soft = limits.SoftInodes
+	e.inodes.hard = limits.HardInodes
+	e.blocks.update(now)
+	e.inodes.update(now)
+	t.version++
+}
+
+func (t *quotaTable) setGrace(blocks, inodes time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.blockGrace = blocks
+	t.inodeGrace = inodes
+	t.version++
+}
+
+// headroom returns how many blocks and inodes can still be charged to the
+// key before the hard limits, -1 when there's no limit
+func (t *quotaTable) headroom(key QuotaKey) (int64, int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.entries[key]
+	if !ok {
+		return -1, -1
+	}
+	return e.blocks.headroom(), e.inodes.headroom()
+}
+
+func (u *quotaUsage) headroom() int64 {
+	if u.hard == 0 {
+		return -1
+	}
+	if u.used >= u.hard {
+		return 0
+	}
+	return u.hard - u.used
+}
+
+func (t *quotaTable) report() []QuotaReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	reports := []QuotaReport{}
+	for key, e := range t.entries {
+		if e.blocks.used == 0 && e.inodes.used == 0 && e.limits() == (QuotaLimits{}) {
+			continue
+		}
+		report := QuotaReport{
+			QuotaKey:    key,
+			QuotaLimits: e.limits(),
+			Blocks:      e.blocks.used,
+			Inodes:      e.inodes.used,
+		}
+		if !e.blocks.since.IsZero() {
+			report.BlockGrace = e.blocks.since.Add(t.blockGrace)
+		}
+		if !e.inodes.since.IsZero() {
+			report.InodeGrace = e.inodes.since.Add(t.inodeGrace)
+		}
+		reports = append(reports, report)
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		if reports[i].Type != reports[j].Type {
+			return reports[i].Type < reports[j].Type
+		}
+		return reports[i].Id < reports[j].Id
+	})
+	return reports
+}
+
+func (e *quotaEntry) limits() QuotaLimits {
+	return QuotaLimits{
+		SoftBlocks: e.blocks.soft,
+		HardBlocks: e.blocks.hard,
+		SoftInodes: e.inodes.soft,
+		HardInodes: e.inodes.hard,
+	}
+}
+
+// unixTime stores the zero time as 0
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func fromUnixTime(seconds int64) time.Time {
+	if seconds == 0 {
+		return time.Time{}
+	}
+	return time.Unix(seconds, 0)
+}
+
+// encode returns the content of the quota file and its version. The file
+// has the grace periods in seconds, followed by the limits and the starts
+// of the grace periods of every entry.
+func (t *quotaTable) encode() ([]byte, int64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var buffer bytes.Buffer
+	header := []int64{int64(t.blockGrace / time.Second), int64(t.inodeGrace / time.Second)}
+	err := binary.Write(&buffer, binary.BigEndian, header)
+	if err != nil {
+		return nil, 0, err
+	}
+	for key, e := range t.entries {
+		if e.limits() == (QuotaLimits{}) && e.blocks.since.IsZero() && e.inodes.since.IsZero() {
+			continue
+		}
+		err = binary.Write(&buffer, binary.BigEndian, key.Type)
+		if err != nil {
+			return nil, 0, err
+		}
+		err = binary.Write(&buffer, binary.BigEndian, key.Id)
+		if err != nil {
+			return nil, 0, err
+		}
+		err = binary.Write(&buffer, binary.BigEndian, e.limits())
+		if err != nil {
+			return nil, 0, err
+		}
+		since := []int64{unixTime(e.blocks.since), unixTime(e.inodes.since)}
+		err = binary.Write(&buffer, binary.BigEndian, since)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	return buffer.Bytes(), t.version, nil
+}
+
+func (t *quotaTable) decode(data []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	reader := bytes.NewReader(data)
+	header := make([]int64, 2)
+	err := binary.Read(reader, binary.BigEndian, header)
+	if err != nil {
+		return err
+	}
+	t.blockGrace = time.Duration(header[0]) * time.Second
+	t.inodeGrace = time.Duration(header[1]) * time.Second
+	for reader.Len() != 0 {
+		var key QuotaKey
+		var limits QuotaLimits
+		since := make([]int64, 2)
+		err = binary.Read(reader, binary.BigEndian, &key.Type)
+		if err == nil {
+			err = binary.Read(reader, binary.BigEndian, &key.Id)
+		}
+		if err == nil {
+			err = binary.Read(reader, binary.BigEndian, &limits)
+		}
+		if err == nil {
+			err = binary.Read(reader, binary.BigEndian, since)
+		}
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		e := t.entry(key)
+		e.blocks.soft = limits.SoftBlocks
+		e.blocks.hard = limits.HardBlocks
+		e.inodes.soft = limits.SoftInodes
+		e.inodes.hard = limits.HardInodes
+		e.blocks.since = fromUnixTime(since[0])
+		e.inodes.since = fromUnixTime(since[1])
+	}
+	return nil
+}
+
+func (i *Inode) quotaKeys() []QuotaKey {
+	keys := []QuotaKey{{Type: USER_QUOTA, Id: i.uid}}
+	if i.project != 0 {
+		keys = append(keys, QuotaKey{Type: PROJECT_QUOTA, Id: i.project})
+	}
+	return keys
+}
+
+// chargedBlocks returns the number of blocks the inode is charged for
+func (i *Inode) chargedBlocks() int64 {
+	blocks := int64(len(i.dataBlocks()))
+	if i.xattrBlock != NO_BLOCK {
+		blocks++
+	}
+	return blocks
+}
+
+// charge adds the blocks and the inodes to the quotas of the owner, it
+// fails with a *QuotaError when a limit would be exceeded
+func (f *FileSystem) charge(owner *Inode, blocks, inodes int64) error {
+	if owner == nil || owner.flags&(FLAG_SNAPSHOT|FLAG_SYSTEM) != 0 {
+		return nil
+	}
+	// root can go over the limits, but it's still charged
+	enforce := f.Session.uid != 0
+	return f.quotas.charge(owner.quotaKeys(), blocks, inodes, enforce, time.Now())
+}
+
+// recharge moves the charges of the inode to the owners change gives it
+func (f *FileSystem) recharge(inode *Inode, change func()) error {
+	blocks := inode.chargedBlocks()
+	err := f.charge(inode, -blocks, -1)
+	if err != nil {
+		return err
+	}
+	change()
+	return f.charge(inode, blocks, 1)
+}
+
+// loadQuotas reads the quota file and counts the usage of every file. The
+// orphans are counted too, they keep their blocks until they are cleaned.
+func (f *FileSystem) loadQuotas() error {
+	if f.Superblock.QuotaInode != NO_INODE {
+		inode, err := f.ReadInode(f.Superblock.QuotaInode)
+		if err != nil {
+			return err
+		}
+		data := make([]byte, inode.Size)
+		_, err = f.Read(&inode, 0, data)
+		if err != nil {
+			return err
+		}
+		err = f.quotas.decode(data)
+		if err != nil {
+			return err
+		}
+	}
+	ids, err := f.orphanList()
+	// a read-only mount keeps the damaged list for fsck to report, the
+	// orphans just aren't charged
+	if errors.Is(err, ErrBadOrphanList) && f.Options.ReadOnly {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	orphans := map[int64]bool{}
+	for _, id := range ids {
+		orphans[id] = true
+	}
+	for id := int64(0); id < f.Superblock.InodeCount; id++ {
+		inode, err := f.ReadInode(id)
+		if err != nil {
+			return err
+		}
+		// free inodes have no links
+		if (inode.linkCount == 0 && !orphans[id]) || inode.flags&(FLAG_SNAPSHOT|FLAG_SYSTEM) != 0 {
+			continue
+		}
+		f.quotas.charge(inode.quotaKeys(), inode.chargedBlocks(), 1, false, time.Now())
+	}
+	f.quotas.saved = f.quotas.version
+	return nil
+}
+
+// quotaFile returns the inode of the quota file, it's created on the first
+// use. The caller holds f.locks.quotaFile.
+func (f *FileSystem) quotaFile() (int64, error) {
+	f.locks.superblock.Lock()
+	id := f.Superblock.QuotaInode
+	f.locks.superblock.Unlock()
+	if id != NO_INODE {
+		return id, nil
+	}
+	inode, err := f.AllocateInode(Inode{flags: FLAG_SYSTEM})
+	if err != nil {
+		return -1, err
+	}
+	// the link keeps the inode from looking free
+	inode.linkCount = 1
+	err = f.WriteInode(&inode)
+	if err != nil {
+		return -1, err
+	}
+	// the file has to be on disk before the superblock points to it
+	err = f.inodes.FlushKey(inode.id)
+	if err != nil {
+		return -1, err
+	}
+	f.locks.superblock.Lock()
+	f.Superblock.QuotaInode = inode.id
+	f.locks.superblock.Unlock()
+	return inode.id, f.WriteSuperblock()
+}
+
+// saveQuotas writes the quota file if the limits or the grace periods have
+// changed since it was written
+func (f *FileSystem) saveQuotas() error {
+	f.locks.quotaFile.Lock()
+	defer f.locks.quotaFile.Unlock()
+	data, version, err := f.quotas.encode()
+	if err != nil {
+		return err
+	}
+	f.quotas.mu.Lock()
+	saved := f.quotas.saved
+	f.quotas.mu.Unlock()
+	if version == saved {
+		return nil
+	}
+	id, err := f.quotaFile()
+	if err != nil {
+		return err
+	}
+	lock := f.locks.Inode(id)
+	lock.Lock()
+	defer lock.Unlock()
+	inode, err := f.ReadInode(id)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(&inode, 0, data)
+	if err == nil && inode.Size > int64(len(data)) {
+		err = f.Truncate(&inode, int64(len(data)))
+	}
+	if err != nil {
+		return err
+	}
+	f.quotas.mu.Lock()
+	f.quotas.saved = version
+	f.quotas.mu.Unlock()
+	return nil
+}
+
+// SetQuota sets the limits of a user or a project, zero limits remove them
+func (f *FileSystem) SetQuota(key QuotaKey, limits QuotaLimits) error {
+	if err := f.writable(); err != nil {
+		return err
+	}
+	if f.Session.uid != 0 {
+		return ErrPermission
+	}
+	if limits.SoftBlocks < 0 || limits.HardBlocks < 0 || limits.SoftInodes < 0 || limits.HardInodes < 0 {
+		return ErrInvalidQuota
+	}
+	if (limits.HardBlocks != 0 && limits.SoftBlocks > limits.HardBlocks) ||
+		(limits.HardInodes != 0 && limits.SoftInodes > limits.HardInodes) {
+		return ErrInvalidQuota
+	}
+	f.quotas.setLimits(key, limits, time.Now())
+	err := f.saveQuotas()
+	if err != nil {
+		return err
+	}
+	return f.commit()
+}
+
+// SetQuotaGrace sets how long the soft limits of blocks and inodes can be
+// exceeded
+func (f *FileSystem) SetQuotaGrace(blocks, inodes time.Duration) error {
+	if err := f.writable(); err != nil {
+		return err
+	}
+	if f.Session.uid != 0 {
+		return ErrPermission
+	}
+	if blocks < 0 || inodes < 0 {
+		return ErrInvalidQuota
+	}
+	f.quotas.setGrace(blocks, inodes)
+	err := f.saveQuotas()
+	if err != nil {
+		return err
+	}
+	return f.commit()
+}
+
+// Quotas returns the usage and the limits of the users and the projects,
+// other users see only their own quota and the projects
+func (f *FileSystem) Quotas() []QuotaReport {
+	reports := []QuotaReport{}
+	for _, report := range f.quotas.report() {
+		if f.Session.uid == 0 || report.Type == PROJECT_QUOTA || report.Id == f.Session.uid {
+			reports = append(reports, report)
+		}
+	}
+	return reports
+}
+
+// SetProject puts the file, and everything under it for a directory, in
+// the project. The charges move to the new project.
+func (f *FileSystem) SetProject(file int64, project uint32) error {
+	if err := f.writable(); err != nil {
+		return err
+	}
+	if f.Session.uid != 0 {
+		return ErrPermission
+	}
+	err := f.setProjectTree(file, project)
+	if err != nil {
+		return err
+	}
+	return f.commit()
+}
+
+func (f *FileSystem) setProjectTree(id int64, project uint32) error {
+	lock := f.locks.Inode(id)
+	lock.Lock()
+	defer lock.Unlock()
+	inode, err := f.ReadInode(id)
+	if err != nil {
+		return err
+	}
+	if inode.flags&FLAG_SNAPSHOT != 0 {
+		return ErrReadOnlySnapshot
+	}
+	if inode.project != project {
+		err = f.recharge(&inode, func() { inode.project = project })
+		if err != nil {
+			return err
+		}
+		inode.touchChanged()
+		err = f.WriteInode(&inode)
+		if err != nil {
+			return err
+		}
+	}
+	if inode.fileType != DIRECTORY {
+		return nil
+	}
+	entries, err := f.ReadDirectory(&inode)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name == "." || entry.Name == ".." {
+			continue
+		}
+		err = f.setProjectTree(entry.Inode, project)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// quotaReport returns the usage of the user or the project
+func quotaReport(f *FileSystem, typ QuotaType, id uint32) QuotaReport {
+	for _, r := range f.Quotas() {
+		if r.Type == typ && r.Id == id {
+			return r
+		}
+	}
+	return QuotaReport{}
+}
+
+func TestQuotaHardLimits(t *testing.T) {
+	f := newTestFileSystem(t, MountOptions{})
+	root := f.Superblock.Root
+	if err := f.SetACL(root, ACL_TYPE_ACCESS, modeACL(0777)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SetQuota(QuotaKey{USER_QUOTA, 5}, QuotaLimits{HardBlocks: 2, HardInodes: 2}); err != nil {
+		t.Fatal(err)
+	}
+	f.Session.uid, f.Session.gid = 5, 5
+	if err := putFile(f, "a", bytes.Repeat([]byte("a"), 2*BLOCK_SIZE)); err != nil {
+		t.Fatal(err)
+	}
+	if err := putFile(f, "b", []byte("b")); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("write over the block limit: %v", err)
+	}
+	// b was created before the write failed, it's the second inode
+	if err := f.CreateCmd(root, "c"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("create over the inode limit: %v", err)
+	}
+	if r := quotaReport(f, USER_QUOTA, 5); r.Blocks != 2 || r.Inodes != 2 {
+		t.Fatalf("usage at the limits: %+v", r)
+	}
+	// the limits don't apply to root, the files are charged to their owner
+	f.Session.uid, f.Session.gid = 0, 0
+	if err := f.CreateCmd(root, "c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.UnlinkCmd(root, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if r := quotaReport(f, USER_QUOTA, 5); r.Blocks != 0 || r.Inodes != 1 {
+		t.Fatalf("usage after the unlink: %+v", r)
+	}
+}
+
+func TestQuotaOrphansAfterCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "img")
+	f, err := NewFileSystem(64, path, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := f.Superblock.Root
+	if err := f.SetACL(root, ACL_TYPE_ACCESS, modeACL(0777)); err != nil {
+		t.Fatal(err)
+	}
+	f.Session.uid, f.Session.gid = 5, 5
+	kept, err := f.Create(root, "kept", REGULAR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteFile(kept, 0, bytes.Repeat([]byte("k"), 3*BLOCK_SIZE)); err != nil {
+		t.Fatal(err)
+	}
+	// the open file is an orphan once it's unlinked
+	fd, err := f.Open(root, "open", O_RDWR|O_CREAT, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.WriteCmd(fd, string(bytes.Repeat([]byte("o"), 4*BLOCK_SIZE))); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.UnlinkCmd(root, "open"); err != nil {
+		t.Fatal(err)
+	}
+	if r := quotaReport(f, USER_QUOTA, 5); r.Blocks != 7 || r.Inodes != 2 {
+		t.Fatalf("usage with the orphan: %+v", r)
+	}
+	// crash without closing the file
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	f.release()
+	f, err = OpenFileSystem(path, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if r := quotaReport(f, USER_QUOTA, 5); r.Blocks != 3 || r.Inodes != 1 {
+		t.Fatalf("usage after the orphan is cleaned: %+v", r)
+	}
+}
+
+func TestWriteOverQuota(t *testing.T) {
+	f := newTestFileSystem(t, MountOptions{})
+	root := f.Superblock.Root
+	if err := f.SetACL(root, ACL_TYPE_ACCESS, modeACL(0777)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SetQuota(QuotaKey{USER_QUOTA, 5}, QuotaLimits{HardBlocks: 2}); err != nil {
+		t.Fatal(err)
+	}
+	f.Session.uid, f.Session.gid = 5, 5
+	file, err := f.Create(root, "file", REGULAR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the blocks are allocated first, nothing is written
+	n, err := f.WriteFile(file, 0, bytes.Repeat([]byte("x"), 3*BLOCK_SIZE))
+	if !errors.Is(err, ErrQuotaExceeded) || n != 0 {
+		t.Fatalf("write over the quota: %d bytes, %v", n, err)
+	}
+	stat, err := f.Stat(file)
+	if err != nil || stat.size != 0 {
+		t.Fatalf("size %d after the failed write: %v", stat.size, err)
+	}
+	if r := quotaReport(f, USER_QUOTA, 5); r.Blocks != 0 {
+		t.Fatalf("%d blocks charged after the failed write", r.Blocks)
+	}
+}
@@ -1,16 +1,14 @@
 package main
 
-import (
-	"errors"
-	"io"
-)
-
 func (f *FileSystem) Read(inode *Inode, offset int64, buffer []byte) (int64, error) {
 	// Check if offset is within file size
 	// if offset is after the end of file, return 0, nil
 	if offset >= inode.Size {
 		return 0, nil
 	}
+	if inode.flags&FLAG_COMPRESS != 0 {
+		return f.readCompressed(inode, offset, buffer)
+	}
 
 	// Find the index of block to read
 	indexofBlock := offset / BLOCK_SIZE
@@ -39,7 +37,12 @@ func UpDivision(a, b int64) int64 {
 	return (a + b - 1) / b
 }
 
+// Write writes the buffer at the offset. When it fails half way the bytes
+// written before are kept and counted, like a short write.
 func (f *FileSystem) Write(inode *Inode, offset int64, buffer []byte) (int64, error) {
+	if err := f.writable(); err != nil {
+		return 0, err
+	}
 	// jump to the offset
 	// write the number of bytes from the buffer
 	// allocate blocks when needed
@@ -47,8 +50,15 @@ func (f *FileSystem) Write(inode *Inode, offset int64, buffer []byte) (int64, er
 	// calculate the new size (offset + size)
 	size := offset + int64(len(buffer))
 	// check if it's not greater than maximum file
-	if size > BLOCK_SIZE*DIRECT_LINKS {
-		return -1, errors.New("size is greater that maximum files size")
+	if size > MAX_FILE_SIZE {
+		return 0, ErrFileTooBig
+	}
+	inode.touchModified()
+	if inode.flags&FLAG_COMPRESS != 0 {
+		if size < inode.Size {
+			size = inode.Size
+		}
+		return f.writeCompressed(inode, offset, buffer, size)
 	}
 
 	// calcualte the number of blocks file occupies = old
@@ -58,9 +68,10 @@ func (f *FileSystem) Write(inode *Inode, offset int64, buffer []byte) (int64, er
 	old := UpDivision(inode.Size, BLOCK_SIZE)
 	new := UpDivision(size, BLOCK_SIZE)
 	for old < new {
-		block, err := f.AllocateBlock()
+		block, err := f.AllocateBlock(inode)
 		if err != nil {
-			return -1, err
+			f.dropBlocks(inode, UpDivision(inode.Size, BLOCK_SIZE), old)
+			return 0, err
 		}
 		inode.Blocks[old] = int64(block)
 		old++
@@ -77,12 +88,28 @@ func (f *FileSystem) Write(inode *Inode, offset int64, buffer []byte) (int64, er
 	n := int64(len(buffer))
 	// write the data to block
 	for len(buffer) != 0 {
-		block := inode.Blocks[index]
-		var err error
-		buffer, err = f.WriteToBlock(Block(block), offsetBlock, buffer)
+		// the block can't become shared while it's changed in place
+		f.locks.dedupe.RLock()
+		err := f.unshareBlock(inode, index)
+		if err == nil {
+			block := inode.Blocks[index]
+			var rest []byte
+			rest, err = f.WriteToBlock(Block(block), offsetBlock, buffer)
+			if err == nil {
+				buffer = rest
+			}
+		}
+		f.locks.dedupe.RUnlock()
 		if err != nil {
-			return -1, err
+			return f.shortWrite(inode, offset, n-int64(len(buffer)), new, err)
+		}
+		if f.Options.Dedupe {
+			_, err = f.dedupeBlock(inode, index)
+			if err != nil {
+				return f.shortWrite(inode, offset, n-int64(len(buffer)), new, err)
+			}
 		}
+		offsetBlock = 0
 		index++
 	}
 	// go to the next block if needed, and repeat
@@ -91,12 +118,23 @@ func (f *FileSystem) Write(inode *Inode, offset int64, buffer []byte) (int64, er
 	}
 	err := f.WriteInode(inode)
 	if err != nil {
-		return -1, err
+		return 0, err
 	}
 
 	return n, nil
 }
 
+// shortWrite keeps the bytes a failed write has written, the file grows
+// to hold them and the blocks allocated past them up to end are freed
+func (f *FileSystem) shortWrite(inode *Inode, offset int64, written int64, end int64, err error) (int64, error) {
+	if offset+written > inode.Size {
+		inode.Size = offset + written
+	}
+	f.dropBlocks(inode, UpDivision(inode.Size, BLOCK_SIZE), end)
+	f.WriteInode(inode)
+	return written, err
+}
+
 func min(a, b int64) int64 {
 	if a < b {
 		return a
@@ -104,20 +142,64 @@ func min(a, b int64) int64 {
 	return b
 }
 
+// dropBlocks frees the slots from first up to end, it undoes the allocations
+// of a write that failed
+func (f *FileSystem) dropBlocks(inode *Inode, first int64, end int64) {
+	for i := first; i < end; i++ {
+		f.FreeBlock(inode, Block(inode.Blocks[i]))
+		inode.Blocks[i] = 0
+	}
+}
+
+// unshareBlock gives the inode its own copy of the block if other files or
+// snapshots use it too, so the write doesn't show up there
+func (f *FileSystem) unshareBlock(inode *Inode, index int64) error {
+	old := Block(inode.Blocks[index])
+	refs, err := f.BlockRefs(old)
+	if err != nil || refs <= 1 {
+		return err
+	}
+	data, err := f.readBlock(old)
+	if err != nil {
+		return err
+	}
+	// the inode keeps the number of its blocks, so it isn't charged
+	block, err := f.AllocateBlock(nil)
+	if err != nil {
+		return err
+	}
+	copied := make([]byte, BLOCK_SIZE)
+	copy(copied, data)
+	err = f.blocks.Put(block, copied)
+	if err != nil {
+		return err
+	}
+	inode.Blocks[index] = int64(block)
+	return f.FreeBlock(nil, old)
+}
+
 func (f *FileSystem) WriteToBlock(block Block, offset int64, buffer []byte) ([]byte, error) {
 	// jump to the block + offset
 	// write the buffer to block, but stop if block ends
 	// return the bytes that were not written
 
 	to_write := BLOCK_SIZE - offset
-	location := f.Superblock.BlocksOffset + int64(block)*BLOCK_SIZE + offset
-	_, err := f.File.Seek(location, io.SeekStart)
+	end := min(to_write, int64(len(buffer)))
+	// cached blocks can be used by readers, so a copy is changed
+	data := make([]byte, BLOCK_SIZE)
+	if end != BLOCK_SIZE {
+		old, err := f.readBlock(block)
+		if err != nil {
+			return []byte{}, err
+		}
+		copy(data, old)
+	}
+	copy(data[offset:], buffer[:end])
+	err := f.blocks.Put(block, data)
 	if err != nil {
 		return []byte{}, err
 	}
-	end := min(to_write, int64(len(buffer)))
-	n, err := f.File.Write(buffer[:end])
-	return buffer[n:], err
+	return buffer[end:], nil
 
 }
 
@@ -126,30 +208,41 @@ func (f *FileSystem) ReadFromBlock(block Block, offset int64, buffer []byte) (in
 	// read the block to buffer, but stop if block ends
 	// return the number of bytes that was written
 	to_read := BLOCK_SIZE - offset
-	location := f.Superblock.BlocksOffset + int64(block)*BLOCK_SIZE + offset
-	_, err := f.File.Seek(location, io.SeekStart)
+	end := min(to_read, int64(len(buffer)))
+	data, err := f.readBlock(block)
 	if err != nil {
 		return -1, err
 	}
-	end := min(to_read, int64(len(buffer)))
-	n, err := f.File.Read(buffer[:end])
-	if int64(n) != end {
-		return int64(n), errors.New("ooooops")
-	}
-	return int64(n), err
+	n := copy(buffer[:end], data[offset:])
+	return int64(n), nil
 }
 
 func (f *FileSystem) Truncate(inode *Inode, size int64) error {
+	if err := f.writable(); err != nil {
+		return err
+	}
 	// if newsize < inode.size
 	//        reduce size (deallocate blocks)
 	// if newsize > inode.size:
 	//        allocate blocks (like in write)
+	if size < 0 {
+		return ErrInvalidSize
+	}
+	if size > MAX_FILE_SIZE {
+		return ErrFileTooBig
+	}
+	inode.touchModified()
+	if inode.flags&FLAG_COMPRESS != 0 {
+		_, err := f.writeCompressed(inode, 0, nil, size)
+		return err
+	}
 	old := UpDivision(inode.Size, BLOCK_SIZE)
 	new := UpDivision(size, BLOCK_SIZE)
 	if size > inode.Size {
 		for old < new {
-			block, err := f.AllocateBlock()
+			block, err := f.AllocateBlock(inode)
 			if err != nil {
+				f.dropBlocks(inode, UpDivision(inode.Size, BLOCK_SIZE), old)
 				return err
 			}
 			inode.Blocks[old] = int64(block)
@@ -158,7 +251,7 @@ func (f *FileSystem) Truncate(inode *Inode, size int64) error {
 	} else if size < inode.Size {
 		for new < old {
 			idx := old - 1
-			err := f.SetBlockBitmapOffset(Block(inode.Blocks[idx]), FREE)
+			err := f.FreeBlock(inode, Block(inode.Blocks[idx]))
 			if err != nil {
 				return err
 			}
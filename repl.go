@@ -1,70 +1,455 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
-	"github.com/xandout/gorpl"
-	"github.com/xandout/gorpl/action"
+	"github.com/chzyer/readline"
 )
 
+// HISTORY_FILE keeps the lines typed in the REPL, it's in the home
+// directory of the user
+const HISTORY_FILE = ".fs_history"
+
+var ErrUnknownCommand error = errors.New("unknown command")
+
 type Handler func(args ...interface{}) (interface{}, error)
 
-func errorify(callback Handler) Handler {
-	return func(args ...interface{}) (interface{}, error) {
-		val, err := callback(args...)
+// Action is a command of the REPL, it gets the words after the name
+type Action struct {
+	Name string
+	// the arguments, shown by help
+	Usage   string
+	Summary string
+	Run     Handler
+}
+
+type Repl struct {
+	fs      *FileSystem
+	actions []Action
+	// values captured by "name = command ...", expanded from $name
+	vars map[string]string
+	// where the commands print, "> path" sends it to a file of the image
+	out io.Writer
+	// ls, stat, open, read, df and the errors print JSON, see json.go
+	json bool
+	// number of scripts being sourced, see script.go
+	depth int
+	// set by exit
+	done bool
+	// the terminal of Start, nil when the commands don't come from it
+	rl *readline.Instance
+}
+
+func (r *Repl) AddAction(name string, usage string, summary string, run Handler) {
+	r.actions = append(r.actions, Action{Name: name, Usage: usage, Summary: summary, Run: run})
+}
+
+func (r *Repl) action(name string) (Action, bool) {
+	for _, a := range r.actions {
+		if a.Name == name {
+			return a, true
+		}
+	}
+	return Action{}, false
+}
+
+// historyPath is where the history is kept, "" turns it off
+func historyPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, HISTORY_FILE)
+}
+
+// SetJSON turns the JSON output on or off
+func (r *Repl) SetJSON(on bool) {
+	r.json = on
+}
+
+func (r *Repl) printError(err error) {
+	if r.json {
+		printJSON(os.Stdout, errorInfo(err))
+		return
+	}
+	fmt.Printf("Error: %s\n", err)
+}
+
+// FileSystem is the mounted image, mkfs and mount replace it
+func (r *Repl) FileSystem() *FileSystem {
+	return r.fs
+}
+
+// prompt shows if the image is mounted read-write or read-only
+func (r *Repl) prompt() string {
+	if r.fs.Options.ReadOnly {
+		return "ro> "
+	}
+	return "rw> "
+}
+
+// swap replaces the image with the one open returns. The old one is
+// synced first, so open can mount the same image again, and it stays
+// mounted when open fails. Once the new one is in place the old device is
+// closed, unless the new image is on it too.
+func (r *Repl) swap(open func() (*FileSystem, error), closeOld bool) error {
+	old := r.fs
+	old.stopFlusher()
+	err := old.Sync()
+	if err == nil {
+		var f *FileSystem
+		f, err = open()
+		if err == nil {
+			r.fs = f
+			if !closeOld {
+				return nil
+			}
+			return old.release()
+		}
+	}
+	if !old.Options.ReadOnly {
+		old.startFlusher()
+	}
+	return err
+}
+
+// replaceImage makes a new image next to the one at path and renames it
+// over it, so the old one is kept when mkfs fails
+func replaceImage(path string, count int64, opts MountOptions) (*FileSystem, error) {
+	tmp := path + ".mkfs"
+	f, err := NewFileSystem(count, tmp, opts)
+	if err == nil {
+		err = f.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	return OpenFileSystem(path, opts)
+}
+
+// passphrase returns the passphrase from $FS_PASSPHRASE, on the terminal
+// it's asked for when that's empty. It's never part of a line, the lines
+// are kept in the history file.
+func (r *Repl) passphrase() (string, error) {
+	if passphrase := os.Getenv(PASSPHRASE_ENV); passphrase != "" {
+		return passphrase, nil
+	}
+	if r.rl == nil {
+		return "", ErrKeyRequired
+	}
+	passphrase, err := r.rl.ReadPassword("passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if len(passphrase) == 0 {
+		return "", ErrKeyRequired
+	}
+	return string(passphrase), nil
+}
+
+// Start reads commands from the terminal until exit or the end of the input
+func (r *Repl) Start() error {
+	rl, err := readline.NewEx(&readline.Config{
+		Prompt:       r.prompt(),
+		HistoryFile:  historyPath(),
+		AutoComplete: &completer{r},
+	})
+	if err != nil {
+		return err
+	}
+	defer rl.Close()
+	r.rl = rl
+	defer func() { r.rl = nil }()
+	for !r.done {
+		// mount may have changed the mode
+		rl.SetPrompt(r.prompt())
+		line, err := rl.Readline()
+		if err == readline.ErrInterrupt {
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = r.Exec(line)
+		if err != nil {
+			r.printError(err)
+		}
+	}
+	return nil
+}
+
+// Exec runs one line, it's split into words like words.go describes.
+// "name = command ..." stores what the command returns, like the fd of
+// open, to be used as $name later.
+func (r *Repl) Exec(line string) error {
+	words, err := r.splitLine(line)
+	if err != nil {
+		return err
+	}
+	if len(words) == 0 {
+		return nil
+	}
+	variable := ""
+	if len(words) > 2 && words[1].text == "=" && !words[1].quoted {
+		if !isVariableName(words[0].text) {
+			return fmt.Errorf("invalid variable name %q", words[0].text)
+		}
+		variable = words[0].text
+		words = words[2:]
+	}
+	words, output, err := redirect(words)
+	if err != nil {
+		return err
+	}
+	if len(words) == 0 {
+		return errors.New("need command")
+	}
+	name := words[0].text
+	args := make([]interface{}, 0, len(words)-1)
+	for _, w := range words[1:] {
+		args = append(args, w.text)
+	}
+	a, ok := r.action(name)
+	if !ok {
+		return fmt.Errorf("%w %q", ErrUnknownCommand, name)
+	}
+	var buffer bytes.Buffer
+	out := r.out
+	if output.path != "" {
+		r.out = &buffer
+	}
+	val, err := a.Run(args...)
+	r.out = out
+	if err != nil {
+		return err
+	}
+	if output.path != "" {
+		err = output.write(r.fs, buffer.Bytes())
 		if err != nil {
-			fmt.Printf("Error: %s\n", err)
+			return err
+		}
+	}
+	if variable != "" {
+		if val == nil {
+			return fmt.Errorf("%s returns nothing to store in %s", name, variable)
 		}
-		return val, err
+		r.vars[variable] = fmt.Sprint(val)
 	}
+	return nil
 }
 
-func NewRepl(fs *FileSystem) gorpl.Repl {
-	exitAction := action.New("exit", errorify(func(args ...interface{}) (interface{}, error) {
-		fmt.Println("Bye!")
-		os.Exit(0)
+func isVariableName(name string) bool {
+	for i, c := range name {
+		letter := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		if !letter && (i == 0 || c < '0' || c > '9') {
+			return false
+		}
+	}
+	return name != ""
+}
+
+func parseFkey(str string) (Fkey, error) {
+	fd, err := strconv.Atoi(str)
+	if err != nil {
+		return -1, errors.New("fd should be int")
+	}
+	return Fkey(fd), nil
+}
+
+// parseCount takes -n lines or -c bytes of head and tail, 10 lines by
+// default
+func parseCount(args []interface{}) (int64, bool, []interface{}, error) {
+	if len(args) < 2 || (args[0].(string) != "-n" && args[0].(string) != "-c") {
+		return 10, true, args, nil
+	}
+	count, err := strconv.ParseInt(args[1].(string), 10, 64)
+	if err != nil || count < 0 {
+		return 0, false, nil, errors.New("count should be a positive int")
+	}
+	return count, args[0].(string) == "-n", args[2:], nil
+}
+
+// formatSize shows the bytes in powers of 1024, like df -h
+func formatSize(size int64) string {
+	units := "KMGTPE"
+	if size < 1024 {
+		return strconv.FormatInt(size, 10)
+	}
+	value := float64(size)
+	unit := -1
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if value < 10 {
+		return fmt.Sprintf("%.1f%c", value, units[unit])
+	}
+	return fmt.Sprintf("%.0f%c", value, units[unit])
+}
+
+// usePercent is the used part of the total, rounded up like df does
+func usePercent(used, total int64) string {
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%v%%", UpDivision(used*100, total))
+}
+
+// formatGrace shows the time left of a grace period
+func formatGrace(end time.Time) string {
+	if end.IsZero() {
+		return "-"
+	}
+	left := time.Until(end).Round(time.Second)
+	if left <= 0 {
+		return "none"
+	}
+	return left.String()
+}
+
+// printStat writes the attributes of the file, one per line
+func printStat(w io.Writer, stat Stat) {
+	ftype := '-'
+
+	switch stat.ftype {
+	case DIRECTORY:
+		ftype = 'd'
+	case REGULAR:
+		ftype = 'r'
+	default:
+		ftype = '-'
+	}
+
+	fmt.Fprintf(w, "inode:\t%v\n", stat.inode)
+	fmt.Fprintf(w, "ftype:\t%c\n", ftype)
+	fmt.Fprintf(w, "mode:\t%04o\n", stat.mode)
+	fmt.Fprintf(w, "uid:\t%v\n", stat.uid)
+	fmt.Fprintf(w, "gid:\t%v\n", stat.gid)
+	fmt.Fprintf(w, "project:\t%v\n", stat.project)
+	fmt.Fprintf(w, "size:\t%v\n", stat.size)
+	fmt.Fprintf(w, "disk:\t%v\n", stat.disk)
+	flags := ""
+	if stat.flags&FLAG_COMPRESS != 0 {
+		flags += "c"
+	}
+	if stat.flags&FLAG_SNAPSHOT != 0 {
+		flags += "s"
+	}
+	if flags == "" {
+		flags = "-"
+	}
+	fmt.Fprintf(w, "flags:\t%s\n", flags)
+	fmt.Fprintf(w, "links:\t%v\n", stat.links)
+	fmt.Fprintf(w, "atime:\t%v\n", stat.atime.Format(time.RFC3339Nano))
+	fmt.Fprintf(w, "mtime:\t%v\n", stat.mtime.Format(time.RFC3339Nano))
+	fmt.Fprintf(w, "ctime:\t%v\n", stat.ctime.Format(time.RFC3339Nano))
+	fmt.Fprintf(w, "shared:\t%v\n", stat.shared)
+	fmt.Fprintf(w, "exclusive:\t%v\n", stat.exclusive)
+	names := make([]string, 0, len(stat.xattrs))
+	for name := range stat.xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "xattr:\t%s=%q\n", name, stat.xattrs[name])
+	}
+}
+
+// printStatFS writes the usage of the image like df -h
+func printStatFS(w io.Writer, stat StatFS) {
+	usedBlocks := stat.Blocks - stat.FreeBlocks
+	usedInodes := stat.Inodes - stat.FreeInodes
+	fmt.Fprintln(w, "\tsize\tused\tavail\tuse%")
+	fmt.Fprintf(w, "blocks\t%v\t%v\t%v\t%v\n",
+		formatSize(stat.Blocks*stat.BlockSize),
+		formatSize(usedBlocks*stat.BlockSize),
+		formatSize(stat.AvailableBlocks*stat.BlockSize),
+		usePercent(usedBlocks, stat.Blocks))
+	fmt.Fprintf(w, "inodes\t%v\t%v\t%v\t%v\n", stat.Inodes, usedInodes, stat.AvailableInodes,
+		usePercent(usedInodes, stat.Inodes))
+	fmt.Fprintf(w, "block size:\t%v\n", formatSize(stat.BlockSize))
+	fmt.Fprintf(w, "max name:\t%v\n", stat.NameMax)
+	fmt.Fprintf(w, "max file size:\t%v\n", formatSize(stat.MaxFileSize))
+}
+
+func NewRepl(fs *FileSystem) *Repl {
+	r := &Repl{fs: fs, vars: make(map[string]string), out: os.Stdout}
+	r.AddAction("help", "[command]", "list the commands or show how one is used", func(args ...interface{}) (interface{}, error) {
+		if len(args) > 1 {
+			return nil, errors.New("need optional command")
+		}
+		if len(args) == 1 {
+			a, ok := r.action(args[0].(string))
+			if !ok {
+				return nil, fmt.Errorf("%w %q", ErrUnknownCommand, args[0].(string))
+			}
+			fmt.Fprintf(r.out, "usage: %s\n", strings.TrimRight(a.Name+" "+a.Usage, " "))
+			fmt.Fprintln(r.out, a.Summary)
+			return nil, nil
+		}
+		for _, a := range r.actions {
+			fmt.Fprintf(r.out, "%-12s %s\n", a.Name, a.Summary)
+		}
+		return nil, nil
+	})
+	r.AddAction("exit", "", "unmount the image and leave", func(args ...interface{}) (interface{}, error) {
+		// the image is unmounted by the caller of Start
+		r.done = true
+		fmt.Fprintln(r.out, "Bye!")
 		return nil, nil
-	}))
-	create := action.New("create", errorify(func(args ...interface{}) (interface{}, error) {
+	})
+	r.AddAction("create", "name", "make an empty file", func(args ...interface{}) (interface{}, error) {
 		if len(args) != 1 {
 			return nil, errors.New("need name")
 		}
 		name := args[0].(string)
-		err := fs.CreateCmd(fs.Session.pwd, name)
+		err := r.fs.CreateCmd(r.fs.Session.pwd, name)
 		return nil, err
-	}))
-	ls := action.New("ls", errorify(func(args ...interface{}) (interface{}, error) {
-		entry, err := fs.List(fs.Session.pwd)
-		if err != nil {
-			return nil, err
+	})
+	r.AddAction("ls", "[-l] [-a] [-R] [-i] [-h] [-S|-t] [-r] [name...]", "list directories", func(args ...interface{}) (interface{}, error) {
+		paths := []string{}
+		if r.json {
+			paths = append(paths, "--json")
 		}
-		fmt.Println("inode\tname")
-		for _, en := range entry {
-			fmt.Printf("%v\t%s\n", en.Inode, en.Name)
+		for _, arg := range args {
+			paths = append(paths, arg.(string))
 		}
-		return nil, nil
-	}))
-	link := action.New("link", errorify(func(args ...interface{}) (interface{}, error) {
+		return nil, r.fs.LsCmd(r.fs.Session.pwd, paths, r.out)
+	})
+	r.AddAction("link", "from to", "make a hard link", func(args ...interface{}) (interface{}, error) {
 		if len(args) != 2 {
 			return nil, errors.New("need from and to")
 		}
 		from := args[0].(string)
 		to := args[1].(string)
-		err := fs.LinkCmd(fs.Session.pwd, from, to)
+		err := r.fs.LinkCmd(r.fs.Session.pwd, from, to)
 		return nil, err
-	}))
-	unlink := action.New("unlink", errorify(func(args ...interface{}) (interface{}, error) {
+	})
+	r.AddAction("unlink", "name", "remove a name of a file", func(args ...interface{}) (interface{}, error) {
 		if len(args) != 1 {
 			return nil, errors.New("need name")
 		}
 		name := args[0].(string)
-		err := fs.UnlinkCmd(fs.Session.pwd, name)
+		err := r.fs.UnlinkCmd(r.fs.Session.pwd, name)
 		return nil, err
-	}))
-	truncate := action.New("truncate", errorify(func(args ...interface{}) (interface{}, error) {
+	})
+	r.AddAction("truncate", "name size", "change the size of a file", func(args ...interface{}) (interface{}, error) {
 		if len(args) != 2 {
 			return nil, errors.New("need name and size ")
 		}
@@ -74,129 +459,622 @@ func NewRepl(fs *FileSystem) gorpl.Repl {
 		if err != nil {
 			return nil, errors.New("size should be int")
 		}
-		err = fs.TruncateCmd(fs.Session.pwd, name, int64(size))
+		err = r.fs.TruncateCmd(r.fs.Session.pwd, name, int64(size))
 		return nil, err
-	}))
-	stat := action.New("stat", errorify(func(args ...interface{}) (interface{}, error) {
+	})
+	r.AddAction("stat", "name", "show the attributes of a file", func(args ...interface{}) (interface{}, error) {
 		if len(args) != 1 {
 			return nil, errors.New("need name")
 		}
 		name := args[0].(string)
-		stat, err := fs.StatCmd(fs.Session.pwd, name)
+		stat, err := r.fs.StatCmd(r.fs.Session.pwd, name)
 		if err != nil {
 			return nil, err
 		}
-
-		ftype := '-'
-
-		switch stat.ftype {
-		case DIRECTORY:
-			ftype = 'd'
-		case REGULAR:
-			ftype = 'r'
-		default:
-			ftype = '-'
+		if r.json {
+			return nil, printJSON(r.out, stat.Info())
 		}
-
-		fmt.Printf("inode:\t%v\n", stat.inode)
-		fmt.Printf("ftype:\t%c\n", ftype)
-		fmt.Printf("size:\t%v\n", stat.size)
-		fmt.Printf("links:\t%v\n", stat.links)
+		printStat(r.out, stat)
 		return nil, nil
-	}))
-	open := action.New("open", errorify(func(args ...interface{}) (interface{}, error) {
-		if len(args) != 1 {
-			return nil, errors.New("need name")
+	})
+	r.AddAction("open", "name [flags [mode]]", "open a file, flags like O_RDWR|O_CREAT, prints the fd", func(args ...interface{}) (interface{}, error) {
+		if len(args) < 1 || len(args) > 3 {
+			return nil, errors.New("need name, optional flags and mode")
 		}
 		name := args[0].(string)
-		fkay, err := fs.OpenCmd(fs.Session.pwd, name)
+		flags := O_RDWR
+		mode := DEFAULT_FILE_MODE
+		if len(args) > 1 {
+			var err error
+			flags, err = ParseOpenFlags(args[1].(string))
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(args) > 2 {
+			m, err := strconv.ParseUint(args[2].(string), 8, 16)
+			if err != nil {
+				return nil, errors.New("mode should be octal")
+			}
+			mode = uint16(m)
+		}
+		fkay, err := r.fs.Open(r.fs.Session.pwd, name, flags, mode)
 		if err != nil {
 			return nil, err
 		}
-		fmt.Printf("fd = %v\n", fkay)
-		return nil, err
-	}))
-	write := action.New("write", errorify(func(args ...interface{}) (interface{}, error) {
+		if r.json {
+			return fkay, printJSON(r.out, FdInfo{Fd: fkay})
+		}
+		fmt.Fprintf(r.out, "fd = %v\n", fkay)
+		return fkay, err
+	})
+	r.AddAction("write", "[-x|-b] fd data...|< host-file", "write at the location of the fd", func(args ...interface{}) (interface{}, error) {
+		mode, args := parseDataMode(args)
 		if len(args) < 2 {
-			return nil, errors.New("need fd and data")
+			return nil, errors.New("need optional -x or -b, fd and data or < host-file")
+		}
+		fd, err := parseFkey(args[0].(string))
+		if err != nil {
+			return nil, err
 		}
-		fd := args[0].(string)
-		data := ""
-		for _, str := range args[1:] {
-			subStr := str.(string)
-			data += subStr
-			data += " "
+		// the words are joined like echo does
+		words := []string{}
+		for _, arg := range args[1:] {
+			words = append(words, arg.(string))
+		}
+		data, err := mode.decode(strings.Join(words, " "))
+		if err != nil {
+			return nil, err
 		}
-		err := fs.WriteCmd(Fkey(fd), data)
+		err = r.fs.WriteCmd(fd, string(data))
 		return nil, err
-	}))
-	read := action.New("read", errorify(func(args ...interface{}) (interface{}, error) {
+	})
+	r.AddAction("read", "[-x|-b] fd length", "read from the location of the fd", func(args ...interface{}) (interface{}, error) {
+		mode, args := parseDataMode(args)
 		if len(args) != 2 {
-			return nil, errors.New("need fd and length")
+			return nil, errors.New("need optional -x or -b, fd and length")
+		}
+		fd, err := parseFkey(args[0].(string))
+		if err != nil {
+			return nil, err
 		}
-		fd := args[0].(string)
 		lengthStr := args[1].(string)
 		length, err := strconv.Atoi(lengthStr)
 		if err != nil {
 			return nil, errors.New("length should be int")
 		}
-		string, err := fs.ReadCmd(Fkey(fd), int64(length))
+		data, err := r.fs.ReadCmd(fd, int64(length))
 		if err != nil {
 			return nil, err
 		}
-		fmt.Println(string)
-		return nil, nil
-	}))
-	seek := action.New("seek", errorify(func(args ...interface{}) (interface{}, error) {
+		text := mode.encode([]byte(data))
+		if r.json {
+			return text, printJSON(r.out, newDataInfo(fd, []byte(data), mode))
+		}
+		fmt.Fprintln(r.out, text)
+		return text, nil
+	})
+	r.AddAction("seek", "fd offset", "move the location of the fd", func(args ...interface{}) (interface{}, error) {
 		if len(args) != 2 {
 			return nil, errors.New("need fd and offset")
 		}
-		fd := args[0].(string)
+		fd, err := parseFkey(args[0].(string))
+		if err != nil {
+			return nil, err
+		}
 		offsetStr := args[1].(string)
 		offset, err := strconv.Atoi(offsetStr)
 		if err != nil {
 			return nil, errors.New("length should be int")
 		}
-		err = fs.SeekCmd(Fkey(fd), int64(offset))
+		err = r.fs.SeekCmd(fd, int64(offset))
 		return nil, err
-	}))
-	close := action.New("close", errorify(func(args ...interface{}) (interface{}, error) {
+	})
+	r.AddAction("close", "fd", "close the fd", func(args ...interface{}) (interface{}, error) {
 		if len(args) != 1 {
 			return nil, errors.New("need fd ")
 		}
-		fd := args[0].(string)
-		err := fs.CloseCmd(Fkey(fd))
+		fd, err := parseFkey(args[0].(string))
+		if err != nil {
+			return nil, err
+		}
+		err = r.fs.CloseCmd(fd)
 		return nil, err
-	}))
-	mkfs := action.New("mkfs", errorify(func(args ...interface{}) (interface{}, error) {
+	})
+	r.AddAction("mkfs", "[-e] n", "make a new image with n inodes in place of this one, -e encrypted", func(args ...interface{}) (interface{}, error) {
+		encrypt := len(args) > 0 && args[0].(string) == "-e"
+		if encrypt {
+			args = args[1:]
+		}
 		if len(args) != 1 {
-			return nil, errors.New("need n")
+			return nil, errors.New("need optional -e, n")
 		}
 		nStr := args[0].(string)
 		n, err := strconv.Atoi(nStr)
 		if err != nil {
 			return nil, errors.New("n should be int")
 		}
-		f, err := NewFileSystem(int64(n), "fs")
+		// the image of a read-only session isn't replaced either
+		if r.fs.Options.ReadOnly {
+			return nil, ErrReadOnly
+		}
+		opts := r.fs.Options
+		if encrypt {
+			opts.Passphrase, err = r.passphrase()
+			if err != nil {
+				return nil, err
+			}
+		}
+		// a host file is replaced by a new one, other devices are
+		// formatted in place and stay open
+		dev := r.fs.Device
+		file, ok := dev.(*FileDevice)
+		if !ok {
+			return nil, r.swap(func() (*FileSystem, error) {
+				return Format(dev, int64(n), opts)
+			}, false)
+		}
+		return nil, r.swap(func() (*FileSystem, error) {
+			return replaceImage(file.Name(), int64(n), opts)
+		}, true)
+	})
+	r.AddAction("mount", "[-r] path", "mount another image, -r read-only", func(args ...interface{}) (interface{}, error) {
+		opts := r.fs.Options
+		opts.ReadOnly = len(args) > 0 && args[0].(string) == "-r"
+		if opts.ReadOnly {
+			args = args[1:]
+		}
+		if len(args) != 1 {
+			return nil, errors.New("need optional -r, path")
+		}
+		path := args[0].(string)
+		return nil, r.swap(func() (*FileSystem, error) {
+			// the passphrase is asked for only when the image is encrypted
+			opts.Passphrase = os.Getenv(PASSPHRASE_ENV)
+			fs, err := OpenFileSystem(path, opts)
+			if errors.Is(err, ErrKeyRequired) && r.rl != nil {
+				opts.Passphrase, err = r.passphrase()
+				if err == nil {
+					fs, err = OpenFileSystem(path, opts)
+				}
+			}
+			return fs, err
+		}, true)
+	})
+	r.AddAction("cache", "", "show the cache counters", func(args ...interface{}) (interface{}, error) {
+		stats := r.fs.CacheStats()
+		fmt.Fprintln(r.out, "cache\thits\tmisses\tdirty")
+		fmt.Fprintf(r.out, "blocks\t%v\t%v\t%v\n", stats.BlockHits, stats.BlockMisses, stats.BlockDirty)
+		fmt.Fprintf(r.out, "inodes\t%v\t%v\t%v\n", stats.InodeHits, stats.InodeMisses, stats.InodeDirty)
+		return nil, nil
+	})
+	r.AddAction("sync", "", "write everything to the disk", func(args ...interface{}) (interface{}, error) {
+		err := r.fs.Sync()
+		return nil, err
+	})
+	r.AddAction("fsync", "[-d] fd", "write the file to the disk, -d only its data", func(args ...interface{}) (interface{}, error) {
+		if len(args) == 2 && args[0].(string) == "-d" {
+			fd, err := parseFkey(args[1].(string))
+			if err != nil {
+				return nil, err
+			}
+			return nil, r.fs.Fdatasync(fd)
+		}
+		if len(args) != 1 {
+			return nil, errors.New("need fd, -d to sync only data")
+		}
+		fd, err := parseFkey(args[0].(string))
 		if err != nil {
 			return nil, err
 		}
-		fs = &f
+		return nil, r.fs.Fsync(fd)
+	})
+	r.AddAction("setxattr", "name attribute value", "set an extended attribute", func(args ...interface{}) (interface{}, error) {
+		if len(args) != 3 {
+			return nil, errors.New("need name, attribute and value")
+		}
+		name := args[0].(string)
+		attr := args[1].(string)
+		value := args[2].(string)
+		err := r.fs.SetXattrCmd(r.fs.Session.pwd, name, attr, []byte(value), 0)
 		return nil, err
-	}))
-	repl := gorpl.New(";")
-	repl.AddAction(*exitAction)
-	repl.AddAction(*create)
-	repl.AddAction(*ls)
-	repl.AddAction(*link)
-	repl.AddAction(*unlink)
-	repl.AddAction(*truncate)
-	repl.AddAction(*stat)
-	repl.AddAction(*open)
-	repl.AddAction(*write)
-	repl.AddAction(*read)
-	repl.AddAction(*seek)
-	repl.AddAction(*close)
-	repl.AddAction(*mkfs)
-	return repl
+	})
+	r.AddAction("getxattr", "name attribute", "show an extended attribute", func(args ...interface{}) (interface{}, error) {
+		if len(args) != 2 {
+			return nil, errors.New("need name and attribute")
+		}
+		name := args[0].(string)
+		attr := args[1].(string)
+		value, err := r.fs.GetXattrCmd(r.fs.Session.pwd, name, attr)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(r.out, "%q\n", value)
+		return value, nil
+	})
+	r.AddAction("listxattr", "name", "list the extended attributes", func(args ...interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, errors.New("need name")
+		}
+		name := args[0].(string)
+		names, err := r.fs.ListXattrCmd(r.fs.Session.pwd, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, attr := range names {
+			fmt.Fprintln(r.out, attr)
+		}
+		return names, nil
+	})
+	r.AddAction("removexattr", "name attribute", "remove an extended attribute", func(args ...interface{}) (interface{}, error) {
+		if len(args) != 2 {
+			return nil, errors.New("need name and attribute")
+		}
+		name := args[0].(string)
+		attr := args[1].(string)
+		err := r.fs.RemoveXattrCmd(r.fs.Session.pwd, name, attr)
+		return nil, err
+	})
+	r.AddAction("mkdir", "name", "make a directory", func(args ...interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, errors.New("need name")
+		}
+		name := args[0].(string)
+		err := r.fs.MkdirCmd(r.fs.Session.pwd, name)
+		return nil, err
+	})
+	r.AddAction("getfacl", "name", "show the ACL", func(args ...interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, errors.New("need name")
+		}
+		name := args[0].(string)
+		stat, err := r.fs.StatCmd(r.fs.Session.pwd, name)
+		if err != nil {
+			return nil, err
+		}
+		acl, err := r.fs.GetACLCmd(r.fs.Session.pwd, name, ACL_TYPE_ACCESS)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(r.out, "# file: %s\n", name)
+		fmt.Fprintf(r.out, "# owner: %v\n", stat.uid)
+		fmt.Fprintf(r.out, "# group: %v\n", stat.gid)
+		fmt.Fprintln(r.out, acl)
+		if stat.ftype == DIRECTORY {
+			def, err := r.fs.GetACLCmd(r.fs.Session.pwd, name, ACL_TYPE_DEFAULT)
+			if err != nil {
+				return nil, err
+			}
+			for _, line := range strings.Split(def.String(), "\n") {
+				if line != "" {
+					fmt.Fprintf(r.out, "default:%s\n", line)
+				}
+			}
+		}
+		return acl, nil
+	})
+	r.AddAction("setfacl", "[-d] -m entries|-x entries|-b|-k name", "change the ACL", func(args ...interface{}) (interface{}, error) {
+		usage := errors.New("need [-d] -m entries, -x entries, -b or -k, and name")
+		kind := ACL_TYPE_ACCESS
+		if len(args) > 0 && args[0].(string) == "-d" {
+			kind = ACL_TYPE_DEFAULT
+			args = args[1:]
+		}
+		if len(args) < 2 {
+			return nil, usage
+		}
+		op := args[0].(string)
+		name := args[len(args)-1].(string)
+		switch op {
+		case "-b":
+			// remove the extended entries and the default ACL
+			err := r.fs.SetACLCmd(r.fs.Session.pwd, name, ACL_TYPE_ACCESS, nil)
+			if err != nil {
+				return nil, err
+			}
+			stat, err := r.fs.StatCmd(r.fs.Session.pwd, name)
+			if err != nil || stat.ftype != DIRECTORY {
+				return nil, err
+			}
+			return nil, r.fs.SetACLCmd(r.fs.Session.pwd, name, ACL_TYPE_DEFAULT, nil)
+		case "-k":
+			return nil, r.fs.SetACLCmd(r.fs.Session.pwd, name, ACL_TYPE_DEFAULT, nil)
+		case "-m", "-x":
+			if len(args) != 3 {
+				return nil, usage
+			}
+		default:
+			return nil, usage
+		}
+		entries := []ACLEntry{}
+		for _, str := range strings.Split(args[1].(string), ",") {
+			entry, err := ParseACLEntry(str, op == "-m")
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		}
+		acl, err := r.fs.GetACLCmd(r.fs.Session.pwd, name, kind)
+		if err != nil {
+			return nil, err
+		}
+		// the default ACL starts from the access one, like in setfacl
+		if acl == nil {
+			acl, err = r.fs.GetACLCmd(r.fs.Session.pwd, name, ACL_TYPE_ACCESS)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if op == "-m" {
+			acl = acl.Modify(entries)
+		} else {
+			acl = acl.Remove(entries)
+		}
+		return nil, r.fs.SetACLCmd(r.fs.Session.pwd, name, kind, acl)
+	})
+	r.AddAction("su", "uid [gid [groups...]]", "change the credentials of the session", func(args ...interface{}) (interface{}, error) {
+		if len(args) < 1 {
+			return nil, errors.New("need uid, optional gid and groups")
+		}
+		ids := []uint32{}
+		for _, arg := range args {
+			id, err := strconv.ParseUint(arg.(string), 10, 32)
+			if err != nil {
+				return nil, errors.New("ids should be int")
+			}
+			ids = append(ids, uint32(id))
+		}
+		r.fs.Session.uid = ids[0]
+		r.fs.Session.gid = ids[0]
+		r.fs.Session.groups = nil
+		if len(ids) > 1 {
+			r.fs.Session.gid = ids[1]
+			r.fs.Session.groups = ids[2:]
+		}
+		return nil, nil
+	})
+	r.AddAction("id", "", "show the credentials of the session", func(args ...interface{}) (interface{}, error) {
+		fmt.Fprintf(r.out, "uid=%v gid=%v groups=%v\n", r.fs.Session.uid, r.fs.Session.gid, r.fs.Session.groups)
+		return nil, nil
+	})
+	r.AddAction("snapshot", "create|delete|rollback name | list", "manage the snapshots", func(args ...interface{}) (interface{}, error) {
+		usage := errors.New("need create, delete or rollback and name, or list")
+		if len(args) == 1 && args[0].(string) == "list" {
+			names, err := r.fs.ListSnapshots()
+			if err != nil {
+				return nil, err
+			}
+			for _, name := range names {
+				fmt.Fprintln(r.out, name)
+			}
+			return names, nil
+		}
+		if len(args) != 2 {
+			return nil, usage
+		}
+		name := args[1].(string)
+		switch args[0].(string) {
+		case "create":
+			return nil, r.fs.CreateSnapshot(name)
+		case "delete":
+			return nil, r.fs.DeleteSnapshot(name)
+		case "rollback":
+			return nil, r.fs.RollbackSnapshot(name)
+		}
+		return nil, usage
+	})
+	r.AddAction("cp", "[--reflink] from to", "copy a file", func(args ...interface{}) (interface{}, error) {
+		reflink := false
+		if len(args) > 0 && args[0].(string) == "--reflink" {
+			reflink = true
+			args = args[1:]
+		}
+		if len(args) != 2 {
+			return nil, errors.New("need optional --reflink, from and to")
+		}
+		from := args[0].(string)
+		to := args[1].(string)
+		err := r.fs.CopyCmd(r.fs.Session.pwd, from, to, reflink)
+		return nil, err
+	})
+	r.AddAction("chattr", "+c|-c name", "turn the compression on or off", func(args ...interface{}) (interface{}, error) {
+		if len(args) != 2 || (args[0].(string) != "+c" && args[0].(string) != "-c") {
+			return nil, errors.New("need +c or -c and name")
+		}
+		on := args[0].(string) == "+c"
+		name := args[1].(string)
+		err := r.fs.SetCompressionCmd(r.fs.Session.pwd, name, on)
+		return nil, err
+	})
+	r.AddAction("dedupe", "", "share the blocks with the same content", func(args ...interface{}) (interface{}, error) {
+		saved, err := r.fs.Dedupe()
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(r.out, "saved %v bytes\n", saved)
+		return saved, nil
+	})
+	r.AddAction("quota", "[set user|project id bsoft bhard isoft ihard | grace blocks inodes]", "show or set the quotas", func(args ...interface{}) (interface{}, error) {
+		usage := errors.New("need nothing, set user|project id bsoft bhard isoft ihard, or grace blocks inodes")
+		if len(args) == 0 {
+			reports := r.fs.Quotas()
+			fmt.Fprintln(r.out, "type\tid\tblocks\tsoft\thard\tgrace\tinodes\tsoft\thard\tgrace")
+			for _, q := range reports {
+				fmt.Fprintf(r.out, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", q.Type, q.Id,
+					q.Blocks, q.SoftBlocks, q.HardBlocks, formatGrace(q.BlockGrace),
+					q.Inodes, q.SoftInodes, q.HardInodes, formatGrace(q.InodeGrace))
+			}
+			return reports, nil
+		}
+		switch args[0].(string) {
+		case "set":
+			if len(args) != 7 {
+				return nil, usage
+			}
+			key := QuotaKey{}
+			switch args[1].(string) {
+			case "user":
+				key.Type = USER_QUOTA
+			case "project":
+				key.Type = PROJECT_QUOTA
+			default:
+				return nil, usage
+			}
+			id, err := strconv.ParseUint(args[2].(string), 10, 32)
+			if err != nil {
+				return nil, errors.New("id should be int")
+			}
+			key.Id = uint32(id)
+			limits := make([]int64, 4)
+			for i := range limits {
+				limits[i], err = strconv.ParseInt(args[3+i].(string), 10, 64)
+				if err != nil {
+					return nil, errors.New("limits should be int")
+				}
+			}
+			return nil, r.fs.SetQuota(key, QuotaLimits{
+				SoftBlocks: limits[0],
+				HardBlocks: limits[1],
+				SoftInodes: limits[2],
+				HardInodes: limits[3],
+			})
+		case "grace":
+			if len(args) != 3 {
+				return nil, usage
+			}
+			blocks, err := time.ParseDuration(args[1].(string))
+			if err != nil {
+				return nil, err
+			}
+			inodes, err := time.ParseDuration(args[2].(string))
+			if err != nil {
+				return nil, err
+			}
+			return nil, r.fs.SetQuotaGrace(blocks, inodes)
+		}
+		return nil, usage
+	})
+	r.AddAction("project", "id name", "move a tree to a project", func(args ...interface{}) (interface{}, error) {
+		if len(args) != 2 {
+			return nil, errors.New("need project id and name")
+		}
+		id, err := strconv.ParseUint(args[0].(string), 10, 32)
+		if err != nil {
+			return nil, errors.New("project id should be int")
+		}
+		name := args[1].(string)
+		return nil, r.fs.SetProjectCmd(r.fs.Session.pwd, name, uint32(id))
+	})
+	r.AddAction("df", "", "show the free blocks and inodes", func(args ...interface{}) (interface{}, error) {
+		stat := r.fs.StatFS()
+		if r.json {
+			return stat, printJSON(r.out, stat)
+		}
+		printStatFS(r.out, stat)
+		return stat, nil
+	})
+	r.AddAction("trim", "", "give the free blocks back to the host", func(args ...interface{}) (interface{}, error) {
+		trimmed, err := r.fs.Trim()
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(r.out, "%v blocks trimmed\n", trimmed)
+		return trimmed, nil
+	})
+	r.AddAction("fsck", "", "check the image", func(args ...interface{}) (interface{}, error) {
+		report, err := r.fs.Fsck()
+		if err != nil {
+			return nil, err
+		}
+		for _, problem := range report.Problems {
+			fmt.Fprintln(r.out, problem)
+		}
+		fmt.Fprintf(r.out, "%v inodes, %v blocks checked, %v problems\n",
+			report.Inodes, report.Blocks, len(report.Problems))
+		return report, nil
+	})
+	r.AddAction("cat", "name...", "print files", func(args ...interface{}) (interface{}, error) {
+		if len(args) == 0 {
+			return nil, errors.New("need names")
+		}
+		for _, arg := range args {
+			data, err := r.fs.GetCmd(r.fs.Session.pwd, arg.(string))
+			if err != nil {
+				return nil, err
+			}
+			r.out.Write(data)
+		}
+		return nil, nil
+	})
+	r.AddAction("head", "[-n lines|-c bytes] name", "print the start of a file", func(args ...interface{}) (interface{}, error) {
+		count, lines, args, err := parseCount(args)
+		if err != nil {
+			return nil, err
+		}
+		if len(args) != 1 {
+			return nil, errors.New("need optional -n lines or -c bytes, and name")
+		}
+		data, err := r.fs.HeadCmd(r.fs.Session.pwd, args[0].(string), count, lines)
+		if err != nil {
+			return nil, err
+		}
+		r.out.Write(data)
+		return nil, nil
+	})
+	r.AddAction("tail", "[-n lines|-c bytes] name", "print the end of a file", func(args ...interface{}) (interface{}, error) {
+		count, lines, args, err := parseCount(args)
+		if err != nil {
+			return nil, err
+		}
+		if len(args) != 1 {
+			return nil, errors.New("need optional -n lines or -c bytes, and name")
+		}
+		data, err := r.fs.TailCmd(r.fs.Session.pwd, args[0].(string), count, lines)
+		if err != nil {
+			return nil, err
+		}
+		r.out.Write(data)
+		return nil, nil
+	})
+	r.AddAction("echo", "[-n] words...", "print the words", func(args ...interface{}) (interface{}, error) {
+		newline := true
+		if len(args) > 0 && args[0].(string) == "-n" {
+			newline = false
+			args = args[1:]
+		}
+		words := []string{}
+		for _, arg := range args {
+			words = append(words, arg.(string))
+		}
+		fmt.Fprint(r.out, strings.Join(words, " "))
+		if newline {
+			fmt.Fprintln(r.out)
+		}
+		return nil, nil
+	})
+	r.AddAction("set", "json on|off", "change a setting of the REPL", func(args ...interface{}) (interface{}, error) {
+		if len(args) != 2 || args[0].(string) != "json" {
+			return nil, errors.New("need json and on or off")
+		}
+		switch args[1].(string) {
+		case "on":
+			r.json = true
+		case "off":
+			r.json = false
+		default:
+			return nil, errors.New("need on or off")
+		}
+		return nil, nil
+	})
+	r.AddAction("source", "[-k] script|-", "run the commands of a host file, -k goes on after errors", func(args ...interface{}) (interface{}, error) {
+		keepGoing := len(args) > 0 && args[0].(string) == "-k"
+		if keepGoing {
+			args = args[1:]
+		}
+		if len(args) != 1 {
+			return nil, errors.New("need optional -k to continue after errors and script")
+		}
+		return nil, r.SourceFile(args[0].(string), keepGoing)
+	})
+	return r
 }
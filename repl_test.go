@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestRepl returns a REPL on a new image in a temporary directory, its
+// output goes to the buffer
+func newTestRepl(t *testing.T) (*Repl, *bytes.Buffer) {
+	t.Helper()
+	fs, err := NewFileSystem(64, filepath.Join(t.TempDir(), "img"), MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRepl(fs)
+	out := &bytes.Buffer{}
+	r.out = out
+	t.Cleanup(func() { r.FileSystem().Close() })
+	return r, out
+}
+
+func TestReplMountFailureKeepsImage(t *testing.T) {
+	r, out := newTestRepl(t)
+	old := r.FileSystem()
+	if err := r.Exec("mount /nonexistent/img"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("mount of a missing image: %v", err)
+	}
+	if r.FileSystem() != old {
+		t.Fatal("the image was replaced by a failed mount")
+	}
+	for _, line := range []string{"create b", "ls"} {
+		if err := r.Exec(line); err != nil {
+			t.Fatalf("%s after a failed mount: %v", line, err)
+		}
+	}
+	if !strings.Contains(out.String(), "b") {
+		t.Fatalf("ls shows %q", out.String())
+	}
+}
+
+func TestReplMountSameImage(t *testing.T) {
+	r, out := newTestRepl(t)
+	path := r.FileSystem().Device.(*FileDevice).Name()
+	for _, line := range []string{"create a", "unlink a", "create b", "mount " + path, "ls"} {
+		if err := r.Exec(line); err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+	}
+	if out.String() != "b\n" {
+		t.Fatalf("ls after the remount shows %q", out.String())
+	}
+	report, err := r.FileSystem().Fsck()
+	if err != nil || len(report.Problems) != 0 {
+		t.Fatal(err, report.Problems)
+	}
+}
+
+func TestReplMkfsReplacesImage(t *testing.T) {
+	r, out := newTestRepl(t)
+	path := r.FileSystem().Device.(*FileDevice).Name()
+	if err := r.Exec("create a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Exec("mkfs x"); err == nil {
+		t.Fatal("mkfs with a bad count succeeded")
+	}
+	for _, line := range []string{"mkfs 16", "create b", "ls"} {
+		if err := r.Exec(line); err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+	}
+	if out.String() != "b\n" {
+		t.Fatalf("ls after mkfs shows %q", out.String())
+	}
+	if r.FileSystem().Device.(*FileDevice).Name() != path {
+		t.Fatal("the new image isn't at the path of the old one")
+	}
+	if _, err := os.Stat(path + ".mkfs"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("the temporary image is left: %v", err)
+	}
+}
+
+func TestReplMkfsInPlace(t *testing.T) {
+	dev := NewMemoryDevice(ImageSize(64))
+	fs, err := Format(dev, 64, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRepl(fs)
+	r.out = &bytes.Buffer{}
+	defer func() { r.FileSystem().Close() }()
+	if err := r.Exec("create a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Exec("mkfs 100000"); !errors.Is(err, ErrDeviceTooSmall) {
+		t.Fatalf("mkfs bigger than the device: %v", err)
+	}
+	if _, err := r.FileSystem().StatCmd(r.FileSystem().Session.pwd, "a"); err != nil {
+		t.Fatalf("the image is lost after a failed mkfs: %v", err)
+	}
+	if err := r.Exec("mkfs 16"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.FileSystem().StatCmd(r.FileSystem().Session.pwd, "a"); err == nil {
+		t.Fatal("the old file is in the new image")
+	}
+}
+
+func TestReplMkfsReadOnly(t *testing.T) {
+	r, out := newTestRepl(t)
+	path := r.FileSystem().Device.(*FileDevice).Name()
+	if err := r.Exec("create keep"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Exec("mount -r " + path); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Exec("mkfs 16"); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("mkfs on a read-only image: %v", err)
+	}
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Fatal("the read-only image was changed")
+	}
+	if err := r.Exec("ls"); err != nil || out.String() != "keep\n" {
+		t.Fatalf("ls after mkfs shows %q: %v", out.String(), err)
+	}
+}
+
+func TestReplEncryptedImage(t *testing.T) {
+	r, out := newTestRepl(t)
+	path := r.FileSystem().Device.(*FileDevice).Name()
+	// the passphrase isn't taken from the line, it would be in the history
+	if err := r.Exec("mount " + path + " pw"); err == nil {
+		t.Fatal("mount took a passphrase")
+	}
+	t.Setenv(PASSPHRASE_ENV, "")
+	if err := r.Exec("mkfs -e 16"); !errors.Is(err, ErrKeyRequired) {
+		t.Fatalf("mkfs -e without a passphrase: %v", err)
+	}
+	t.Setenv(PASSPHRASE_ENV, "pw")
+	for _, line := range []string{"mkfs -e 16", "create a"} {
+		if err := r.Exec(line); err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+	}
+	t.Setenv(PASSPHRASE_ENV, "")
+	if err := r.Exec("mount " + path); !errors.Is(err, ErrKeyRequired) {
+		t.Fatalf("mount without a passphrase: %v", err)
+	}
+	t.Setenv(PASSPHRASE_ENV, "pw")
+	for _, line := range []string{"mount " + path, "ls"} {
+		if err := r.Exec(line); err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+	}
+	if out.String() != "a\n" {
+		t.Fatalf("ls shows %q", out.String())
+	}
+}
+
+func TestReplReadLength(t *testing.T) {
+	r, out := newTestRepl(t)
+	for _, line := range []string{"fd = open a O_RDWR|O_CREAT", "write $fd hello", "seek $fd 0"} {
+		if err := r.Exec(line); err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+	}
+	if err := r.Exec("read $fd -1"); !errors.Is(err, ErrInvalidSize) {
+		t.Fatalf("read of a negative length: %v", err)
+	}
+	out.Reset()
+	// a length past any file reads to the end
+	if err := r.Exec("read $fd 9223372036854775807"); err != nil || out.String() != "hello\n" {
+		t.Fatalf("read %q: %v", out.String(), err)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// A script has one REPL command per line, "#" starts a comment line.
+// Variables hold what a command returns, so the fds can be used later:
+//
+//	# fixture
+//	fd = open notes.txt O_RDWR|O_CREAT
+//	write $fd hello
+//	close $fd
+
+// MAX_SOURCE_DEPTH stops scripts that source themselves
+const MAX_SOURCE_DEPTH = 16
+
+var ErrSourceDepth error = errors.New("scripts are nested too deep")
+
+// ScriptError is a failed line of a script
+type ScriptError struct {
+	File string
+	Line int
+	Err  error
+}
+
+func (e *ScriptError) Error() string {
+	return fmt.Sprintf("%s:%v: %v", e.File, e.Line, e.Err)
+}
+
+func (e *ScriptError) Unwrap() error {
+	return e.Err
+}
+
+// Source runs the lines of the script. It stops at the first failed line,
+// with keepGoing the rest is run and all the failures are returned.
+func (r *Repl) Source(name string, script io.Reader, keepGoing bool) error {
+	if r.depth >= MAX_SOURCE_DEPTH {
+		return ErrSourceDepth
+	}
+	r.depth++
+	defer func() { r.depth-- }()
+	var errs []error
+	scanner := bufio.NewScanner(script)
+	for line := 1; !r.done && scanner.Scan(); line++ {
+		err := r.Exec(scanner.Text())
+		if err == nil {
+			continue
+		}
+		err = &ScriptError{File: name, Line: line, Err: err}
+		if !keepGoing {
+			return err
+		}
+		errs = append(errs, err)
+	}
+	err := scanner.Err()
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// SourceFile runs the script from the host file, "-" is stdin
+func (r *Repl) SourceFile(path string, keepGoing bool) error {
+	if path == "-" {
+		return r.Source("stdin", os.Stdin, keepGoing)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return r.Source(path, file, keepGoing)
+}
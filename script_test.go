@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSourceVariables(t *testing.T) {
+	r, _ := newTestRepl(t)
+	script := strings.Join([]string{
+		"# make a file through its fd",
+		"fd = open notes O_RDWR|O_CREAT",
+		"write $fd hello",
+		"",
+		"close $fd",
+	}, "\n")
+	if err := r.Source("fixture", strings.NewReader(script), false); err != nil {
+		t.Fatal(err)
+	}
+	fs := r.FileSystem()
+	if data, err := fs.GetCmd(fs.Session.pwd, "notes"); err != nil || string(data) != "hello" {
+		t.Fatalf("the script wrote %q: %v", data, err)
+	}
+	if r.vars["fd"] == "" {
+		t.Fatal("the fd isn't kept")
+	}
+}
+
+func TestSourceKeepGoing(t *testing.T) {
+	script := "create a\nunlink missing\ncreate b\nfoo\n"
+	r, _ := newTestRepl(t)
+	err := r.Source("fixture", strings.NewReader(script), false)
+	var scriptErr *ScriptError
+	if !errors.As(err, &scriptErr) || scriptErr.File != "fixture" || scriptErr.Line != 2 {
+		t.Fatalf("failed script: %v", err)
+	}
+	if _, err := r.FileSystem().Lookup(r.FileSystem().Superblock.Root, "b"); err == nil {
+		t.Fatal("the script went on after the failed line")
+	}
+	// with keepGoing every line runs and both failures are returned
+	r, _ = newTestRepl(t)
+	err = r.Source("fixture", strings.NewReader(script), true)
+	if err == nil || !strings.Contains(err.Error(), "fixture:2:") || !strings.Contains(err.Error(), "fixture:4:") {
+		t.Fatalf("failed script: %v", err)
+	}
+	if !errors.Is(err, ErrUnknownCommand) {
+		t.Fatalf("the unknown command isn't in %v", err)
+	}
+	if _, err := r.FileSystem().Lookup(r.FileSystem().Superblock.Root, "b"); err != nil {
+		t.Fatalf("the line after the failure didn't run: %v", err)
+	}
+}
+
+func TestSourceDepth(t *testing.T) {
+	r, _ := newTestRepl(t)
+	path := filepath.Join(t.TempDir(), "self")
+	if err := os.WriteFile(path, []byte("source "+path+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SourceFile(path, false); !errors.Is(err, ErrSourceDepth) {
+		t.Fatalf("script that sources itself: %v", err)
+	}
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// the snapshots are reachable as /.snapshots/<name>, the entry is hidden
+// from the listing of the root directory
+const SNAPSHOTS_DIR = ".snapshots"
+
+var ErrReadOnlySnapshot error = newError("snapshot is read-only", syscall.EROFS)
+
+// A snapshot is a copy of the inodes of the tree. The data blocks aren't
+// copied, the snapshot takes a reference to them and Write copies a shared
+// block before it's changed. The snapshot inodes have FLAG_SNAPSHOT, so
+// they can be read but not changed.
+//
+// The snapshot operations are serialized by f.locks.snapshots, the tree is
+// copied one inode at a time. A copy that fails half way is freed again,
+// and a copy needs a free inode for every file of the tree, so it's
+// checked up front.
+
+func checkSnapshotName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return ErrInvalidPath
+	}
+	return nil
+}
+
+// snapshotsInode returns the directory of the snapshots or NO_INODE
+func (f *FileSystem) snapshotsInode() int64 {
+	f.locks.superblock.Lock()
+	defer f.locks.superblock.Unlock()
+	return f.Superblock.Snapshots
+}
+
+// snapshotsDir returns the directory of the snapshots, it's created on the
+// first use
+func (f *FileSystem) snapshotsDir() (int64, error) {
+	if id := f.snapshotsInode(); id != NO_INODE {
+		return id, nil
+	}
+	rootLock := f.locks.Inode(f.Superblock.Root)
+	rootLock.Lock()
+	defer rootLock.Unlock()
+	root, err := f.ReadInode(f.Superblock.Root)
+	if err != nil {
+		return -1, err
+	}
+	dir, err := f.AllocateDirectory(Inode{mode: 0555, flags: FLAG_SNAPSHOT})
+	if err != nil {
+		return -1, err
+	}
+	err = f.AddFile(&dir, ".", &dir)
+	if err != nil {
+		return -1, err
+	}
+	err = f.AddFile(&dir, "..", &root)
+	if err != nil {
+		return -1, err
+	}
+	// the directory has to be on disk before the superblock points to it
+	err = f.inodes.FlushKey(dir.id)
+	if err != nil {
+		return -1, err
+	}
+	f.locks.superblock.Lock()
+	f.Superblock.Snapshots = dir.id
+	f.locks.superblock.Unlock()
+	return dir.id, f.WriteSuperblock()
+}
+
+// copyInode makes a new inode with the attributes, the data and the
+// extended attributes of the source, the caller holds the lock of the
+// source. Directories get only ".", the entries are added by copyTree.
+func (f *FileSystem) copyInode(src *Inode, frozen bool) (*Inode, error) {
+	// the frozen copies aren't charged to the owners
+	template := Inode{
+		mode:    src.mode,
+		flags:   src.flags &^ FLAG_SNAPSHOT,
+		uid:     src.uid,
+		gid:     src.gid,
+		project: src.project,
+	}
+	if frozen {
+		template.flags |= FLAG_SNAPSHOT
+	}
+	var inode Inode
+	var err error
+	if src.fileType == DIRECTORY {
+		inode, err = f.AllocateDirectory(template)
+	} else {
+		inode, err = f.AllocateInode(template)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = f.fillCopy(src, &inode)
+	if err != nil {
+		f.DeallocateInode(&inode)
+		return nil, err
+	}
+	return &inode, nil
+}
+
+func (f *FileSystem) fillCopy(src *Inode, inode *Inode) error {
+	if src.fileType == REGULAR {
+		err := f.shareBlocks(src, inode)
+		if err != nil {
+			return err
+		}
+	}
+	attrs, err := f.readXattrs(src)
+	if err != nil {
+		return err
+	}
+	err = f.writeXattrs(inode, attrs)
+	if err != nil {
+		return err
+	}
+	if inode.fileType == DIRECTORY {
+		return f.AddFile(inode, ".", inode)
+	}
+	return nil
+}
+
+// dropCopies frees the copies of a copyTree that failed, nothing links to
+// them yet
+func (f *FileSystem) dropCopies(copies map[int64]*Inode) {
+	for _, copied := range copies {
+		f.DeallocateInode(copied)
+	}
+}
+
+// checkFreeInodes fails with ErrNoInodes when there are fewer free inodes
+// than files under src, plus extra
+func (f *FileSystem) checkFreeInodes(src int64, extra int64) error {
+	seen := map[int64]bool{}
+	err := f.countTree(src, seen)
+	if err != nil {
+		return err
+	}
+	f.locks.inodeBitmap.Lock()
+	free := f.freeInodes
+	f.locks.inodeBitmap.Unlock()
+	if int64(len(seen))+extra > free {
+		return ErrNoInodes
+	}
+	return nil
+}
+
+// countTree adds the file and everything under it to seen
+func (f *FileSystem) countTree(src int64, seen map[int64]bool) error {
+	seen[src] = true
+	lock := f.locks.Inode(src)
+	lock.RLock()
+	inode, err := f.ReadInode(src)
+	var entries []Entry
+	if err == nil && inode.fileType == DIRECTORY {
+		entries, err = f.ReadDirectory(&inode)
+	}
+	lock.RUnlock()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name == "." || entry.Name == ".." || seen[entry.Inode] {
+			continue
+		}
+		err = f.countTree(entry.Inode, seen)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyTree copies the file and everything under it. Nobody else can reach
+// the copies until they're linked, so only the sources are locked. Files
+// with several links are copied once, copies maps the source inodes to
+// their copies. On failure the copies made so far are in copies, for
+// dropCopies.
+func (f *FileSystem) copyTree(src int64, frozen bool, copies map[int64]*Inode) (*Inode, error) {
+	lock := f.locks.Inode(src)
+	lock.RLock()
+	inode, err := f.ReadInode(src)
+	if err == nil && inode.linkCount == 0 {
+		// it was unlinked in the meantime
+		err = ErrFileNotFound
+	}
+	var entries []Entry
+	if err == nil && inode.fileType == DIRECTORY {
+		entries, err = f.ReadDirectory(&inode)
+	}
+	var copied *Inode
+	if err == nil {
+		copied, err = f.copyInode(&inode, frozen)
+	}
+	lock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	copies[src] = copied
+	for _, entry := range entries {
+		if entry.Name == "." || entry.Name == ".." {
+			continue
+		}
+		child, ok := copies[entry.Inode]
+		if !ok {
+			child, err = f.copyTree(entry.Inode, frozen, copies)
+			if err == ErrFileNotFound {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		err = f.linkCopy(copied, entry.Name, child)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// the copy keeps the times of the source, they changed as it was filled
+	copied.atime = inode.atime
+	copied.mtime = inode.mtime
+	return copied, f.WriteInode(copied)
+}
+
+// linkCopy adds a copied file to a directory, with ".." for directories
+func (f *FileSystem) linkCopy(dir *Inode, name string, file *Inode) error {
+	err := f.AddFile(dir, name, file)
+	if err != nil {
+		return err
+	}
+	if file.fileType == DIRECTORY {
+		// ".." isn't a change of the copy
+		mtime := file.mtime
+		err = f.AddFile(file, "..", dir)
+		if err != nil {
+			return err
+		}
+		file.mtime = mtime
+		return f.WriteInode(file)
+	}
+	return nil
+}
+
+// removeTree unlinks the name and everything under it, the caller holds
+// the lock of the directory
+func (f *FileSystem) removeTree(dir *Inode, name string) error {
+	id, err := f.FindEntry(dir, name)
+	if err != nil {
+		return err
+	}
+	lock := f.locks.Inode(id)
+	lock.Lock()
+	defer lock.Unlock()
+	file, err := f.ReadInode(id)
+	if err != nil {
+		return err
+	}
+	if file.fileType == DIRECTORY {
+		entries, err := f.ReadDirectory(&file)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.Name == "." || entry.Name == ".." {
+				continue
+			}
+			err = f.removeTree(&file, entry.Name)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = f.RemoveFile(&file, ".")
+		if err != nil {
+			return err
+		}
+		_, err = f.RemoveFile(&file, "..")
+		if err != nil {
+			return err
+		}
+		// ".." was pointing to the directory, so its link counter has changed
+		*dir, err = f.ReadInode(dir.id)
+		if err != nil {
+			return err
+		}
+	}
+	file, err = f.RemoveFile(dir, name)
+	if err != nil {
+		return err
+	}
+	if file.linkCount == 0 {
+		return f.releaseUnlinked(&file)
+	}
+	return nil
+}
+
+// CreateSnapshot freezes the current tree under the name
+func (f *FileSystem) CreateSnapshot(name string) error {
+	if err := f.writable(); err != nil {
+		return err
+	}
+	err := checkSnapshotName(name)
+	if err != nil {
+		return err
+	}
+	// taking, dropping and restoring snapshots is left to root
+	if f.Session.uid != 0 {
+		return ErrPermission
+	}
+	f.locks.snapshots.Lock()
+	defer f.locks.snapshots.Unlock()
+	// the directory of the snapshots may need one more
+	extra := int64(0)
+	if f.snapshotsInode() == NO_INODE {
+		extra = 1
+	}
+	err = f.checkFreeInodes(f.Superblock.Root, extra)
+	if err != nil {
+		return err
+	}
+	snapshots, err := f.snapshotsDir()
+	if err != nil {
+		return err
+	}
+	lock := f.locks.Inode(snapshots)
+	lock.Lock()
+	defer lock.Unlock()
+	dir, err := f.ReadInode(snapshots)
+	if err != nil {
+		return err
+	}
+	_, err = f.FindEntry(&dir, name)
+	if err == nil {
+		return ErrFileExists
+	}
+	if err != ErrFileNotFound {
+		return err
+	}
+	copies := map[int64]*Inode{}
+	root, err := f.copyTree(f.Superblock.Root, true, copies)
+	if err == nil {
+		err = f.linkCopy(&dir, name, root)
+	}
+	if err != nil {
+		f.dropCopies(copies)
+		return err
+	}
+	return f.commit()
+}
+
+// ListSnapshots returns the names of the snapshots, sorted
+func (f *FileSystem) ListSnapshots() ([]string, error) {
+	snapshots := f.snapshotsInode()
+	if snapshots == NO_INODE {
+		return []string{}, nil
+	}
+	entries, err := f.List(snapshots)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, entry := range entries {
+		if entry.Name != "." && entry.Name != ".." {
+			names = append(names, entry.Name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (f *FileSystem) DeleteSnapshot(name string) error {
+	if err := f.writable(); err != nil {
+		return err
+	}
+	err := checkSnapshotName(name)
+	if err != nil {
+		return err
+	}
+	// taking, dropping and restoring snapshots is left to root
+	if f.Session.uid != 0 {
+		return ErrPermission
+	}
+	f.locks.snapshots.Lock()
+	defer f.locks.snapshots.Unlock()
+	snapshots := f.snapshotsInode()
+	if snapshots == NO_INODE {
+		return ErrFileNotFound
+	}
+	lock := f.locks.Inode(snapshots)
+	lock.Lock()
+	defer lock.Unlock()
+	dir, err := f.ReadInode(snapshots)
+	if err != nil {
+		return err
+	}
+	err = f.removeTree(&dir, name)
+	if err != nil {
+		return err
+	}
+	return f.commit()
+}
+
+// RollbackSnapshot replaces the current tree with a copy of the snapshot,
+// the snapshot itself is kept. The working directory moves to the root.
+// The files of the snapshot are copied before the current tree is
+// dropped, so a failed copy leaves the tree as it was.
+func (f *FileSystem) RollbackSnapshot(name string) error {
+	if err := f.writable(); err != nil {
+		return err
+	}
+	err := checkSnapshotName(name)
+	if err != nil {
+		return err
+	}
+	// taking, dropping and restoring snapshots is left to root
+	if f.Session.uid != 0 {
+		return ErrPermission
+	}
+	f.locks.snapshots.Lock()
+	defer f.locks.snapshots.Unlock()
+	snapshots := f.snapshotsInode()
+	if snapshots == NO_INODE {
+		return ErrFileNotFound
+	}
+	snapshot, err := f.Lookup(snapshots, name)
+	if err != nil {
+		return err
+	}
+	snapshotLock := f.locks.Inode(snapshot)
+	snapshotLock.RLock()
+	src, err := f.ReadInode(snapshot)
+	var entries []Entry
+	if err == nil {
+		entries, err = f.ReadDirectory(&src)
+	}
+	var attrs map[string][]byte
+	if err == nil {
+		attrs, err = f.readXattrs(&src)
+	}
+	snapshotLock.RUnlock()
+	if err != nil {
+		return err
+	}
+	// the current tree is still there while the snapshot is copied
+	err = f.checkFreeInodes(snapshot, -1)
+	if err != nil {
+		return err
+	}
+	copies := map[int64]*Inode{}
+	children := []*Inode{}
+	for _, entry := range entries {
+		if entry.Name == "." || entry.Name == ".." {
+			continue
+		}
+		child, ok := copies[entry.Inode]
+		if !ok {
+			child, err = f.copyTree(entry.Inode, false, copies)
+			if err != nil {
+				f.dropCopies(copies)
+				return err
+			}
+		}
+		children = append(children, child)
+	}
+	rootLock := f.locks.Inode(f.Superblock.Root)
+	rootLock.Lock()
+	defer rootLock.Unlock()
+	root, err := f.ReadInode(f.Superblock.Root)
+	if err == nil {
+		err = f.dropTree(&root)
+	}
+	if err != nil {
+		f.dropCopies(copies)
+		return err
+	}
+	// the snapshot's root is copied into the existing root, so the root
+	// keeps its inode
+	root.mode = src.mode
+	root.gid = src.gid
+	err = f.recharge(&root, func() {
+		root.uid = src.uid
+		root.project = src.project
+	})
+	if err != nil {
+		return err
+	}
+	err = f.writeXattrs(&root, attrs)
+	if err != nil {
+		return err
+	}
+	i := 0
+	for _, entry := range entries {
+		if entry.Name == "." || entry.Name == ".." {
+			continue
+		}
+		err = f.linkCopy(&root, entry.Name, children[i])
+		if err != nil {
+			return err
+		}
+		i++
+	}
+	f.Session.pwd = f.Superblock.Root
+	return f.commit()
+}
+
+// dropTree removes everything in the directory, the caller holds its lock
+func (f *FileSystem) dropTree(dir *Inode) error {
+	entries, err := f.ReadDirectory(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name == "." || entry.Name == ".." {
+			continue
+		}
+		err = f.removeTree(dir, entry.Name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
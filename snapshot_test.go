@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// putFile writes the data to the file at the path, it's made if it's
+// missing and truncated if it isn't
+func putFile(f *FileSystem, path string, data []byte) error {
+	fd, err := f.Open(f.Superblock.Root, path, O_WRONLY|O_CREAT|O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	err = f.WriteCmd(fd, string(data))
+	closeErr := f.CloseCmd(fd)
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// getFile reads the file at the path
+func getFile(f *FileSystem, path string) ([]byte, error) {
+	stat, err := f.StatCmd(f.Superblock.Root, path)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := f.Open(f.Superblock.Root, path, O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.CloseCmd(fd)
+	data, err := f.ReadCmd(fd, stat.size)
+	return []byte(data), err
+}
+
+// fillWithOrphans takes every free block with open unlinked files, which
+// nothing in the tree links to. The files are closed at the end of the
+// test.
+func fillWithOrphans(t *testing.T, f *FileSystem) {
+	t.Helper()
+	root := f.Superblock.Root
+	block := string(bytes.Repeat([]byte("o"), BLOCK_SIZE))
+	for i := 0; ; i++ {
+		name := fmt.Sprintf("orphan%d", i)
+		fd, err := f.Open(root, name, O_RDWR|O_CREAT, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.CloseCmd(fd) })
+		if err := f.UnlinkCmd(root, name); err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < DIRECT_LINKS; j++ {
+			err = f.WriteCmd(fd, block)
+			if errors.Is(err, ErrNoSpace) {
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestSnapshotKeepsTree(t *testing.T) {
+	f := newTestFileSystem(t, MountOptions{})
+	root := f.Superblock.Root
+	if err := f.MkdirCmd(root, "d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := putFile(f, "d/a", []byte("before")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.CreateSnapshot("s"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.CreateSnapshot("s"); !errors.Is(err, ErrFileExists) {
+		t.Fatalf("second snapshot with the name: %v", err)
+	}
+	if err := putFile(f, "d/a", []byte("after!")); err != nil {
+		t.Fatal(err)
+	}
+	if err := putFile(f, "b", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := getFile(f, "/.snapshots/s/d/a"); err != nil || string(data) != "before" {
+		t.Fatalf("snapshot holds %q: %v", data, err)
+	}
+	if err := putFile(f, "/.snapshots/s/d/a", []byte("x")); !errors.Is(err, ErrReadOnlySnapshot) {
+		t.Fatalf("write to the snapshot: %v", err)
+	}
+	if names, err := f.ListSnapshots(); err != nil || len(names) != 1 || names[0] != "s" {
+		t.Fatalf("snapshots %v: %v", names, err)
+	}
+	checkClean(t, f)
+	if err := f.RollbackSnapshot("s"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := getFile(f, "d/a"); err != nil || string(data) != "before" {
+		t.Fatalf("rolled back file holds %q: %v", data, err)
+	}
+	if _, err := f.StatCmd(root, "b"); !errors.Is(err, ErrFileNotFound) {
+		t.Fatalf("file made after the snapshot: %v", err)
+	}
+	// the rolled back files can be changed again
+	if err := putFile(f, "d/a", []byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.DeleteSnapshot("s"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.StatCmd(root, "/.snapshots/s"); !errors.Is(err, ErrFileNotFound) {
+		t.Fatalf("deleted snapshot: %v", err)
+	}
+	checkClean(t, f)
+}
+
+func TestSnapshotWithoutFreeInodes(t *testing.T) {
+	f := newTestFileSystem(t, MountOptions{})
+	root := f.Superblock.Root
+	// with the root more than half of the inodes are used
+	for i := 0; i < 35; i++ {
+		if err := f.CreateCmd(root, fmt.Sprintf("f%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	used := usedInodes(t, f)
+	if err := f.CreateSnapshot("s"); !errors.Is(err, ErrNoInodes) {
+		t.Fatalf("snapshot without enough inodes: %v", err)
+	}
+	if usedInodes(t, f) != used {
+		t.Fatalf("%d inodes are used after the failed snapshot, not %d", usedInodes(t, f), used)
+	}
+	checkClean(t, f)
+}
+
+func TestSnapshotWithoutSpace(t *testing.T) {
+	f := newTestFileSystem(t, MountOptions{})
+	root := f.Superblock.Root
+	for i := 0; i < 8; i++ {
+		if err := f.MkdirCmd(root, fmt.Sprintf("d%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the directory of the snapshots is made on the first one
+	if err := f.CreateSnapshot("x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.DeleteSnapshot("x"); err != nil {
+		t.Fatal(err)
+	}
+	fillWithOrphans(t, f)
+	// the copies of the directories need more blocks than are left
+	for i := 0; i < 4; i++ {
+		if err := f.UnlinkCmd(root, fmt.Sprintf("d%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	used := usedInodes(t, f)
+	free := f.StatFS().FreeBlocks
+	if err := f.CreateSnapshot("s"); !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("snapshot without space: %v", err)
+	}
+	if usedInodes(t, f) != used || f.StatFS().FreeBlocks != free {
+		t.Fatal("the failed snapshot wasn't freed")
+	}
+	checkClean(t, f)
+}
+
+func TestRollbackWithoutSpace(t *testing.T) {
+	f := newTestFileSystem(t, MountOptions{})
+	root := f.Superblock.Root
+	for i := 0; i < 8; i++ {
+		if err := f.MkdirCmd(root, fmt.Sprintf("d%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.PutCmd(root, "keep", []byte("kept")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.CreateSnapshot("s"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		if err := f.UnlinkCmd(root, fmt.Sprintf("d%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.MkdirCmd(root, "x"); err != nil {
+		t.Fatal(err)
+	}
+	// dropping the tree frees nothing, the data of keep is in the snapshot,
+	// and the copies of the directories need more blocks than are left
+	fillWithOrphans(t, f)
+	if err := f.UnlinkCmd(root, "x"); err != nil {
+		t.Fatal(err)
+	}
+	free := f.StatFS().FreeBlocks
+	if err := f.RollbackSnapshot("s"); !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("rollback without space: %v", err)
+	}
+	entries, err := f.List(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ".", ".." and keep
+	if len(entries) != 3 {
+		t.Fatalf("%d entries in the root after the failed rollback", len(entries))
+	}
+	if data, err := f.GetCmd(root, "keep"); err != nil || string(data) != "kept" {
+		t.Fatalf("keep holds %q: %v", data, err)
+	}
+	if f.StatFS().FreeBlocks != free {
+		t.Fatal("the failed rollback wasn't freed")
+	}
+	checkClean(t, f)
+}
@@ -0,0 +1,76 @@
+package main
+
+import "math/bits"
+
+// StatFS describes the image, the sizes are in blocks of BlockSize bytes.
+// The available blocks and inodes are the free ones the session can use,
+// they're fewer when its user has a hard quota.
+type StatFS struct {
+	BlockSize       int64 `json:"block_size"`
+	Blocks          int64 `json:"blocks"`
+	FreeBlocks      int64 `json:"free_blocks"`
+	AvailableBlocks int64 `json:"available_blocks"`
+	Inodes          int64 `json:"inodes"`
+	FreeInodes      int64 `json:"free_inodes"`
+	AvailableInodes int64 `json:"available_inodes"`
+	NameMax         int64 `json:"name_max"`
+	MaxFileSize     int64 `json:"max_file_size"`
+}
+
+func (f *FileSystem) StatFS() StatFS {
+	f.locks.blockBitmap.Lock()
+	freeBlocks := f.freeBlocks
+	f.locks.blockBitmap.Unlock()
+	f.locks.inodeBitmap.Lock()
+	freeInodes := f.freeInodes
+	f.locks.inodeBitmap.Unlock()
+	stat := StatFS{
+		BlockSize:       BLOCK_SIZE,
+		Blocks:          f.usableBlocks(),
+		FreeBlocks:      freeBlocks,
+		AvailableBlocks: freeBlocks,
+		Inodes:          f.Superblock.InodeCount,
+		FreeInodes:      freeInodes,
+		AvailableInodes: freeInodes,
+		NameMax:         NAME_MAX,
+		MaxFileSize:     MAX_FILE_SIZE,
+	}
+	if f.Session.uid != 0 {
+		blocks, inodes := f.quotas.headroom(QuotaKey{Type: USER_QUOTA, Id: f.Session.uid})
+		if blocks != -1 && blocks < stat.AvailableBlocks {
+			stat.AvailableBlocks = blocks
+		}
+		if inodes != -1 && inodes < stat.AvailableInodes {
+			stat.AvailableInodes = inodes
+		}
+	}
+	return stat
+}
+
+// countFree sets the counters of the free blocks and inodes from the bitmaps
+func (f *FileSystem) countFree() error {
+	used, err := f.countBits(f.Superblock.BlockBitmapOffset, f.Superblock.BlockCount/8)
+	if err != nil {
+		return err
+	}
+	f.freeBlocks = f.usableBlocks() - used
+	used, err = f.countBits(f.Superblock.InodeBitmapOffset, f.Superblock.InodeCount/8)
+	if err != nil {
+		return err
+	}
+	f.freeInodes = f.Superblock.InodeCount - used
+	return nil
+}
+
+// countBits returns the number of bits set in the bitmap
+func (f *FileSystem) countBits(offset int64, size int64) (int64, error) {
+	bitmap, err := f.readBitmap(offset, size)
+	if err != nil {
+		return 0, err
+	}
+	var count int64
+	for _, word := range bitmap {
+		count += int64(bits.OnesCount8(word))
+	}
+	return count, nil
+}
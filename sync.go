@@ -0,0 +1,143 @@
+package main
+
+import "time"
+
+// flusher writes the cache back periodically, see MountOptions.FlushInterval
+type flusher struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (f *FileSystem) startFlusher() {
+	if f.Options.FlushInterval <= 0 {
+		return
+	}
+	fl := &flusher{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	f.flusher = fl
+	go func() {
+		defer close(fl.done)
+		ticker := time.NewTicker(f.Options.FlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				// a failed flush is retried on the next tick and
+				// reported by Close
+				f.Sync()
+			case <-fl.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (f *FileSystem) stopFlusher() {
+	if f.flusher == nil {
+		return
+	}
+	close(f.flusher.stop)
+	<-f.flusher.done
+	f.flusher = nil
+}
+
+// Sync writes every cached inode and block, and the superblock, to the
+// image, punches the freed blocks and waits until the host has stored them
+func (f *FileSystem) Sync() error {
+	if f.Options.ReadOnly {
+		return nil
+	}
+	err := f.saveQuotas()
+	if err != nil {
+		return err
+	}
+	err = f.FlushCache()
+	if err != nil {
+		return err
+	}
+	err = f.WriteSuperblock()
+	if err != nil {
+		return err
+	}
+	err = f.discardFreed()
+	if err != nil {
+		return err
+	}
+	return f.Device.Sync()
+}
+
+// commit is called at the end of every update, with MountOptions.Sync the
+// update is on disk when it returns
+func (f *FileSystem) commit() error {
+	if !f.Options.Sync {
+		return nil
+	}
+	return f.Sync()
+}
+
+func (f *FileSystem) flushData(inode *Inode) error {
+	for _, block := range inode.dataBlocks() {
+		err := f.blocks.FlushKey(block)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Fsync writes the data and the inode of the open file to the image
+func (f *FileSystem) Fsync(fd Fkey) error {
+	fileDesc, err := f.getFd(fd)
+	if err != nil {
+		return err
+	}
+	lock := f.locks.Inode(fileDesc.inode)
+	lock.RLock()
+	defer lock.RUnlock()
+	inode, err := f.ReadInode(fileDesc.inode)
+	if err != nil {
+		return err
+	}
+	err = f.flushData(&inode)
+	if err != nil {
+		return err
+	}
+	err = f.inodes.FlushKey(inode.id)
+	if err != nil {
+		return err
+	}
+	return f.Device.Sync()
+}
+
+// Fdatasync is like Fsync, but the inode is written only when it's needed
+// to read the data back, that is when the size or the blocks have changed
+func (f *FileSystem) Fdatasync(fd Fkey) error {
+	fileDesc, err := f.getFd(fd)
+	if err != nil {
+		return err
+	}
+	lock := f.locks.Inode(fileDesc.inode)
+	lock.RLock()
+	defer lock.RUnlock()
+	inode, err := f.ReadInode(fileDesc.inode)
+	if err != nil {
+		return err
+	}
+	err = f.flushData(&inode)
+	if err != nil {
+		return err
+	}
+	stored, err := f.readInodeFromDisk(inode.id)
+	if err != nil {
+		return err
+	}
+	if stored.Size != inode.Size || stored.Blocks != inode.Blocks {
+		err = f.inodes.FlushKey(inode.id)
+		if err != nil {
+			return err
+		}
+	}
+	return f.Device.Sync()
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeNew writes the data to a new file in the root
+func writeNew(t *testing.T, f *FileSystem, name string, data string) {
+	t.Helper()
+	file, err := f.Create(f.Superblock.Root, name, REGULAR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteFile(file, 0, []byte(data)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// onDisk tells if the data is in the image file
+func onDisk(t *testing.T, path string, data string) bool {
+	t.Helper()
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Contains(raw, []byte(data))
+}
+
+func TestSyncWritesCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "img")
+	f, err := NewFileSystem(64, path, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	writeNew(t, f, "a", "cached until sync")
+	if onDisk(t, path, "cached until sync") {
+		t.Fatal("the data was written before the sync")
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if !onDisk(t, path, "cached until sync") {
+		t.Fatal("the data isn't on disk after the sync")
+	}
+}
+
+func TestSyncMount(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "img")
+	f, err := NewFileSystem(64, path, MountOptions{Sync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	writeNew(t, f, "a", "written at once")
+	if !onDisk(t, path, "written at once") {
+		t.Fatal("the data isn't on disk after the update")
+	}
+}
+
+func TestFlushInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "img")
+	f, err := NewFileSystem(64, path, MountOptions{FlushInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	writeNew(t, f, "a", "flushed later")
+	for start := time.Now(); !onDisk(t, path, "flushed later"); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("the cache wasn't flushed")
+		}
+	}
+}
+
+func TestFsyncAndFdatasync(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "img")
+	f, err := NewFileSystem(64, path, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := f.Superblock.Root
+	fd, err := f.Open(root, "a", O_RDWR|O_CREAT, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.WriteCmd(fd, "fsync data"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Fsync(fd); err != nil {
+		t.Fatal(err)
+	}
+	if !onDisk(t, path, "fsync data") {
+		t.Fatal("the data isn't on disk after fsync")
+	}
+	// the file grows, so its inode is written too
+	if err := f.WriteCmd(fd, " and fdatasync"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Fdatasync(fd); err != nil {
+		t.Fatal(err)
+	}
+	if !onDisk(t, path, "fsync data and fdatasync") {
+		t.Fatal("the data isn't on disk after fdatasync")
+	}
+	id, err := f.Lookup(root, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := f.readInodeFromDisk(id)
+	if err != nil || stored.Size != 24 {
+		t.Fatalf("size %d on disk: %v", stored.Size, err)
+	}
+	if err := f.CloseCmd(fd); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
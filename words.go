@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The REPL splits its lines like a shell:
+//
+//	'...'    is taken as it is
+//	"..."    expands $name, ${name} and the escapes
+//	\n \t \r \0 \\ \" \' \$ \xHH are the escapes, outside of quotes too
+//	# text   is a comment when it starts a word that isn't quoted
+//	< path   is replaced by the content of the host file
+//	> path   writes what the command prints to the file of the image,
+//	>> path  adds it at the end of the file
+//
+// The data of write and read can be text, hex (-x) or base64 (-b).
+
+var ErrUnterminatedQuote error = errors.New("quote is not closed")
+
+// word is a word of a line, the quoted ones are never comments,
+// redirections or the "=" of an assignment
+type word struct {
+	text   string
+	quoted bool
+}
+
+type lineParser struct {
+	vars map[string]string
+	line string
+	pos  int
+}
+
+// splitLine splits the line into words, variables and escapes are
+// replaced and the comment is dropped
+func (r *Repl) splitLine(line string) ([]word, error) {
+	p := &lineParser{vars: r.vars, line: line}
+	words := []word{}
+	for {
+		for p.pos < len(line) && isSpace(line[p.pos]) {
+			p.pos++
+		}
+		if p.pos == len(line) || line[p.pos] == '#' {
+			return words, nil
+		}
+		w, err := p.word()
+		if err != nil {
+			return nil, err
+		}
+		words = append(words, w)
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+func (p *lineParser) word() (word, error) {
+	var text strings.Builder
+	w := word{}
+	for p.pos < len(p.line) && !isSpace(p.line[p.pos]) {
+		c := p.line[p.pos]
+		switch c {
+		case '\'':
+			end := strings.IndexByte(p.line[p.pos+1:], '\'')
+			if end < 0 {
+				return w, ErrUnterminatedQuote
+			}
+			text.WriteString(p.line[p.pos+1 : p.pos+1+end])
+			p.pos += end + 2
+			w.quoted = true
+		case '"':
+			p.pos++
+			for p.pos < len(p.line) && p.line[p.pos] != '"' {
+				err := p.char(&text)
+				if err != nil {
+					return w, err
+				}
+			}
+			if p.pos == len(p.line) {
+				return w, ErrUnterminatedQuote
+			}
+			p.pos++
+			w.quoted = true
+		default:
+			err := p.char(&text)
+			if err != nil {
+				return w, err
+			}
+		}
+	}
+	w.text = text.String()
+	return w, nil
+}
+
+// char writes the next character, an escape or a variable
+func (p *lineParser) char(text *strings.Builder) error {
+	c := p.line[p.pos]
+	switch c {
+	case '\\':
+		return p.escape(text)
+	case '$':
+		return p.variable(text)
+	}
+	text.WriteByte(c)
+	p.pos++
+	return nil
+}
+
+func (p *lineParser) escape(text *strings.Builder) error {
+	if p.pos+1 == len(p.line) {
+		return errors.New("escape at the end of the line")
+	}
+	c := p.line[p.pos+1]
+	p.pos += 2
+	switch c {
+	case 'n':
+		text.WriteByte('\n')
+	case 't':
+		text.WriteByte('\t')
+	case 'r':
+		text.WriteByte('\r')
+	case '0':
+		text.WriteByte(0)
+	case 'x':
+		if p.pos+2 > len(p.line) {
+			return errors.New("\\x needs two hex digits")
+		}
+		b, err := strconv.ParseUint(p.line[p.pos:p.pos+2], 16, 8)
+		if err != nil {
+			return errors.New("\\x needs two hex digits")
+		}
+		text.WriteByte(byte(b))
+		p.pos += 2
+	default:
+		// \\, \", \', \$, \# and the space are taken as they are
+		text.WriteByte(c)
+	}
+	return nil
+}
+
+func (p *lineParser) variable(text *strings.Builder) error {
+	start := p.pos + 1
+	end := start
+	braced := start < len(p.line) && p.line[start] == '{'
+	if braced {
+		start++
+		end = strings.IndexByte(p.line[start:], '}')
+		if end < 0 {
+			return errors.New("${ is not closed")
+		}
+		end += start
+	} else {
+		for end < len(p.line) && isVariableName(p.line[start:end+1]) {
+			end++
+		}
+	}
+	name := p.line[start:end]
+	if name == "" {
+		// a lone $ is kept
+		text.WriteByte('$')
+		p.pos++
+		return nil
+	}
+	value, ok := p.vars[name]
+	if !ok {
+		return fmt.Errorf("variable $%s is not set", name)
+	}
+	text.WriteString(value)
+	p.pos = end
+	if braced {
+		p.pos++
+	}
+	return nil
+}
+
+// output is the file of the image the command prints to
+type output struct {
+	path   string
+	append bool
+}
+
+func (o output) write(fs *FileSystem, data []byte) error {
+	if o.append {
+		return fs.AppendCmd(fs.Session.pwd, o.path, data)
+	}
+	return fs.PutCmd(fs.Session.pwd, o.path, data)
+}
+
+// redirect replaces "< path" with the content of the host file and takes
+// out "> path" and ">> path"
+func redirect(words []word) ([]word, output, error) {
+	out := output{}
+	result := make([]word, 0, len(words))
+	for i := 0; i < len(words); i++ {
+		w := words[i]
+		op := ""
+		for _, prefix := range []string{">>", ">", "<"} {
+			if !w.quoted && strings.HasPrefix(w.text, prefix) {
+				op = prefix
+				break
+			}
+		}
+		if op == "" {
+			result = append(result, w)
+			continue
+		}
+		path := w.text[len(op):]
+		if path == "" {
+			if i+1 == len(words) {
+				return nil, out, fmt.Errorf("%s needs a file", op)
+			}
+			i++
+			path = words[i].text
+		}
+		if op != "<" {
+			out = output{path: path, append: op == ">>"}
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, out, err
+		}
+		result = append(result, word{text: string(data), quoted: true})
+	}
+	return result, out, nil
+}
+
+// dataMode is how write takes and read shows the data
+type dataMode int
+
+const (
+	TEXT_DATA dataMode = iota
+	HEX_DATA
+	BASE64_DATA
+)
+
+func (m dataMode) String() string {
+	switch m {
+	case HEX_DATA:
+		return "hex"
+	case BASE64_DATA:
+		return "base64"
+	}
+	return "text"
+}
+
+// parseDataMode takes the -x or -b option from the front of the args
+func parseDataMode(args []interface{}) (dataMode, []interface{}) {
+	if len(args) > 0 {
+		switch args[0].(string) {
+		case "-x":
+			return HEX_DATA, args[1:]
+		case "-b":
+			return BASE64_DATA, args[1:]
+		}
+	}
+	return TEXT_DATA, args
+}
+
+func (m dataMode) decode(text string) ([]byte, error) {
+	switch m {
+	case HEX_DATA:
+		return hex.DecodeString(strings.Join(strings.Fields(text), ""))
+	case BASE64_DATA:
+		return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(text), ""))
+	}
+	return []byte(text), nil
+}
+
+func (m dataMode) encode(data []byte) string {
+	switch m {
+	case HEX_DATA:
+		return hex.EncodeToString(data)
+	case BASE64_DATA:
+		return base64.StdEncoding.EncodeToString(data)
+	}
+	return string(data)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSplitLine(t *testing.T) {
+	r := &Repl{vars: map[string]string{"fd": "3", "name": "a b"}}
+	for _, test := range []struct {
+		line  string
+		words []word
+	}{
+		{"write  $fd\thello", []word{{"write", false}, {"3", false}, {"hello", false}}},
+		{`write $fd "hello world"`, []word{{"write", false}, {"3", false}, {"hello world", true}}},
+		{`echo '$name\n' "$name\n" ${name}x`, []word{{"echo", false}, {`$name\n`, true}, {"a b\n", true}, {"a bx", false}}},
+		{`echo a\ b \x41\t\0 \$fd \#x`, []word{{"echo", false}, {"a b", false}, {"A\t\x00", false}, {"$fd", false}, {"#x", false}}},
+		{`echo it"'"s '#' $ # the rest`, []word{{"echo", false}, {"it's", true}, {"#", true}, {"$", false}}},
+		{"# only a comment", []word{}},
+		{"x = ''", []word{{"x", false}, {"=", false}, {"", true}}},
+	} {
+		words, err := r.splitLine(test.line)
+		if err != nil {
+			t.Errorf("%s: %v", test.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(words, test.words) {
+			t.Errorf("%s: split into %+v", test.line, words)
+		}
+	}
+	for _, line := range []string{`echo "open`, "echo 'open", `echo end\`, `echo \xZZ`, "echo $unset", "echo ${fd"} {
+		if _, err := r.splitLine(line); err == nil {
+			t.Errorf("%s: split without an error", line)
+		}
+	}
+	if _, err := r.splitLine(`echo "open`); !errors.Is(err, ErrUnterminatedQuote) {
+		t.Errorf("unterminated quote: %v", err)
+	}
+}
+
+func TestRedirectInput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data")
+	if err := os.WriteFile(path, []byte("from the host"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	words, _, err := redirect([]word{{"write", false}, {"3", false}, {"<", false}, {path, false}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(words, []word{{"write", false}, {"3", false}, {"from the host", true}}) {
+		t.Fatalf("redirected into %+v", words)
+	}
+	// a quoted < is an argument
+	words, _, err = redirect([]word{{"echo", false}, {"<", true}})
+	if err != nil || len(words) != 2 {
+		t.Fatalf("quoted <: %+v %v", words, err)
+	}
+}
+
+func TestDataModes(t *testing.T) {
+	data := []byte{0, 1, 'a', 0xff}
+	for _, mode := range []dataMode{TEXT_DATA, HEX_DATA, BASE64_DATA} {
+		decoded, err := mode.decode(mode.encode(data))
+		if err != nil || !reflect.DeepEqual(decoded, data) {
+			t.Errorf("%v: %v %v", mode, decoded, err)
+		}
+	}
+	// spaces between the digits are dropped
+	if decoded, err := HEX_DATA.decode("00 01\n61 ff"); err != nil || !reflect.DeepEqual(decoded, data) {
+		t.Errorf("hex with spaces: %v %v", decoded, err)
+	}
+	mode, args := parseDataMode([]interface{}{"-b", "AAFh/w=="})
+	if mode != BASE64_DATA || len(args) != 1 {
+		t.Errorf("-b parsed as %v %v", mode, args)
+	}
+}
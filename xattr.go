@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/binary"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+const (
+	XATTR_INLINE_SIZE = 64
+	XATTR_NAME_MAX    = 255
+	// entry header: name length and value length
+	XATTR_HEADER_SIZE = 1 + 2
+	// values up to this size are preferably kept in the inode
+	XATTR_INLINE_VALUE_MAX = 32
+)
+
+const (
+	// fail if the attribute exists
+	XATTR_CREATE = 0x1
+	// fail if the attribute doesn't exist
+	XATTR_REPLACE = 0x2
+)
+
+var XATTR_NAMESPACES = []string{"user.", "trusted.", "system."}
+
+var ErrNoXattr error = newError("no such attribute", ENOATTR)
+var ErrXattrExists error = newError("attribute already exists", syscall.EEXIST)
+var ErrXattrNamespace error = newError("unsupported attribute namespace", syscall.ENOTSUP)
+var ErrXattrName error = newError("invalid attribute name", syscall.EINVAL)
+var ErrXattrNoSpace error = newError("no space left for attributes", syscall.ENOSPC)
+
+// Attributes are stored as a list of entries: the name length (1 byte),
+// the value length (2 bytes), the name and the value. A zero name length
+// ends the list. Small values are kept inline in the inode, the rest goes
+// to the inode's xattr block.
+
+func checkXattrName(name string) error {
+	if len(name) > XATTR_NAME_MAX {
+		return ErrXattrName
+	}
+	for _, namespace := range XATTR_NAMESPACES {
+		if strings.HasPrefix(name, namespace) {
+			if len(name) == len(namespace) {
+				return ErrXattrName
+			}
+			return nil
+		}
+	}
+	return ErrXattrNamespace
+}
+
+func decodeXattrs(data []byte, attrs map[string][]byte) {
+	for len(data) >= XATTR_HEADER_SIZE && data[0] != 0 {
+		nameLen := int(data[0])
+		valueLen := int(binary.BigEndian.Uint16(data[1:]))
+		data = data[XATTR_HEADER_SIZE:]
+		if nameLen+valueLen > len(data) {
+			return
+		}
+		value := make([]byte, valueLen)
+		copy(value, data[nameLen:nameLen+valueLen])
+		attrs[string(data[:nameLen])] = value
+		data = data[nameLen+valueLen:]
+	}
+}
+
+func encodeXattr(data []byte, name string, value []byte) []byte {
+	data = append(data, byte(len(name)))
+	data = binary.BigEndian.AppendUint16(data, uint16(len(value)))
+	data = append(data, name...)
+	return append(data, value...)
+}
+
+// xattrAccess checks the permission to use the attribute. Trusted ones are
+// only for root, system ones can be changed by the owner, user ones follow
+// the permissions of the file.
+func (f *FileSystem) xattrAccess(inode *Inode, name string, want uint16) error {
+	uid := f.Session.uid
+	switch {
+	case want == MAY_WRITE && inode.flags&FLAG_SNAPSHOT != 0:
+		return ErrReadOnlySnapshot
+	case uid == 0:
+		return nil
+	case strings.HasPrefix(name, "trusted."):
+		return ErrPermission
+	case strings.HasPrefix(name, "system."):
+		if want == MAY_WRITE && uid != inode.uid {
+			return ErrPermission
+		}
+		return nil
+	default:
+		return f.access(inode, want)
+	}
+}
+
+// readXattrs returns all attributes of the inode, the caller holds its lock
+func (f *FileSystem) readXattrs(inode *Inode) (map[string][]byte, error) {
+	attrs := make(map[string][]byte)
+	decodeXattrs(inode.xattrs[:], attrs)
+	if inode.xattrBlock != NO_BLOCK {
+		data, err := f.readBlock(Block(inode.xattrBlock))
+		if err != nil {
+			return nil, err
+		}
+		decodeXattrs(data, attrs)
+	}
+	return attrs, nil
+}
+
+// writeXattrs replaces all attributes of the inode, the caller holds its
+// lock
+func (f *FileSystem) writeXattrs(inode *Inode, attrs map[string][]byte) error {
+	// small entries go first, so most of them end up inline
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a := len(names[i]) + len(attrs[names[i]])
+		b := len(names[j]) + len(attrs[names[j]])
+		if a != b {
+			return a < b
+		}
+		return names[i] < names[j]
+	})
+	inline := []byte{}
+	block := []byte{}
+	for _, name := range names {
+		value := attrs[name]
+		size := XATTR_HEADER_SIZE + len(name) + len(value)
+		if len(value) <= XATTR_INLINE_VALUE_MAX && len(inline)+size <= XATTR_INLINE_SIZE {
+			inline = encodeXattr(inline, name, value)
+		} else if len(block)+size <= BLOCK_SIZE {
+			block = encodeXattr(block, name, value)
+		} else {
+			return ErrXattrNoSpace
+		}
+	}
+	if len(block) != 0 && inode.xattrBlock == NO_BLOCK {
+		newBlock, err := f.AllocateBlock(inode)
+		if err != nil {
+			return err
+		}
+		inode.xattrBlock = int64(newBlock)
+	}
+	if len(block) != 0 {
+		data := make([]byte, BLOCK_SIZE)
+		copy(data, block)
+		err := f.blocks.Put(Block(inode.xattrBlock), data)
+		if err != nil {
+			return err
+		}
+	} else if inode.xattrBlock != NO_BLOCK {
+		// nothing is left in the block
+		err := f.FreeBlock(inode, Block(inode.xattrBlock))
+		if err != nil {
+			return err
+		}
+		inode.xattrBlock = NO_BLOCK
+	}
+	inode.xattrs = [XATTR_INLINE_SIZE]byte{}
+	copy(inode.xattrs[:], inline)
+	inode.touchChanged()
+	return f.WriteInode(inode)
+}
+
+func (f *FileSystem) SetXattr(file int64, name string, value []byte, flags int) error {
+	if err := f.writable(); err != nil {
+		return err
+	}
+	err := checkXattrName(name)
+	if err != nil {
+		return err
+	}
+	if XATTR_HEADER_SIZE+len(name)+len(value) > BLOCK_SIZE {
+		return ErrXattrNoSpace
+	}
+	lock := f.locks.Inode(file)
+	lock.Lock()
+	defer lock.Unlock()
+	inode, err := f.ReadInode(file)
+	if err != nil {
+		return err
+	}
+	err = f.xattrAccess(&inode, name, MAY_WRITE)
+	if err != nil {
+		return err
+	}
+	attrs, err := f.readXattrs(&inode)
+	if err != nil {
+		return err
+	}
+	_, exists := attrs[name]
+	if exists && flags&XATTR_CREATE != 0 {
+		return ErrXattrExists
+	}
+	if !exists && flags&XATTR_REPLACE != 0 {
+		return ErrNoXattr
+	}
+	// the ACLs are checked and keep the mode bits in sync, like SetACL
+	if kind, ok := aclType(name); ok {
+		err = f.setACLXattr(&inode, kind, value)
+	} else {
+		attrs[name] = value
+		err = f.writeXattrs(&inode, attrs)
+	}
+	if err != nil {
+		return err
+	}
+	return f.commit()
+}
+
+// setACLXattr stores the raw value of an ACL attribute, the caller holds
+// the lock of the inode
+func (f *FileSystem) setACLXattr(inode *Inode, kind ACLType, value []byte) error {
+	acl, err := decodeACL(value)
+	if err != nil {
+		return err
+	}
+	if kind == ACL_TYPE_DEFAULT && inode.fileType != DIRECTORY {
+		return ErrFileIsNotDir
+	}
+	return f.writeACL(inode, kind, acl)
+}
+
+func (f *FileSystem) GetXattr(file int64, name string) ([]byte, error) {
+	err := checkXattrName(name)
+	if err != nil {
+		return nil, err
+	}
+	lock := f.locks.Inode(file)
+	lock.RLock()
+	defer lock.RUnlock()
+	inode, err := f.ReadInode(file)
+	if err != nil {
+		return nil, err
+	}
+	err = f.xattrAccess(&inode, name, MAY_READ)
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := f.readXattrs(&inode)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := attrs[name]
+	if !ok {
+		return nil, ErrNoXattr
+	}
+	return value, nil
+}
+
+// ListXattr returns the names of the attributes, sorted
+func (f *FileSystem) ListXattr(file int64) ([]string, error) {
+	lock := f.locks.Inode(file)
+	lock.RLock()
+	defer lock.RUnlock()
+	inode, err := f.ReadInode(file)
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := f.readXattrs(&inode)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		// hide the attributes the session can't read
+		if f.xattrAccess(&inode, name, MAY_READ) == nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (f *FileSystem) RemoveXattr(file int64, name string) error {
+	if err := f.writable(); err != nil {
+		return err
+	}
+	err := checkXattrName(name)
+	if err != nil {
+		return err
+	}
+	lock := f.locks.Inode(file)
+	lock.Lock()
+	defer lock.Unlock()
+	inode, err := f.ReadInode(file)
+	if err != nil {
+		return err
+	}
+	err = f.xattrAccess(&inode, name, MAY_WRITE)
+	if err != nil {
+		return err
+	}
+	attrs, err := f.readXattrs(&inode)
+	if err != nil {
+		return err
+	}
+	if _, ok := attrs[name]; !ok {
+		return ErrNoXattr
+	}
+	delete(attrs, name)
+	err = f.writeXattrs(&inode, attrs)
+	if err != nil {
+		return err
+	}
+	return f.commit()
+}